@@ -6,17 +6,28 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"golang.org/x/sync/singleflight"
 	"golang.org/x/time/rate"
 )
 
-// The zero value ('BaseDirectory{}') is a usable Directory.
+// The zero value ('BaseDirectory{}') is a usable Directory, but does not limit requests to the PLC directory at all; [NewBaseDirectory] sets up a limiter by default.
+//
+// BaseDirectory does not cache results; wrap it in a [CacheDirectory] for that (and [CacheDirectory.Prefetch], to warm the cache ahead of time).
+//
+// A BaseDirectory holds internal state (in-flight request coalescing, PLC backoff), so must not be copied after first use; pass it around by pointer.
 type BaseDirectory struct {
+	_ noCopy
+
 	// if non-empty, this string should have URL method, hostname, and optional port; it should not have a path or trailing slash
 	PLCURL string
-	// If not nil, this limiter will be used to rate-limit requests to the PLCURL
+	// If not nil, this limiter will be used to rate-limit requests to the PLCURL. Superseded by a "plc" entry in MethodLimiters, if there is one
 	PLCLimiter *rate.Limiter
+	// Rate limiters for DID resolution requests, keyed by DID method (eg, "plc", "web"). Methods without an entry are not limited (except by PLCLimiter, for backwards compatibility)
+	MethodLimiters map[string]*rate.Limiter
 	// If not nil, this function will be called inline with DID Web lookups, and can be used to limit the number of requests to a given hostname
 	DIDWebLimitFunc func(ctx context.Context, hostname string) error
 	// HTTP client used for did:web, did:plc, and HTTP (well-known) handle resolution
@@ -29,9 +40,61 @@ type BaseDirectory struct {
 	SkipDNSDomainSuffixes []string
 	// set of fallback DNS servers (eg, domain registrars) to try as a fallback. each entry should be "ip:port", eg "8.8.8.8:53"
 	FallbackDNSServers []string
+	// if true, handles which resolve via DNS are also checked against HTTP well-known resolution, and resolution fails with ErrHandleConflict if the two return different DIDs. This doubles the cost of handle resolution, so is mostly useful for auditing
+	HandleCrossCheck bool
+	// Timeout for DID resolution, applied only if the context passed in has no deadline (an explicit deadline always takes precedence, including the first caller's deadline for coalesced ResolveDID calls). Defaults to DefaultResolveTimeout if zero; a negative value disables the timeout, except that coalesced ResolveDID requests are still bounded by DefaultResolveTimeout
+	ResolveTimeout time.Duration
+	// If true, did:web documents are rejected (with ErrUntrustedController) unless every verification method is controlled by the DID itself, or by one of AllowedDIDWebControllers. This guards against a compromised or misconfigured web server delegating control of an identity elsewhere. Off by default, as some did:web documents in the wild are not this strict
+	VerifyDIDWebControllers bool
+	// Additional controllers accepted when VerifyDIDWebControllers is set
+	AllowedDIDWebControllers []syntax.DID
+	// User-Agent header sent with all HTTP resolution requests. Operators doing high-volume resolution should set this to something identifying and contactable. Defaults to DefaultUserAgent if empty
+	UserAgent string
+	// Source of time for rate limiting and PLC backoff; the real clock if nil. See Clock
+	Clock Clock
+
+	// set when the PLC directory responds with 429 and a Retry-After header; requests to PLCURL are held until this time
+	plcBackoffLk    sync.Mutex
+	plcBackoffUntil time.Time
+
+	// coalesces concurrent ResolveDID calls for the same DID
+	didGroup singleflight.Group
 }
 
 var _ Directory = (*BaseDirectory)(nil)
+var _ DIDRefresher = (*BaseDirectory)(nil)
+
+// Embedded in structs which must not be copied after first use, so that 'go vet' (copylocks) reports copies
+type noCopy struct{}
+
+func (*noCopy) Lock()   {}
+func (*noCopy) Unlock() {}
+
+// Creates a BaseDirectory which resolves did:plc against plcURL (DefaultPLCURL if empty), with requests rate-limited to plcRate per second, in bursts of up to plcBurst. Zero (or negative) values use DefaultPLCRateLimit and DefaultPLCBurst; pass rate.Inf to disable limiting.
+//
+// Other fields can be set on the returned directory as needed, including replacing PLCLimiter (eg, to share one limiter between several directories).
+func NewBaseDirectory(plcURL string, plcRate rate.Limit, plcBurst int) *BaseDirectory {
+	if plcURL == "" {
+		plcURL = DefaultPLCURL
+	}
+	if plcRate <= 0 {
+		plcRate = DefaultPLCRateLimit
+	}
+	if plcBurst <= 0 {
+		plcBurst = DefaultPLCBurst
+	}
+	return &BaseDirectory{
+		PLCURL:     plcURL,
+		PLCLimiter: rate.NewLimiter(plcRate, plcBurst),
+	}
+}
+
+func (d *BaseDirectory) clock() Clock {
+	if d.Clock == nil {
+		return SystemClock{}
+	}
+	return d.Clock
+}
 
 func (d *BaseDirectory) LookupHandle(ctx context.Context, h syntax.Handle) (*Identity, error) {
 	h = h.Normalize()
@@ -62,24 +125,63 @@ func (d *BaseDirectory) LookupHandle(ctx context.Context, h syntax.Handle) (*Ide
 }
 
 func (d *BaseDirectory) LookupDID(ctx context.Context, did syntax.DID) (*Identity, error) {
-	doc, err := d.ResolveDID(ctx, did)
+	return d.lookupDID(ctx, did)
+}
+
+// Refresh is like LookupDID, but always makes a new DID resolution request, instead of sharing the result of one already in flight (which may have started before a change to the DID document)
+func (d *BaseDirectory) Refresh(ctx context.Context, did syntax.DID) (*Identity, error) {
+	return d.lookupDID(ctx, did, WithFreshResolution())
+}
+
+func (d *BaseDirectory) lookupDID(ctx context.Context, did syntax.DID, opts ...ResolveOpt) (*Identity, error) {
+	doc, err := d.ResolveDID(ctx, did, opts...)
 	if err != nil {
 		return nil, err
 	}
 	ident := ParseIdentity(doc)
+	if err := d.verifyDeclaredHandle(ctx, did, &ident); err != nil {
+		return nil, err
+	}
+	return &ident, nil
+}
+
+// LookupDIDConditional re-resolves a DID for which the caller already has an identity (prev) and the HTTP validators of the DID document it came from. If the server reports the document unchanged, the identity is rebuilt from prev instead of re-parsing a document; the declared handle is re-verified either way, since handle resolution can change independently of the DID document. If prev or validators is nil, this is a regular lookup, coalesced with concurrent lookups of the DID as with LookupDID.
+//
+// Returns the validators for the document, which are nil if the server did not send any.
+func (d *BaseDirectory) LookupDIDConditional(ctx context.Context, did syntax.DID, prev *Identity, validators *DocValidators) (*Identity, *DocValidators, error) {
+	if prev == nil {
+		validators = nil
+	}
+	doc, validators, err := d.ResolveDIDConditional(ctx, did, validators)
+	var ident Identity
+	if errors.Is(err, ErrDIDNotModified) {
+		ident = *prev
+		ident.ParsedPublicKey = nil
+	} else if err != nil {
+		return nil, nil, err
+	} else {
+		ident = ParseIdentity(doc)
+	}
+	if err := d.verifyDeclaredHandle(ctx, did, &ident); err != nil {
+		return nil, nil, err
+	}
+	return &ident, validators, nil
+}
+
+// Sets ident.Handle to the handle declared in the identity, if it is well-formed and resolves back to the DID, or to syntax.HandleInvalid otherwise. Also pre-parses the public key.
+func (d *BaseDirectory) verifyDeclaredHandle(ctx context.Context, did syntax.DID, ident *Identity) error {
 	declared, err := ident.DeclaredHandle()
-	if errors.Is(err, ErrHandleNotDeclared) {
+	if err != nil {
+		// no handle, or a malformed one: the identity is still usable, just without a handle
 		ident.Handle = syntax.HandleInvalid
-	} else if err != nil {
-		return nil, err
 	} else {
 		// if a handle was declared, resolve it
 		resolvedDID, err := d.ResolveHandle(ctx, declared)
 		if err != nil {
-			if errors.Is(err, ErrHandleNotFound) || errors.Is(err, ErrHandleResolutionFailed) {
+			if errors.Is(err, ErrHandleNotFound) || errors.Is(err, ErrHandleResolutionFailed) || errors.Is(err, ErrHandleConflict) {
 				ident.Handle = syntax.HandleInvalid
 			} else {
-				return nil, err
+				return err
 			}
 		} else if resolvedDID != did {
 			ident.Handle = syntax.HandleInvalid
@@ -93,7 +195,28 @@ func (d *BaseDirectory) LookupDID(ctx context.Context, did syntax.DID) (*Identit
 	if nil == err {
 		ident.ParsedPublicKey = pk
 	}
-	return &ident, nil
+	return nil
+}
+
+// Maximum number of nested DID and handle resolutions in a single chain (see ErrResolutionLoop)
+const maxResolutionDepth = 8
+
+type resolutionChainKey struct{}
+
+// Records a DID or handle resolution in the chain carried by ctx, returning a context to use for the resolution itself (including any callbacks, like DIDWebLimitFunc). Resolutions are single-hop today, but this keeps any nested resolution (eg, a custom directory or limit func which resolves another identity) from looping forever, or deadlocking on DID request coalescing.
+func enterResolution(ctx context.Context, ident string) (context.Context, error) {
+	chain, _ := ctx.Value(resolutionChainKey{}).([]string)
+	for _, prev := range chain {
+		if prev == ident {
+			return nil, fmt.Errorf("%w: %s is already being resolved", ErrResolutionLoop, ident)
+		}
+	}
+	if len(chain) >= maxResolutionDepth {
+		return nil, fmt.Errorf("%w: more than %d nested resolutions", ErrResolutionLoop, maxResolutionDepth)
+	}
+	next := make([]string, len(chain), len(chain)+1)
+	copy(next, chain)
+	return context.WithValue(ctx, resolutionChainKey{}, append(next, ident)), nil
 }
 
 func (d *BaseDirectory) Lookup(ctx context.Context, a syntax.AtIdentifier) (*Identity, error) {
@@ -14,10 +14,15 @@ import (
 )
 
 type CacheDirectory struct {
-	Inner             Directory
-	ErrTTL            time.Duration
-	handleCache       *expirable.LRU[syntax.Handle, HandleEntry]
-	identityCache     *expirable.LRU[syntax.DID, IdentityEntry]
+	Inner  Directory
+	ErrTTL time.Duration
+	// Source of time for entry expiry; the real clock if nil. See Clock
+	Clock         Clock
+	hitTTL        time.Duration
+	handleCache   *expirable.LRU[syntax.Handle, HandleEntry]
+	identityCache *expirable.LRU[syntax.DID, IdentityEntry]
+	// successful entries which have validators are kept here for longer than the regular cache TTL, so that if Inner implements ConditionalDIDLookup, expired entries can be revalidated with a conditional request
+	revalidateCache   *expirable.LRU[syntax.DID, IdentityEntry]
 	didLookupChans    sync.Map
 	handleLookupChans sync.Map
 }
@@ -32,6 +37,8 @@ type IdentityEntry struct {
 	Updated  time.Time
 	Identity *Identity
 	Err      error
+	// HTTP validators of the DID document the identity was resolved from, if the inner directory supports conditional lookups and the server sent any
+	Validators *DocValidators
 }
 
 var handleCacheHits = promauto.NewCounter(prometheus.CounterOpts{
@@ -64,37 +71,61 @@ var handleRequestsCoalesced = promauto.NewCounter(prometheus.CounterOpts{
 	Help: "Number of handle requests coalesced",
 })
 
+var identityRefreshUnchanged = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "atproto_directory_identity_refresh_unchanged",
+	Help: "Number of identity re-resolutions where the DID document and handle were unchanged",
+})
+
 var _ Directory = (*CacheDirectory)(nil)
+var _ DIDRefresher = (*CacheDirectory)(nil)
+
+// How much longer than the hit TTL identities are retained for conditional revalidation
+const revalidateTTLFactor = 4
 
 // Capacity of zero means unlimited size. Similarly, ttl of zero means unlimited duration.
+//
+// If inner implements ConditionalDIDLookup (as BaseDirectory does), expired identities are refreshed with conditional requests, so unchanged DID documents are not re-downloaded.
 func NewCacheDirectory(inner Directory, capacity int, hitTTL, errTTL time.Duration) CacheDirectory {
 	return CacheDirectory{
-		ErrTTL:        errTTL,
-		Inner:         inner,
-		handleCache:   expirable.NewLRU[syntax.Handle, HandleEntry](capacity, nil, hitTTL),
-		identityCache: expirable.NewLRU[syntax.DID, IdentityEntry](capacity, nil, hitTTL),
+		ErrTTL:          errTTL,
+		Inner:           inner,
+		hitTTL:          hitTTL,
+		handleCache:     expirable.NewLRU[syntax.Handle, HandleEntry](capacity, nil, hitTTL),
+		identityCache:   expirable.NewLRU[syntax.DID, IdentityEntry](capacity, nil, hitTTL),
+		revalidateCache: expirable.NewLRU[syntax.DID, IdentityEntry](capacity, nil, hitTTL*revalidateTTLFactor),
 	}
 }
 
-func (d *CacheDirectory) IsHandleStale(e *HandleEntry) bool {
-	if e.Err != nil && time.Since(e.Updated) > d.ErrTTL {
-		return true
+func (d *CacheDirectory) clock() Clock {
+	if d.Clock == nil {
+		return SystemClock{}
 	}
-	return false
+	return d.Clock
 }
 
-func (d *CacheDirectory) IsIdentityStale(e *IdentityEntry) bool {
-	if e.Err != nil && time.Since(e.Updated) > d.ErrTTL {
-		return true
+// Reports whether an entry updated at the given time has outlived its TTL. The LRUs also evict entries after the hit TTL, on the real clock; this check is what applies the TTLs on d.Clock
+func (d *CacheDirectory) isStale(updated time.Time, err error) bool {
+	age := d.clock().Now().Sub(updated)
+	if err != nil {
+		return age > d.ErrTTL
 	}
-	return false
+	return d.hitTTL > 0 && age > d.hitTTL
+}
+
+func (d *CacheDirectory) IsHandleStale(e *HandleEntry) bool {
+	return d.isStale(e.Updated, e.Err)
+}
+
+func (d *CacheDirectory) IsIdentityStale(e *IdentityEntry) bool {
+	return d.isStale(e.Updated, e.Err)
 }
 
 func (d *CacheDirectory) updateHandle(ctx context.Context, h syntax.Handle) HandleEntry {
 	ident, err := d.Inner.LookupHandle(ctx, h)
+	now := d.clock().Now()
 	if err != nil {
 		he := HandleEntry{
-			Updated: time.Now(),
+			Updated: now,
 			DID:     "",
 			Err:     err,
 		}
@@ -103,12 +134,12 @@ func (d *CacheDirectory) updateHandle(ctx context.Context, h syntax.Handle) Hand
 	}
 
 	entry := IdentityEntry{
-		Updated:  time.Now(),
+		Updated:  now,
 		Identity: ident,
 		Err:      nil,
 	}
 	he := HandleEntry{
-		Updated: time.Now(),
+		Updated: now,
 		DID:     ident.DID,
 		Err:     nil,
 	}
@@ -163,30 +194,93 @@ func (d *CacheDirectory) ResolveHandle(ctx context.Context, h syntax.Handle) (sy
 }
 
 func (d *CacheDirectory) updateDID(ctx context.Context, did syntax.DID) IdentityEntry {
-	ident, err := d.Inner.LookupDID(ctx, did)
+	var ident *Identity
+	var validators *DocValidators
+	var err error
+	if cond, ok := d.Inner.(ConditionalDIDLookup); ok && d.revalidateCache != nil {
+		// only an expired entry with validators is revalidated with a conditional request. Otherwise (eg, a cold miss) this is a regular lookup, which BaseDirectory coalesces with concurrent lookups of the DID, and still returns validators for next time
+		var prev *Identity
+		var prevValidators *DocValidators
+		if old, ok := d.revalidateCache.Peek(did); ok && old.Identity != nil && old.Validators != nil && (old.Validators.ETag != "" || old.Validators.LastModified != "") {
+			prev, prevValidators = old.Identity, old.Validators
+		}
+		ident, validators, err = cond.LookupDIDConditional(ctx, did, prev, prevValidators)
+	} else {
+		ident, err = d.Inner.LookupDID(ctx, did)
+	}
+	return d.storeDID(did, ident, validators, err)
+}
+
+// Caches the result of an identity lookup (including errors), returning the new entry
+func (d *CacheDirectory) storeDID(did syntax.DID, ident *Identity, validators *DocValidators, err error) IdentityEntry {
+	// an unchanged identity is kept as is (including any parsed public key), rather than replaced with an equivalent copy
+	if err == nil {
+		if prev := d.previousIdentity(did); prev != nil && prev.Doc != nil && prev.Handle == ident.Handle && prev.Doc.Equal(ident.Doc) {
+			identityRefreshUnchanged.Inc()
+			ident = prev
+		}
+	}
+
 	// persist the identity lookup error, instead of processing it immediately
+	now := d.clock().Now()
 	entry := IdentityEntry{
-		Updated:  time.Now(),
-		Identity: ident,
-		Err:      err,
+		Updated:    now,
+		Identity:   ident,
+		Err:        err,
+		Validators: validators,
 	}
 	var he *HandleEntry
 	// if *not* an error, then also update the handle cache
 	if nil == err && !ident.Handle.IsInvalidHandle() {
 		he = &HandleEntry{
-			Updated: time.Now(),
+			Updated: now,
 			DID:     did,
 			Err:     nil,
 		}
 	}
 
 	d.identityCache.Add(did, entry)
+	if err == nil && validators != nil && d.revalidateCache != nil {
+		d.revalidateCache.Add(did, entry)
+	}
 	if he != nil {
 		d.handleCache.Add(ident.Handle, *he)
 	}
 	return entry
 }
 
+// Returns the last successfully resolved identity for a DID, if still cached
+func (d *CacheDirectory) previousIdentity(did syntax.DID) *Identity {
+	if old, ok := d.identityCache.Peek(did); ok && old.Err == nil && old.Identity != nil {
+		return old.Identity
+	}
+	if d.revalidateCache != nil {
+		if old, ok := d.revalidateCache.Peek(did); ok {
+			return old.Identity
+		}
+	}
+	return nil
+}
+
+// Refresh looks up the identity for a DID from the inner directory, bypassing the cache (and the inner directory's own caching or coalescing, if it implements DIDRefresher), and overwrites the cached entry with the result. Failures are cached too, as with a regular lookup, rather than leaving a possibly outdated identity in place.
+//
+// This is for acting on fresh key material immediately after a rotation, without waiting for the cached entry to expire.
+func (d *CacheDirectory) Refresh(ctx context.Context, did syntax.DID) (*Identity, error) {
+	var ident *Identity
+	var err error
+	if r, ok := d.Inner.(DIDRefresher); ok {
+		ident, err = r.Refresh(ctx, did)
+	} else {
+		ident, err = d.Inner.LookupDID(ctx, did)
+	}
+	// validators for the old document are no use now
+	if d.revalidateCache != nil {
+		d.revalidateCache.Remove(did)
+	}
+	entry := d.storeDID(did, ident, nil, err)
+	return entry.Identity, entry.Err
+}
+
 func (d *CacheDirectory) LookupDID(ctx context.Context, did syntax.DID) (*Identity, error) {
 	id, _, err := d.LookupDIDWithCacheState(ctx, did)
 	return id, err
@@ -236,6 +330,45 @@ func (d *CacheDirectory) LookupDIDWithCacheState(ctx context.Context, did syntax
 	return nil, false, fmt.Errorf("unexpected control-flow error")
 }
 
+// Prefetch looks up each of the given DIDs, with up to concurrency lookups at a time, so that the identities are cached before they are needed (eg, warming up the cache at startup, from a local index of the accounts a service will be asked about). Rate limits configured on the inner directory still apply. Identities which are already cached are not looked up again, and failures are cached as usual (for ErrTTL).
+//
+// Blocks until all the lookups are done, or ctx is cancelled, and returns the number of lookups which succeeded and failed. DIDs not yet looked up when ctx is cancelled are not counted. Callers can run this in a goroutine to warm the cache in the background.
+//
+// This lives on CacheDirectory rather than BaseDirectory because BaseDirectory keeps no cache of its own, so prefetching through it would resolve every DID and then discard the results. To prefetch with a BaseDirectory, wrap it with NewCacheDirectory.
+func (d *CacheDirectory) Prefetch(ctx context.Context, dids []syntax.DID, concurrency int) (succeeded, failed int) {
+	concurrency = max(1, concurrency)
+
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	sem := make(chan struct{}, concurrency)
+	for _, did := range dids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(did syntax.DID) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			_, err := d.LookupDID(ctx, did)
+			lk.Lock()
+			defer lk.Unlock()
+			if err != nil {
+				failed++
+			} else {
+				succeeded++
+			}
+		}(did)
+	}
+	wg.Wait()
+	return succeeded, failed
+}
+
 func (d *CacheDirectory) LookupHandle(ctx context.Context, h syntax.Handle) (*Identity, error) {
 	ident, _, err := d.LookupHandleWithCacheState(ctx, h)
 	return ident, err
@@ -284,6 +417,9 @@ func (d *CacheDirectory) Purge(ctx context.Context, a syntax.AtIdentifier) error
 	did, err := a.AsDID()
 	if nil == err { // if not an error, is a DID
 		d.identityCache.Remove(did)
+		if d.revalidateCache != nil {
+			d.revalidateCache.Remove(did)
+		}
 		return nil
 	}
 	return fmt.Errorf("at-identifier neither a Handle nor a DID")
@@ -78,7 +78,7 @@ func runResolveHandle(cctx *cli.Context) error {
 	}
 	slog.Info("valid syntax", "handle", handle)
 
-	d := identity.BaseDirectory{}
+	d := &identity.BaseDirectory{}
 	did, err := d.ResolveHandle(ctx, handle)
 	if err != nil {
 		return err
@@ -102,7 +102,7 @@ func runResolveDID(cctx *cli.Context) error {
 	}
 	slog.Info("valid syntax", "did", did)
 
-	d := identity.BaseDirectory{}
+	d := &identity.BaseDirectory{}
 	doc, err := d.ResolveDID(ctx, did)
 	if err != nil {
 		return err
@@ -2,15 +2,23 @@ package identity
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type DIDDocument struct {
@@ -27,54 +35,467 @@ type DocVerificationMethod struct {
 	PublicKeyMultibase string `json:"publicKeyMultibase"`
 }
 
+// Returns all the atproto handles in the alsoKnownAs list, in order. Entries which are not at:// URIs (eg, mailto: or https: URIs), or which do not parse as a handle, are skipped.
+//
+// As with [Identity.DeclaredHandle], these handles have not been bi-directionally verified.
+func (d *DIDDocument) Handles() []syntax.Handle {
+	var out []syntax.Handle
+	for _, u := range d.AlsoKnownAs {
+		if !strings.HasPrefix(u, "at://") {
+			continue
+		}
+		h, err := syntax.ParseHandle(u[len("at://"):])
+		if err != nil {
+			continue
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// Returns the first valid handle from [DIDDocument.Handles], or ErrHandleNotDeclared if there are none.
+func (d *DIDDocument) PrimaryHandle() (syntax.Handle, error) {
+	hdls := d.Handles()
+	if len(hdls) == 0 {
+		return "", ErrHandleNotDeclared
+	}
+	return hdls[0], nil
+}
+
+// Reports whether d and other are equivalent documents. The slice fields are compared ignoring order, so re-ordering entries is not a change (even though re-ordering alsoKnownAs can change [DIDDocument.PrimaryHandle]). Two nil documents are equal.
+func (d *DIDDocument) Equal(other *DIDDocument) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+	return d.DID == other.DID &&
+		sameElements(d.AlsoKnownAs, other.AlsoKnownAs, strings.Compare) &&
+		sameElements(d.VerificationMethod, other.VerificationMethod, compareVerificationMethods) &&
+		sameElements(d.Service, other.Service, compareServices)
+}
+
+// Returns a copy of the document which shares no slices with d
+func (d *DIDDocument) clone() *DIDDocument {
+	return &DIDDocument{
+		DID:                d.DID,
+		AlsoKnownAs:        slices.Clone(d.AlsoKnownAs),
+		VerificationMethod: slices.Clone(d.VerificationMethod),
+		Service:            slices.Clone(d.Service),
+	}
+}
+
+// Describes how other (the newer document) differs from d, as human-readable lines, eg for auditing handle changes and key rotations. Verification methods and services are matched up by ID. Returns nil if the documents are [DIDDocument.Equal].
+func (d *DIDDocument) Diff(other *DIDDocument) []string {
+	if d.Equal(other) {
+		return nil
+	}
+	if d == nil {
+		d = &DIDDocument{}
+	}
+	if other == nil {
+		other = &DIDDocument{}
+	}
+
+	var out []string
+	if d.DID != other.DID {
+		out = append(out, fmt.Sprintf("DID changed: %s -> %s", d.DID, other.DID))
+	}
+
+	for _, u := range d.AlsoKnownAs {
+		if !slices.Contains(other.AlsoKnownAs, u) {
+			out = append(out, describeAlsoKnownAs(u, "removed"))
+		}
+	}
+	for _, u := range other.AlsoKnownAs {
+		if !slices.Contains(d.AlsoKnownAs, u) {
+			out = append(out, describeAlsoKnownAs(u, "added"))
+		}
+	}
+
+	oldKeys := indexByID(d.VerificationMethod, func(vm DocVerificationMethod) string { return vm.ID })
+	newKeys := indexByID(other.VerificationMethod, func(vm DocVerificationMethod) string { return vm.ID })
+	for _, vm := range d.VerificationMethod {
+		nvm, ok := newKeys[vm.ID]
+		if !ok {
+			out = append(out, fmt.Sprintf("key removed: %s", vm.ID))
+			continue
+		}
+		if oldKeys[vm.ID] != vm {
+			// duplicate ID; only the first entry counts
+			continue
+		}
+		if nvm.PublicKeyMultibase != vm.PublicKeyMultibase {
+			out = append(out, fmt.Sprintf("key rotated: %s: %s -> %s", vm.ID, vm.PublicKeyMultibase, nvm.PublicKeyMultibase))
+		}
+		if nvm.Type != vm.Type {
+			out = append(out, fmt.Sprintf("key type changed: %s: %s -> %s", vm.ID, vm.Type, nvm.Type))
+		}
+		if nvm.Controller != vm.Controller {
+			out = append(out, fmt.Sprintf("key controller changed: %s: %s -> %s", vm.ID, vm.Controller, nvm.Controller))
+		}
+	}
+	for _, vm := range other.VerificationMethod {
+		if _, ok := oldKeys[vm.ID]; !ok && newKeys[vm.ID] == vm {
+			out = append(out, fmt.Sprintf("key added: %s (%s)", vm.ID, vm.PublicKeyMultibase))
+		}
+	}
+
+	oldSvcs := indexByID(d.Service, func(s DocService) string { return s.ID })
+	newSvcs := indexByID(other.Service, func(s DocService) string { return s.ID })
+	for _, s := range d.Service {
+		ns, ok := newSvcs[s.ID]
+		if !ok {
+			out = append(out, fmt.Sprintf("service removed: %s", s.ID))
+			continue
+		}
+		if oldSvcs[s.ID] != s {
+			continue
+		}
+		if ns.ServiceEndpoint != s.ServiceEndpoint {
+			out = append(out, fmt.Sprintf("service endpoint changed: %s: %s -> %s", s.ID, s.ServiceEndpoint, ns.ServiceEndpoint))
+		}
+		if ns.Type != s.Type {
+			out = append(out, fmt.Sprintf("service type changed: %s: %s -> %s", s.ID, s.Type, ns.Type))
+		}
+	}
+	for _, s := range other.Service {
+		if _, ok := oldSvcs[s.ID]; !ok && newSvcs[s.ID] == s {
+			out = append(out, fmt.Sprintf("service added: %s (%s)", s.ID, s.ServiceEndpoint))
+		}
+	}
+
+	if len(out) == 0 {
+		// only the number of duplicated entries differs
+		out = append(out, "duplicate entries changed")
+	}
+	return out
+}
+
+func describeAlsoKnownAs(u, change string) string {
+	if strings.HasPrefix(u, "at://") {
+		if h, err := syntax.ParseHandle(u[len("at://"):]); err == nil {
+			return fmt.Sprintf("handle %s: %s", change, h)
+		}
+	}
+	return fmt.Sprintf("alsoKnownAs %s: %s", change, u)
+}
+
+// Maps IDs to entries; as with [ParseIdentity], the first entry wins if an ID is repeated
+func indexByID[T any](entries []T, id func(T) string) map[string]T {
+	out := make(map[string]T, len(entries))
+	for _, e := range entries {
+		if _, ok := out[id(e)]; !ok {
+			out[id(e)] = e
+		}
+	}
+	return out
+}
+
+func sameElements[T comparable](a, b []T, cmp func(T, T) int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.SortFunc(a, cmp)
+	slices.SortFunc(b, cmp)
+	return slices.Equal(a, b)
+}
+
+func compareVerificationMethods(a, b DocVerificationMethod) int {
+	if c := strings.Compare(a.ID, b.ID); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Type, b.Type); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Controller, b.Controller); c != 0 {
+		return c
+	}
+	return strings.Compare(a.PublicKeyMultibase, b.PublicKeyMultibase)
+}
+
+func compareServices(a, b DocService) int {
+	if c := strings.Compare(a.ID, b.ID); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Type, b.Type); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ServiceEndpoint, b.ServiceEndpoint)
+}
+
 type DocService struct {
 	ID              string `json:"id"`
 	Type            string `json:"type"`
 	ServiceEndpoint string `json:"serviceEndpoint"`
 }
 
-// WARNING: this does *not* bi-directionally verify account metadata; it only implements direct DID-to-DID-document lookup for the supported DID methods, and parses the resulting DID Doc into an Identity struct
-func (d *BaseDirectory) ResolveDID(ctx context.Context, did syntax.DID) (*DIDDocument, error) {
+// Returned (wrapped) when a DID resolution HTTP request returns an unexpected status code. Wraps ErrDIDResolutionFailed, so callers can use either errors.Is with the sentinel, or errors.As to branch on the status code (eg, backing off on 429).
+type DIDHTTPError struct {
+	StatusCode int
+	// DID method being resolved, eg "plc" or "web"
+	Method string
+	// For 429 responses, the delay requested by the server via the Retry-After header (zero if not provided)
+	RetryAfter time.Duration
+}
+
+func (e *DIDHTTPError) Error() string {
+	return fmt.Sprintf("%s: did:%s HTTP status %d", ErrDIDResolutionFailed, e.Method, e.StatusCode)
+}
+
+func (e *DIDHTTPError) Unwrap() error {
+	return ErrDIDResolutionFailed
+}
+
+var didResolutionsCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "atproto_directory_did_resolutions_coalesced",
+	Help: "Number of DID resolutions which shared an already in-flight request",
+})
+
+var didResolutionsNotModified = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "atproto_directory_did_resolutions_not_modified",
+	Help: "Number of conditional DID resolutions where the server reported the document unchanged",
+})
+
+// Per-call override for DID resolution, passed to [BaseDirectory.ResolveDID]. This avoids mutating BaseDirectory fields (which is racy) for one-off calls.
+type ResolveOpt func(*resolveOptions)
+
+type resolveOptions struct {
+	plcURL         string
+	insecureDIDWeb bool
+	fresh          bool
+}
+
+// Resolves did:plc against this PLC directory (eg, a mirror, or the new directory during a migration) instead of BaseDirectory.PLCURL. The PLC Retry-After backoff for BaseDirectory.PLCURL does not apply, but PLC rate limiters do
+func WithPLCURL(url string) ResolveOpt {
+	return func(o *resolveOptions) {
+		o.plcURL = url
+	}
+}
+
+// Fetches did:web documents over plain http:// instead of https://. Only for local testing
+func WithInsecureDIDWeb() ResolveOpt {
+	return func(o *resolveOptions) {
+		o.insecureDIDWeb = true
+	}
+}
+
+// Always makes a new request, instead of sharing the result of a concurrent in-flight resolution of the same DID (eg, when the caller knows the document has just changed)
+func WithFreshResolution() ResolveOpt {
+	return func(o *resolveOptions) {
+		o.fresh = true
+	}
+}
+
+func collectResolveOpts(opts []ResolveOpt) *resolveOptions {
+	o := &resolveOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WARNING: this does *not* bi-directionally verify account metadata; it only implements direct DID-to-DID-document lookup for the supported DID methods. Most callers want [BaseDirectory.LookupDID] instead, which also parses the document into an [Identity] (with verified handle and pre-parsed signing key)
+//
+// Concurrent calls for the same DID (and options) are coalesced into a single network request, unless WithFreshResolution is passed. The shared request is not cancelled if one caller's context is (each caller stops waiting when its own context is done), but it is bound by the first caller's deadline, and is always bounded even if ResolveTimeout is disabled. Results (including errors) are only shared between concurrent callers, not cached.
+func (d *BaseDirectory) ResolveDID(ctx context.Context, did syntax.DID, opts ...ResolveOpt) (*DIDDocument, error) {
+	doc, _, err := d.resolveDIDCoalesced(ctx, did, collectResolveOpts(opts))
+	return doc, err
+}
+
+// A document and its validators, as shared between coalesced callers
+type resolvedDoc struct {
+	doc        *DIDDocument
+	validators *DocValidators
+}
+
+// Implements ResolveDID, also returning the validators of the document
+func (d *BaseDirectory) resolveDIDCoalesced(ctx context.Context, did syntax.DID, o *resolveOptions) (*DIDDocument, *DocValidators, error) {
+	ctx, err := enterResolution(ctx, did.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrDIDResolutionFailed, err)
+	}
+	if o.fresh {
+		return d.resolveDID(ctx, did, o)
+	}
+
+	// overrides change the result, so only calls with the same overrides are coalesced
+	key := did.String()
+	if o.plcURL != "" || o.insecureDIDWeb {
+		key = fmt.Sprintf("%s|%s|%t", key, o.plcURL, o.insecureDIDWeb)
+	}
+	ch := d.didGroup.DoChan(key, func() (any, error) {
+		sctx, cancel := d.sharedResolveContext(ctx)
+		defer cancel()
+		doc, validators, err := d.resolveDID(sctx, did, o)
+		if err != nil {
+			return nil, err
+		}
+		return &resolvedDoc{doc: doc, validators: validators}, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Shared {
+			didResolutionsCoalesced.Inc()
+		}
+		if res.Err != nil {
+			return nil, nil, res.Err
+		}
+		// each caller gets its own copy, so mutating one doesn't affect the others
+		r := res.Val.(*resolvedDoc)
+		var validators *DocValidators
+		if r.validators != nil {
+			v := *r.validators
+			validators = &v
+		}
+		return r.doc.clone(), validators, nil
+	case <-ctx.Done():
+		return nil, nil, fmt.Errorf("%w: %w", ErrDIDResolutionFailed, ctx.Err())
+	}
+}
+
+func (d *BaseDirectory) resolveDID(ctx context.Context, did syntax.DID, o *resolveOptions) (*DIDDocument, *DocValidators, error) {
 	start := time.Now()
 	switch did.Method() {
 	case "web":
-		doc, err := d.ResolveDIDWeb(ctx, did)
+		doc, validators, err := d.resolveDIDWeb(ctx, did, nil, o)
 		elapsed := time.Since(start)
 		slog.Debug("resolve DID", "did", did, "err", err, "duration_ms", elapsed.Milliseconds())
-		return doc, err
+		return doc, validators, err
 	case "plc":
-		doc, err := d.ResolveDIDPLC(ctx, did)
+		doc, validators, err := d.resolveDIDPLC(ctx, did, nil, o)
 		elapsed := time.Since(start)
 		slog.Debug("resolve DID", "did", did, "err", err, "duration_ms", elapsed.Milliseconds())
-		return doc, err
+		return doc, validators, err
 	default:
-		return nil, fmt.Errorf("DID method not supported: %s", did.Method())
+		return nil, nil, fmt.Errorf("DID method not supported: %s", did.Method())
 	}
 }
 
-func (d *BaseDirectory) ResolveDIDWeb(ctx context.Context, did syntax.DID) (*DIDDocument, error) {
+func (d *BaseDirectory) ResolveDIDWeb(ctx context.Context, did syntax.DID, opts ...ResolveOpt) (*DIDDocument, error) {
+	doc, _, err := d.resolveDIDWeb(ctx, did, nil, collectResolveOpts(opts))
+	return doc, err
+}
+
+func (d *BaseDirectory) resolveDIDWeb(ctx context.Context, did syntax.DID, prev *DocValidators, o *resolveOptions) (*DIDDocument, *DocValidators, error) {
+	ctx, cancel := d.resolveContext(ctx)
+	defer cancel()
+
+	docURL, err := d.didWebRequestURL(ctx, did, o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := d.newRequest(ctx, docURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	prev.setHeaders(req)
+	resp, err := d.doDIDWebRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		didResolutionsNotModified.Inc()
+		return nil, prev, ErrDIDNotModified
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, fmt.Errorf("%w: did:web HTTP status 404", ErrDIDNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &DIDHTTPError{StatusCode: resp.StatusCode, Method: "web"}
+	}
+
+	var doc DIDDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("%w: JSON DID document parse: %w", ErrDIDResolutionFailed, err)
+	}
+	if d.VerifyDIDWebControllers {
+		if err := doc.verifyControllers(did, d.AllowedDIDWebControllers); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrDIDResolutionFailed, err)
+		}
+	}
+	return &doc, validatorsFromResponse(resp), nil
+}
+
+// ProbeDIDWeb checks whether a did:web's DID document exists, with a HEAD request, without downloading or parsing it. Returns false (and no error) if the server responds 404 or 410, or the hostname does not exist. The same hostname validation and rate limits apply as for ResolveDIDWeb.
+//
+// This is a cheap liveness check for scanning many candidate did:webs before fully resolving the survivors. A true result does not mean the document is valid. Servers which do not support HEAD requests (eg, responding 405) return a DIDHTTPError.
+func (d *BaseDirectory) ProbeDIDWeb(ctx context.Context, did syntax.DID, opts ...ResolveOpt) (bool, error) {
+	ctx, cancel := d.resolveContext(ctx)
+	defer cancel()
+
+	docURL, err := d.didWebRequestURL(ctx, did, collectResolveOpts(opts))
+	if err != nil {
+		return false, err
+	}
+
+	req, err := d.newRequest(ctx, docURL)
+	if err != nil {
+		return false, err
+	}
+	req.Method = http.MethodHead
+	resp, err := d.doDIDWebRequest(req)
+	if errors.Is(err, ErrDIDNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound, http.StatusGone:
+		return false, nil
+	default:
+		return false, &DIDHTTPError{StatusCode: resp.StatusCode, Method: "web"}
+	}
+}
+
+// Validates a did:web, and waits on any rate limits for its hostname, returning the URL its DID document is fetched from
+func (d *BaseDirectory) didWebRequestURL(ctx context.Context, did syntax.DID, o *resolveOptions) (string, error) {
 	if did.Method() != "web" {
-		return nil, fmt.Errorf("expected a did:web, got: %s", did)
+		return "", fmt.Errorf("expected a did:web, got: %s", did)
 	}
-	hostname := did.Identifier()
-	handle, err := syntax.ParseHandle(hostname)
+	docURL, hostname, err := didWebURL(did)
 	if err != nil {
-		return nil, fmt.Errorf("did:web identifier not a simple hostname: %s", hostname)
+		return "", err
 	}
-	if !handle.AllowedTLD() {
-		return nil, fmt.Errorf("did:web hostname has disallowed TLD: %s", hostname)
+	if o.insecureDIDWeb {
+		docURL = "http://" + strings.TrimPrefix(docURL, "https://")
 	}
 
-	// TODO: use a more robust client
-	// TODO: allow ctx to specify unsafe http:// resolution, for testing?
+	if err := d.waitMethodLimiter(ctx, "web"); err != nil {
+		return "", err
+	}
 
 	if d.DIDWebLimitFunc != nil {
 		if err := d.DIDWebLimitFunc(ctx, hostname); err != nil {
-			return nil, fmt.Errorf("did:web limit func returned an error for (%s): %w", hostname, err)
+			return "", fmt.Errorf("did:web limit func returned an error for (%s): %w", hostname, err)
 		}
 	}
+	return docURL, nil
+}
+
+// Maximum number of (same-host) redirects followed when fetching a did:web document
+const maxDIDWebRedirects = 3
 
-	resp, err := http.Get("https://" + hostname + "/.well-known/did.json")
+// Sends a did:web request, classifying transport errors (NXDOMAIN as ErrDIDNotFound, and certificate problems as ErrDIDWebTLS). Redirects are only followed within the DID's own host (see ErrDIDWebRedirect)
+func (d *BaseDirectory) doDIDWebRequest(req *http.Request) (*http.Response, error) {
+	client := d.HTTPClient
+	client.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		if err := checkDIDWebRedirect(next, via); err != nil {
+			return err
+		}
+		if d.HTTPClient.CheckRedirect != nil {
+			return d.HTTPClient.CheckRedirect(next, via)
+		}
+		return nil
+	}
+	resp, err := client.Do(req)
 	// look for NXDOMAIN
 	var dnsErr *net.DNSError
 	if errors.As(err, &dnsErr) {
@@ -83,52 +504,271 @@ func (d *BaseDirectory) ResolveDIDWeb(ctx context.Context, did syntax.DID) (*DID
 		}
 	}
 	if err != nil {
+		if isCertificateError(err) {
+			return nil, fmt.Errorf("%w: %w: %w", ErrDIDResolutionFailed, ErrDIDWebTLS, err)
+		}
 		return nil, fmt.Errorf("%w: did:web HTTP well-known fetch: %w", ErrDIDResolutionFailed, err)
 	}
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("%w: did:web HTTP status 404", ErrDIDNotFound)
+	return resp, nil
+}
+
+// Checks that every verification method in the document is controlled by the DID itself, or by one of the allowed controllers. A missing controller is treated as untrusted.
+func (doc *DIDDocument) verifyControllers(did syntax.DID, allowed []syntax.DID) error {
+	for _, vm := range doc.VerificationMethod {
+		ctrl := syntax.DID(vm.Controller)
+		if ctrl == did || slices.Contains(allowed, ctrl) {
+			continue
+		}
+		return fmt.Errorf("%w: %q controlled by %q", ErrUntrustedController, vm.ID, vm.Controller)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%w: did:web HTTP status %d", ErrDIDResolutionFailed, resp.StatusCode)
+	return nil
+}
+
+// Returns the HTTPS URL of the DID document for a did:web, and the bare hostname. Per the did:web spec, a percent-encoded port may follow the hostname (eg, "did:web:example.com%3A3000"), and further colon-separated segments are path components (in which case the document is at "<path>/did.json" instead of under "/.well-known/").
+func didWebURL(did syntax.DID) (string, string, error) {
+	parts := strings.Split(did.Identifier(), ":")
+
+	hostname := parts[0]
+	port := ""
+	if i := strings.Index(strings.ToLower(hostname), "%3a"); i >= 0 {
+		hostname, port = hostname[:i], hostname[i+3:]
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 || strconv.Itoa(n) != port {
+			return "", "", fmt.Errorf("did:web identifier has invalid port: %s", did.Identifier())
+		}
+	}
+	handle, err := syntax.ParseHandle(hostname)
+	if err != nil {
+		return "", "", fmt.Errorf("did:web identifier not a simple hostname: %s", hostname)
+	}
+	if !handle.AllowedTLD() {
+		return "", "", fmt.Errorf("did:web hostname has disallowed TLD: %s", hostname)
 	}
 
-	var doc DIDDocument
-	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
-		return nil, fmt.Errorf("%w: JSON DID document parse: %w", ErrDIDResolutionFailed, err)
+	host := hostname
+	if port != "" {
+		host = hostname + ":" + port
+	}
+	if len(parts) == 1 {
+		return "https://" + host + "/.well-known/did.json", hostname, nil
 	}
-	return &doc, nil
+
+	var path strings.Builder
+	for _, seg := range parts[1:] {
+		seg, err := url.PathUnescape(seg)
+		if err != nil || seg == "" || seg == "." || seg == ".." || strings.Contains(seg, "/") {
+			return "", "", fmt.Errorf("did:web identifier has invalid path segment: %s", did.Identifier())
+		}
+		path.WriteString("/" + url.PathEscape(seg))
+	}
+	return "https://" + host + path.String() + "/did.json", hostname, nil
+}
+
+func (d *BaseDirectory) ResolveDIDPLC(ctx context.Context, did syntax.DID, opts ...ResolveOpt) (*DIDDocument, error) {
+	doc, _, err := d.resolveDIDPLC(ctx, did, nil, collectResolveOpts(opts))
+	return doc, err
 }
 
-func (d *BaseDirectory) ResolveDIDPLC(ctx context.Context, did syntax.DID) (*DIDDocument, error) {
+func (d *BaseDirectory) resolveDIDPLC(ctx context.Context, did syntax.DID, prev *DocValidators, o *resolveOptions) (*DIDDocument, *DocValidators, error) {
+	ctx, cancel := d.resolveContext(ctx)
+	defer cancel()
+
 	if did.Method() != "plc" {
-		return nil, fmt.Errorf("expected a did:plc, got: %s", did)
+		return nil, nil, fmt.Errorf("expected a did:plc, got: %s", did)
 	}
 
 	plcURL := d.PLCURL
-	if plcURL == "" {
-		plcURL = DefaultPLCURL
+	if o.plcURL != "" {
+		plcURL = o.plcURL
+	}
+	docURL, err := plcEndpoint(plcURL, did.String())
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if d.PLCLimiter != nil {
-		if err := d.PLCLimiter.Wait(ctx); err != nil {
-			return nil, fmt.Errorf("failed to wait for PLC limiter: %w", err)
+	if o.plcURL != "" {
+		if err := d.waitMethodLimiter(ctx, "plc"); err != nil {
+			return nil, nil, err
 		}
+	} else if err := d.waitPLC(ctx); err != nil {
+		return nil, nil, err
 	}
 
-	resp, err := http.Get(plcURL + "/" + did.String())
+	req, err := d.newRequest(ctx, docURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	prev.setHeaders(req)
+	resp, err := d.HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("%w: PLC directory lookup: %w", ErrDIDResolutionFailed, err)
+		return nil, nil, fmt.Errorf("%w: PLC directory lookup: %w", ErrDIDResolutionFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		didResolutionsNotModified.Inc()
+		return nil, prev, ErrDIDNotModified
 	}
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("%w: PLC directory 404", ErrDIDNotFound)
+		return nil, nil, fmt.Errorf("%w: PLC directory 404", ErrDIDNotFound)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%w: PLC directory status %d", ErrDIDResolutionFailed, resp.StatusCode)
+		// a 429 from an overridden PLC URL says nothing about BaseDirectory.PLCURL
+		return nil, nil, d.plcStatusError(resp, o.plcURL == "")
 	}
 
 	var doc DIDDocument
 	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
-		return nil, fmt.Errorf("%w: JSON DID document parse: %w", ErrDIDResolutionFailed, err)
+		return nil, nil, fmt.Errorf("%w: JSON DID document parse: %w", ErrDIDResolutionFailed, err)
+	}
+	return &doc, validatorsFromResponse(resp), nil
+}
+
+// HTTP cache validators from a DID document response, used to make conditional requests when re-resolving the DID
+type DocValidators struct {
+	ETag         string
+	LastModified string
+}
+
+func validatorsFromResponse(resp *http.Response) *DocValidators {
+	v := &DocValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if v.ETag == "" && v.LastModified == "" {
+		return nil
+	}
+	return v
+}
+
+// Sets conditional request headers; a no-op on nil
+func (v *DocValidators) setHeaders(req *http.Request) {
+	if v == nil {
+		return
+	}
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// ResolveDIDConditional is like ResolveDID, but if prev is not nil, makes a conditional request (If-None-Match / If-Modified-Since) and returns ErrDIDNotModified (along with prev) if the server responds that the document has not changed. Otherwise returns the document and the validators from the response, which are nil if the server sent none.
+//
+// Conditional requests are not coalesced with concurrent calls, but if prev is nil, this is a regular resolution, and is coalesced as with ResolveDID.
+func (d *BaseDirectory) ResolveDIDConditional(ctx context.Context, did syntax.DID, prev *DocValidators) (*DIDDocument, *DocValidators, error) {
+	if prev == nil {
+		return d.resolveDIDCoalesced(ctx, did, &resolveOptions{})
+	}
+	ctx, err := enterResolution(ctx, did.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrDIDResolutionFailed, err)
+	}
+	switch did.Method() {
+	case "web":
+		return d.resolveDIDWeb(ctx, did, prev, &resolveOptions{})
+	case "plc":
+		return d.resolveDIDPLC(ctx, did, prev, &resolveOptions{})
+	default:
+		return nil, nil, fmt.Errorf("DID method not supported: %s", did.Method())
+	}
+}
+
+// Constructs a GET request for identity resolution, with the configured User-Agent
+func (d *BaseDirectory) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("constructing HTTP request for identity resolution: %w", err)
+	}
+	ua := d.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	return req, nil
+}
+
+// Waits on the rate limiter for the given DID method, if any is configured
+func (d *BaseDirectory) waitMethodLimiter(ctx context.Context, method string) error {
+	lim := d.MethodLimiters[method]
+	if lim == nil && method == "plc" {
+		lim = d.PLCLimiter
+	}
+	if lim == nil {
+		return nil
+	}
+
+	// equivalent to lim.Wait, but on the directory's clock
+	now := d.clock().Now()
+	r := lim.ReserveN(now, 1)
+	if !r.OK() {
+		return fmt.Errorf("failed to wait for did:%s limiter: request exceeds burst", method)
+	}
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	// context deadlines are on the real clock
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		r.CancelAt(now)
+		return fmt.Errorf("failed to wait for did:%s limiter: would exceed context deadline", method)
+	}
+	select {
+	case <-d.clock().After(delay):
+		return nil
+	case <-ctx.Done():
+		r.CancelAt(d.clock().Now())
+		return fmt.Errorf("failed to wait for did:%s limiter: %w", method, ctx.Err())
+	}
+}
+
+// Redirect policy for did:web requests: a server can move its DID document around within its own host, but not hand resolution off to another host, which could then serve a document for an identity it does not control
+func checkDIDWebRedirect(next *http.Request, via []*http.Request) error {
+	orig := via[0].URL
+	if len(via) > maxDIDWebRedirects {
+		return fmt.Errorf("%w: more than %d redirects", ErrDIDWebRedirect, maxDIDWebRedirects)
+	}
+	if !strings.EqualFold(next.URL.Host, orig.Host) {
+		return fmt.Errorf("%w: redirected from %s to another host: %s", ErrDIDWebRedirect, orig.Host, next.URL.Host)
+	}
+	if orig.Scheme == "https" && next.URL.Scheme != "https" {
+		return fmt.Errorf("%w: redirected from https to %s", ErrDIDWebRedirect, next.URL.Scheme)
+	}
+	return nil
+}
+
+// Whether an HTTP client error was caused by TLS certificate verification failing
+func isCertificateError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &verifyErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// Context for a resolution shared between coalesced ResolveDID callers. It is detached from the first caller's cancellation, since other callers may be waiting on the result, but keeps that caller's deadline. Without one, ResolveTimeout applies; the shared request is always bounded (by DefaultResolveTimeout, if ResolveTimeout is disabled), so a hung request can't hold up every later caller for the same DID
+func (d *BaseDirectory) sharedResolveContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	shared := context.WithoutCancel(ctx)
+	if dl, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(shared, dl)
+	}
+	if d.ResolveTimeout < 0 {
+		return context.WithTimeout(shared, DefaultResolveTimeout)
+	}
+	return d.resolveContext(shared)
+}
+
+// Applies ResolveTimeout to the context, unless the caller already set a deadline
+func (d *BaseDirectory) resolveContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	timeout := d.ResolveTimeout
+	if timeout == 0 {
+		timeout = DefaultResolveTimeout
+	}
+	if timeout < 0 {
+		return ctx, func() {}
 	}
-	return &doc, nil
+	return context.WithTimeout(ctx, timeout)
 }
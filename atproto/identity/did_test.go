@@ -1,12 +1,25 @@
 package identity
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
 )
 
 func TestDIDDocParse(t *testing.T) {
@@ -42,6 +55,7 @@ func TestDIDDocParse(t *testing.T) {
 		hdl, err := id.DeclaredHandle()
 		assert.NoError(err)
 		assert.Equal("atproto.com", hdl.String())
+		assert.Same(&doc, id.Doc)
 	}
 }
 
@@ -78,3 +92,1054 @@ func TestDIDDocFeedGenParse(t *testing.T) {
 	assert.True(ok)
 	assert.Equal("https://discover.bsky.social", svc.URL)
 }
+
+func TestResolvePLCAuditLog(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	logBytes, err := os.ReadFile("testdata/did_plc_audit_log.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/did:plc:ewvi7nxzyoun6zhxrhs64oiz/log/audit" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(logBytes)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{PLCURL: srv.URL}
+	ops, err := dir.ResolvePLCAuditLog(ctx, syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	assert.NoError(err)
+	assert.Equal(2, len(ops))
+	assert.Equal("plc_operation", ops[0].Operation.Type)
+	assert.Nil(ops[0].Operation.Prev)
+	assert.Equal(ops[0].CID, *ops[1].Operation.Prev)
+	assert.True(ops[0].CreatedAt.Before(ops[1].CreatedAt))
+	assert.NotEmpty(ops[1].Operation.Sig)
+	assert.Contains(string(ops[1].Operation.Raw), "rotationKeys")
+
+	_, err = dir.ResolvePLCAuditLog(ctx, syntax.DID("did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"))
+	assert.ErrorIs(err, ErrDIDNotFound)
+}
+
+func TestResolveDIDPLCHTTPError(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{PLCURL: srv.URL}
+	_, err := dir.ResolveDIDPLC(ctx, syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	assert.ErrorIs(err, ErrDIDResolutionFailed)
+	var httpErr *DIDHTTPError
+	if assert.ErrorAs(err, &httpErr) {
+		assert.Equal(http.StatusTooManyRequests, httpErr.StatusCode)
+		assert.Equal("plc", httpErr.Method)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(time.Duration(0), parseRetryAfter("blah", now))
+	assert.Equal(time.Duration(0), parseRetryAfter("-5", now))
+	assert.Equal(30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(time.Duration(0), parseRetryAfter(now.Add(-time.Hour).Format(http.TimeFormat), now))
+}
+
+func TestResolveDIDPLCRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{PLCURL: srv.URL}
+	_, err := dir.ResolveDIDPLC(ctx, syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	var httpErr *DIDHTTPError
+	if assert.ErrorAs(err, &httpErr) {
+		assert.Equal(10*time.Second, httpErr.RetryAfter)
+	}
+
+	// subsequent requests are held back until the Retry-After has passed
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = dir.ResolveDIDPLC(ctx, syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	assert.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func TestResolveUserAgent(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	uas := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uas <- r.UserAgent()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{PLCURL: srv.URL}
+	dir.ResolveDIDPLC(ctx, syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	assert.Equal(DefaultUserAgent, <-uas)
+
+	dir.UserAgent = "example-indexer/1.0 (ops@example.com)"
+	dir.ResolveDIDPLC(ctx, syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	assert.Equal("example-indexer/1.0 (ops@example.com)", <-uas)
+}
+
+func TestResolveDIDCoalesce(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	docBytes, err := os.ReadFile("testdata/did_plc_doc.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hits atomic.Int64
+	gate := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-gate
+		w.Write(docBytes)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{PLCURL: srv.URL}
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+
+	var wg sync.WaitGroup
+	docs := make([]*DIDDocument, 10)
+	for i := range docs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doc, err := dir.ResolveDID(ctx, did)
+			if assert.NoError(err) {
+				assert.Equal(did, doc.DID)
+			}
+			docs[i] = doc
+		}(i)
+	}
+
+	// wait for the shared request to be in flight, so the short deadline below isn't the one it inherits
+	assert.Eventually(func() bool { return hits.Load() == 1 }, time.Second, time.Millisecond)
+
+	// a caller whose context expires stops waiting, without affecting the others
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = dir.ResolveDID(shortCtx, did)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	close(gate)
+	wg.Wait()
+	assert.Equal(int64(1), hits.Load())
+
+	// coalesced callers get independent copies of the document
+	docs[0].AlsoKnownAs[0] = "at://mutated.example.com"
+	docs[0].VerificationMethod[0].PublicKeyMultibase = "mutated"
+	assert.NotEqual(docs[0].AlsoKnownAs[0], docs[1].AlsoKnownAs[0])
+	assert.NotEqual(docs[0].VerificationMethod[0], docs[1].VerificationMethod[0])
+}
+
+func TestResolveDIDSharedTimeout(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	orig := DefaultResolveTimeout
+	DefaultResolveTimeout = 50 * time.Millisecond
+	defer func() { DefaultResolveTimeout = orig }()
+
+	// even with ResolveTimeout disabled and no caller deadline, a hung shared request is bounded
+	dir := &BaseDirectory{PLCURL: srv.URL, ResolveTimeout: -1}
+	_, err := dir.ResolveDID(ctx, syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	assert.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func TestMethodLimiters(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	// a limiter with zero burst never allows a request
+	blocked := rate.NewLimiter(0, 0)
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+
+	dir := &BaseDirectory{PLCURL: srv.URL, MethodLimiters: map[string]*rate.Limiter{"plc": blocked}}
+	_, err := dir.ResolveDID(ctx, did)
+	assert.Error(err)
+	assert.NotErrorIs(err, ErrDIDNotFound)
+	assert.Equal(int64(0), hits.Load())
+
+	// legacy PLCLimiter field still applies
+	dir = &BaseDirectory{PLCURL: srv.URL, PLCLimiter: blocked}
+	_, err = dir.ResolveDID(ctx, did)
+	assert.Error(err)
+	assert.Equal(int64(0), hits.Load())
+
+	// per-method entry takes precedence over the legacy field
+	dir = &BaseDirectory{PLCURL: srv.URL, PLCLimiter: blocked, MethodLimiters: map[string]*rate.Limiter{"plc": rate.NewLimiter(rate.Inf, 1)}}
+	_, err = dir.ResolveDID(ctx, did)
+	assert.ErrorIs(err, ErrDIDNotFound)
+	assert.Equal(int64(1), hits.Load())
+}
+
+func TestResolveDIDWebTLS(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// test server has a self-signed certificate, which the client does not trust
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{
+		HTTPClient: http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, srv.Listener.Addr().String())
+				},
+			},
+		},
+	}
+	_, err := dir.ResolveDIDWeb(ctx, syntax.DID("did:web:example.com"))
+	assert.ErrorIs(err, ErrDIDWebTLS)
+	assert.ErrorIs(err, ErrDIDResolutionFailed)
+	assert.Contains(err.Error(), "x509")
+}
+
+func TestResolveTimeout(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	docBytes, err := os.ReadFile("testdata/did_plc_doc.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write(docBytes)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{PLCURL: srv.URL, ResolveTimeout: 50 * time.Millisecond}
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+
+	// no caller deadline; ResolveTimeout applies
+	_, err = dir.ResolveDID(ctx, did)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	// an explicit caller deadline takes precedence
+	longCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	doc, err := dir.ResolveDIDPLC(longCtx, did)
+	if assert.NoError(err) {
+		assert.Equal(did, doc.DID)
+	}
+
+	// including on the coalesced ResolveDID path, for deadlines beyond DefaultResolveTimeout
+	longerCtx, cancel := context.WithTimeout(ctx, DefaultResolveTimeout+5*time.Second)
+	defer cancel()
+	doc, err = dir.ResolveDID(longerCtx, did)
+	if assert.NoError(err) {
+		assert.Equal(did, doc.DID)
+	}
+}
+
+func TestDIDWebURL(t *testing.T) {
+	assert := assert.New(t)
+
+	good := map[string]string{
+		"did:web:example.com":                    "https://example.com/.well-known/did.json",
+		"did:web:example.com%3A3000":             "https://example.com:3000/.well-known/did.json",
+		"did:web:example.com%3a3000":             "https://example.com:3000/.well-known/did.json",
+		"did:web:example.com:user:alice":         "https://example.com/user/alice/did.json",
+		"did:web:staging.example.com%3A8443:pds": "https://staging.example.com:8443/pds/did.json",
+	}
+	for raw, expected := range good {
+		u, host, err := didWebURL(syntax.DID(raw))
+		if assert.NoError(err, raw) {
+			assert.Equal(expected, u)
+			assert.NotContains(host, ":")
+		}
+	}
+
+	bad := []string{
+		"did:web:example.com%3A",
+		"did:web:example.com%3A99999",
+		"did:web:example.com%3Aabc",
+		"did:web:example.local%3A3000",
+		"did:web:localhost",
+		"did:web:example.com:..:alice",
+		"did:web:example.com:a%2Fb",
+	}
+	for _, raw := range bad {
+		_, _, err := didWebURL(syntax.DID(raw))
+		assert.Error(err, raw)
+	}
+}
+
+func TestConditionalResolve(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// strip the declared handle, so no handle resolution is attempted
+	docBytes, err := os.ReadFile("testdata/did_plc_doc.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(docBytes, &raw); err != nil {
+		t.Fatal(err)
+	}
+	delete(raw, "alsoKnownAs")
+	docBytes, err = json.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var full, notModified atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(docBytes)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{PLCURL: srv.URL}
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+
+	_, validators, err := dir.ResolveDIDConditional(ctx, did, nil)
+	assert.NoError(err)
+	if assert.NotNil(validators) {
+		assert.Equal(`"v1"`, validators.ETag)
+	}
+	_, _, err = dir.ResolveDIDConditional(ctx, did, validators)
+	assert.ErrorIs(err, ErrDIDNotModified)
+
+	ident, validators, err := dir.LookupDIDConditional(ctx, did, nil, nil)
+	assert.NoError(err)
+	ident2, _, err := dir.LookupDIDConditional(ctx, did, ident, validators)
+	assert.NoError(err)
+	assert.Equal(ident.PDSEndpoint(), ident2.PDSEndpoint())
+	assert.NotNil(ident2.ParsedPublicKey)
+
+	// the cache revalidates expired entries instead of re-fetching
+	full.Store(0)
+	notModified.Store(0)
+	cache := NewCacheDirectory(dir, 100, 10*time.Millisecond, time.Millisecond)
+	_, err = cache.LookupDID(ctx, did)
+	assert.NoError(err)
+	time.Sleep(20 * time.Millisecond)
+	ident, err = cache.LookupDID(ctx, did)
+	assert.NoError(err)
+	assert.Equal(did, ident.DID)
+	assert.Equal(int64(1), full.Load())
+	assert.Equal(int64(1), notModified.Load())
+}
+
+func TestDIDDocHandles(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	doc := DIDDocument{
+		DID: syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"),
+		AlsoKnownAs: []string{
+			"mailto:someone@example.com",
+			"at://not_a_handle",
+			"at://",
+			"at://atproto.com",
+			"https://example.com",
+			"at://second.example.com",
+		},
+	}
+	assert.Equal([]syntax.Handle{"atproto.com", "second.example.com"}, doc.Handles())
+	hdl, err := doc.PrimaryHandle()
+	assert.NoError(err)
+	assert.Equal(syntax.Handle("atproto.com"), hdl)
+
+	_, err = (&DIDDocument{AlsoKnownAs: []string{"at://not_a_handle"}}).PrimaryHandle()
+	assert.ErrorIs(err, ErrHandleNotDeclared)
+
+	// a malformed declared handle doesn't fail the whole lookup
+	doc.AlsoKnownAs = []string{"at://not_a_handle"}
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(docBytes)
+	}))
+	defer srv.Close()
+
+	dir := &BaseDirectory{PLCURL: srv.URL}
+	ident, err := dir.LookupDID(ctx, doc.DID)
+	assert.NoError(err)
+	assert.Equal(syntax.HandleInvalid, ident.Handle)
+}
+
+func TestResolutionLoop(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// a limit func which resolves the same DID again would otherwise deadlock on request coalescing
+	dir := &BaseDirectory{}
+	dir.DIDWebLimitFunc = func(ctx context.Context, hostname string) error {
+		_, err := dir.ResolveDID(ctx, syntax.DID("did:web:"+hostname))
+		return err
+	}
+	_, err := dir.ResolveDID(ctx, syntax.DID("did:web:loop.example.com"))
+	assert.ErrorIs(err, ErrResolutionLoop)
+	assert.ErrorIs(err, ErrDIDResolutionFailed)
+
+	// a chain of distinct DIDs is cut off by depth
+	var depth atomic.Int64
+	dir.DIDWebLimitFunc = func(ctx context.Context, hostname string) error {
+		n := depth.Add(1)
+		_, err := dir.ResolveDID(ctx, syntax.DID(fmt.Sprintf("did:web:hop%d.example.com", n)))
+		return err
+	}
+	_, err = dir.ResolveDID(ctx, syntax.DID("did:web:hop0.example.com"))
+	assert.ErrorIs(err, ErrResolutionLoop)
+	assert.Equal(int64(maxResolutionDepth), depth.Load())
+
+	// sequential resolutions with the same context are not a loop
+	chainCtx, err := enterResolution(ctx, "did:web:a.example.com")
+	assert.NoError(err)
+	_, err = enterResolution(chainCtx, "b.example.com")
+	assert.NoError(err)
+	_, err = enterResolution(chainCtx, "b.example.com")
+	assert.NoError(err)
+	_, err = enterResolution(chainCtx, "did:web:a.example.com")
+	assert.ErrorIs(err, ErrResolutionLoop)
+}
+
+func TestResolveOpts(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	docBytes, err := os.ReadFile("testdata/did_plc_doc.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var primaryHits, mirrorHits atomic.Int64
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		w.Write(docBytes)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorHits.Add(1)
+		if r.URL.Path == "/.well-known/did.json" {
+			w.Write([]byte(`{"id": "did:web:example.com"}`))
+			return
+		}
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer mirror.Close()
+
+	dir := &BaseDirectory{PLCURL: primary.URL}
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+
+	// a rate-limited mirror doesn't pause requests to the primary PLC directory
+	_, err = dir.ResolveDID(ctx, did, WithPLCURL(mirror.URL))
+	var httpErr *DIDHTTPError
+	if assert.ErrorAs(err, &httpErr) {
+		assert.Equal(http.StatusTooManyRequests, httpErr.StatusCode)
+	}
+	assert.Equal(int64(1), mirrorHits.Load())
+
+	start := time.Now()
+	_, err = dir.ResolveDID(ctx, did, WithFreshResolution())
+	assert.NoError(err)
+	assert.Less(time.Since(start), time.Second)
+	assert.Equal(int64(1), primaryHits.Load())
+
+	// did:web over http, with all hostnames dialing the test server
+	mirrorAddr := mirror.Listener.Addr().String()
+	dir.HTTPClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, mirrorAddr)
+		},
+	}
+	doc, err := dir.ResolveDID(ctx, syntax.DID("did:web:example.com"), WithInsecureDIDWeb())
+	assert.NoError(err)
+	if assert.NotNil(doc) {
+		assert.Equal(syntax.DID("did:web:example.com"), doc.DID)
+	}
+	assert.Equal(int64(2), mirrorHits.Load())
+}
+
+func TestCacheRefresh(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+	var pds atomic.Value
+	pds.Store("https://old.example.com")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(DIDDocument{
+			DID: did,
+			Service: []DocService{
+				{ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: pds.Load().(string)},
+			},
+		})
+	}))
+	defer srv.Close()
+
+	cache := NewCacheDirectory(&BaseDirectory{PLCURL: srv.URL}, 100, time.Hour, time.Hour)
+	ident, err := cache.LookupDID(ctx, did)
+	assert.NoError(err)
+	assert.Equal("https://old.example.com", ident.PDSEndpoint())
+
+	pds.Store("https://new.example.com")
+	ident, err = cache.LookupDID(ctx, did)
+	assert.NoError(err)
+	assert.Equal("https://old.example.com", ident.PDSEndpoint())
+
+	ident, err = cache.Refresh(ctx, did)
+	assert.NoError(err)
+	assert.Equal("https://new.example.com", ident.PDSEndpoint())
+
+	// the cached entry was replaced
+	ident, hit, err := cache.LookupDIDWithCacheState(ctx, did)
+	assert.NoError(err)
+	assert.True(hit)
+	assert.Equal("https://new.example.com", ident.PDSEndpoint())
+}
+
+func TestDIDWebControllers(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	controller := "did:web:example.com"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": "did:web:example.com", "verificationMethod": [{"id": "did:web:example.com#atproto", "type": "Multikey", "controller": %q, "publicKeyMultibase": "zQ3shunBKsXixLxKtC5qeSG9E4J5RkGN57im31pcTzbNQnm5w"}]}`, controller)
+	}))
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	dir := &BaseDirectory{VerifyDIDWebControllers: true}
+	dir.HTTPClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	did := syntax.DID("did:web:example.com")
+
+	_, err := dir.ResolveDID(ctx, did, WithInsecureDIDWeb())
+	assert.NoError(err)
+
+	controller = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	_, err = dir.ResolveDID(ctx, did, WithInsecureDIDWeb())
+	assert.ErrorIs(err, ErrUntrustedController)
+	assert.ErrorIs(err, ErrDIDResolutionFailed)
+
+	dir.AllowedDIDWebControllers = []syntax.DID{"did:plc:ewvi7nxzyoun6zhxrhs64oiz"}
+	_, err = dir.ResolveDID(ctx, did, WithInsecureDIDWeb())
+	assert.NoError(err)
+
+	// lenient by default
+	controller = "did:web:elsewhere.example.com"
+	dir.VerifyDIDWebControllers = false
+	_, err = dir.ResolveDID(ctx, did, WithInsecureDIDWeb())
+	assert.NoError(err)
+}
+
+func TestPLCEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	for base, expected := range map[string]string{
+		"":                              "https://plc.directory/did:plc:abc123",
+		"https://plc.directory":         "https://plc.directory/did:plc:abc123",
+		"https://plc.directory/":        "https://plc.directory/did:plc:abc123",
+		"http://localhost:2582/mirror/": "http://localhost:2582/mirror/did:plc:abc123",
+	} {
+		u, err := plcEndpoint(base, "did:plc:abc123")
+		assert.NoError(err, base)
+		assert.Equal(expected, u, base)
+	}
+
+	for _, base := range []string{"plc.directory", "ftp://plc.directory", "https://", "https://plc.directory?x=1", "://bad"} {
+		_, err := plcEndpoint(base, "did:plc:abc123")
+		assert.ErrorIs(err, ErrInvalidPLCURL, base)
+	}
+
+	dir := &BaseDirectory{PLCURL: "plc.directory"}
+	assert.ErrorIs(dir.Validate(), ErrInvalidPLCURL)
+	_, err := dir.ResolveDIDPLC(context.Background(), syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	assert.ErrorIs(err, ErrInvalidPLCURL)
+	dir.PLCURL = ""
+	assert.NoError(dir.Validate())
+}
+
+func TestProbeDIDWeb(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var methods []string
+	var lk sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		methods = append(methods, r.Method)
+		lk.Unlock()
+		switch r.Host {
+		case "live.example.com":
+			w.Write([]byte(`{"id": "did:web:live.example.com"}`))
+		case "gone.example.com":
+			w.WriteHeader(http.StatusGone)
+		case "broken.example.com":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	dir := &BaseDirectory{}
+	dir.HTTPClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	ok, err := dir.ProbeDIDWeb(ctx, syntax.DID("did:web:live.example.com"), WithInsecureDIDWeb())
+	assert.NoError(err)
+	assert.True(ok)
+
+	for _, did := range []syntax.DID{"did:web:missing.example.com", "did:web:gone.example.com"} {
+		ok, err = dir.ProbeDIDWeb(ctx, did, WithInsecureDIDWeb())
+		assert.NoError(err)
+		assert.False(ok)
+	}
+
+	_, err = dir.ProbeDIDWeb(ctx, syntax.DID("did:web:broken.example.com"), WithInsecureDIDWeb())
+	var httpErr *DIDHTTPError
+	if assert.ErrorAs(err, &httpErr) {
+		assert.Equal(http.StatusInternalServerError, httpErr.StatusCode)
+	}
+
+	// same validation as resolution, without a request
+	_, err = dir.ProbeDIDWeb(ctx, syntax.DID("did:web:localhost.local"))
+	assert.Error(err)
+	_, err = dir.ProbeDIDWeb(ctx, syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+	assert.Error(err)
+
+	lk.Lock()
+	defer lk.Unlock()
+	assert.Equal([]string{"HEAD", "HEAD", "HEAD", "HEAD"}, methods)
+}
+
+func TestDIDDocEqualDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+	doc := &DIDDocument{
+		DID:         did,
+		AlsoKnownAs: []string{"at://atproto.com", "mailto:someone@example.com"},
+		VerificationMethod: []DocVerificationMethod{
+			{ID: did.String() + "#atproto", Type: "Multikey", Controller: did.String(), PublicKeyMultibase: "zOld"},
+		},
+		Service: []DocService{
+			{ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: "https://old.example.com"},
+			{ID: "#bsky_fg", Type: "BskyFeedGenerator", ServiceEndpoint: "https://feeds.example.com"},
+		},
+	}
+	assert.True(doc.Equal(doc))
+	assert.Nil(doc.Diff(doc))
+	assert.True((*DIDDocument)(nil).Equal(nil))
+	assert.False(doc.Equal(nil))
+
+	// order-insensitive
+	reordered := *doc
+	reordered.AlsoKnownAs = []string{"mailto:someone@example.com", "at://atproto.com"}
+	reordered.Service = []DocService{doc.Service[1], doc.Service[0]}
+	assert.True(doc.Equal(&reordered))
+	assert.Nil(doc.Diff(&reordered))
+
+	updated := &DIDDocument{
+		DID:         did,
+		AlsoKnownAs: []string{"at://new.example.com", "mailto:someone@example.com"},
+		VerificationMethod: []DocVerificationMethod{
+			{ID: did.String() + "#atproto", Type: "Multikey", Controller: did.String(), PublicKeyMultibase: "zNew"},
+		},
+		Service: []DocService{
+			{ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: "https://new.example.com"},
+			{ID: "#atproto_labeler", Type: "AtprotoLabeler", ServiceEndpoint: "https://labels.example.com"},
+		},
+	}
+	assert.False(doc.Equal(updated))
+	assert.Equal([]string{
+		"handle removed: atproto.com",
+		"handle added: new.example.com",
+		"key rotated: did:plc:ewvi7nxzyoun6zhxrhs64oiz#atproto: zOld -> zNew",
+		"service endpoint changed: #atproto_pds: https://old.example.com -> https://new.example.com",
+		"service removed: #bsky_fg",
+		"service added: #atproto_labeler (https://labels.example.com)",
+	}, doc.Diff(updated))
+
+	// duplicates still count
+	dup := *doc
+	dup.Service = append(slices.Clone(doc.Service), doc.Service[0])
+	assert.False(doc.Equal(&dup))
+	assert.NotEmpty(doc.Diff(&dup))
+}
+
+func TestCacheRefreshUnchanged(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(DIDDocument{DID: did})
+	}))
+	defer srv.Close()
+
+	cache := NewCacheDirectory(&BaseDirectory{PLCURL: srv.URL}, 100, time.Hour, time.Hour)
+	ident, err := cache.LookupDID(ctx, did)
+	assert.NoError(err)
+
+	// re-resolving an unchanged document keeps the existing identity
+	refreshed, err := cache.Refresh(ctx, did)
+	assert.NoError(err)
+	assert.Same(ident, refreshed)
+}
+
+func TestNewBaseDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := NewBaseDirectory("", 0, 0)
+	assert.Equal(DefaultPLCURL, dir.PLCURL)
+	if assert.NotNil(dir.PLCLimiter) {
+		assert.Equal(DefaultPLCRateLimit, dir.PLCLimiter.Limit())
+		assert.Equal(DefaultPLCBurst, dir.PLCLimiter.Burst())
+	}
+	assert.NoError(dir.Validate())
+
+	dir = NewBaseDirectory("https://plc.example.com", 50, 5)
+	assert.Equal("https://plc.example.com", dir.PLCURL)
+	assert.Equal(rate.Limit(50), dir.PLCLimiter.Limit())
+	assert.Equal(5, dir.PLCLimiter.Burst())
+}
+
+// a manually advanced Clock
+type fakeClock struct {
+	lk      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Waiting() int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return len(c.waiters)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.now = c.now.Add(d)
+	var waiting []fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+func TestResolveDIDPLCRetryAfterFakeClock(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+	var limited atomic.Bool
+	limited.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limited.Load() {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(DIDDocument{DID: did})
+	}))
+	defer srv.Close()
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dir := &BaseDirectory{PLCURL: srv.URL, Clock: clock}
+	_, err := dir.ResolveDIDPLC(ctx, did)
+	var httpErr *DIDHTTPError
+	assert.ErrorAs(err, &httpErr)
+	limited.Store(false)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := dir.ResolveDIDPLC(ctx, did)
+		done <- err
+	}()
+
+	// held back by the backoff, until the clock passes it; no real time needs to pass
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiting() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected request to wait for the Retry-After backoff")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(30 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("request made before the Retry-After had passed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(30 * time.Second)
+	select {
+	case err := <-done:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for request after backoff")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var active, maxActive atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		did := strings.TrimPrefix(r.URL.Path, "/")
+		if strings.HasSuffix(did, "missing") {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(DIDDocument{DID: syntax.DID(did)})
+	}))
+	defer srv.Close()
+
+	dids := []syntax.DID{"did:plc:aaaa", "did:plc:bbbb", "did:plc:cccc", "did:plc:dddd", "did:plc:missing"}
+	cache := NewCacheDirectory(&BaseDirectory{PLCURL: srv.URL}, 100, time.Hour, time.Hour)
+	succeeded, failed := cache.Prefetch(ctx, dids, 2)
+	assert.Equal(4, succeeded)
+	assert.Equal(1, failed)
+	assert.LessOrEqual(maxActive.Load(), int32(2))
+
+	for _, did := range dids[:4] {
+		_, hit, err := cache.LookupDIDWithCacheState(ctx, did)
+		assert.NoError(err)
+		assert.True(hit)
+	}
+
+	// nothing is looked up once the context is done
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	succeeded, failed = cache.Prefetch(cancelled, []syntax.DID{"did:plc:eeee"}, 2)
+	assert.Equal(0, succeeded+failed)
+}
+
+func TestDIDWebRedirects(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// every hostname dials the same test server, which dispatches on the Host header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Host == "example.com" && r.URL.Path == "/.well-known/did.json":
+			http.Redirect(w, r, "/moved/did.json", http.StatusFound)
+		case r.Host == "example.com" && r.URL.Path == "/moved/did.json":
+			w.Write([]byte(`{"id": "did:web:example.com"}`))
+		case r.Host == "spoof.example.com" && r.URL.Path == "/.well-known/did.json":
+			http.Redirect(w, r, "http://attacker.example.com/did.json", http.StatusFound)
+		case r.Host == "loop.example.com":
+			http.Redirect(w, r, r.URL.Path+"x", http.StatusFound)
+		default:
+			w.Write([]byte(`{"id": "did:web:spoof.example.com"}`))
+		}
+	}))
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	dir := &BaseDirectory{}
+	dir.HTTPClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	// same-host redirects are fine
+	doc, err := dir.ResolveDIDWeb(ctx, syntax.DID("did:web:example.com"), WithInsecureDIDWeb())
+	assert.NoError(err)
+	if assert.NotNil(doc) {
+		assert.Equal(syntax.DID("did:web:example.com"), doc.DID)
+	}
+
+	_, err = dir.ResolveDIDWeb(ctx, syntax.DID("did:web:spoof.example.com"), WithInsecureDIDWeb())
+	assert.ErrorIs(err, ErrDIDWebRedirect)
+	assert.ErrorIs(err, ErrDIDResolutionFailed)
+
+	_, err = dir.ResolveDIDWeb(ctx, syntax.DID("did:web:loop.example.com"), WithInsecureDIDWeb())
+	assert.ErrorIs(err, ErrDIDWebRedirect)
+
+	// probes are held to the same policy
+	_, err = dir.ProbeDIDWeb(ctx, syntax.DID("did:web:spoof.example.com"), WithInsecureDIDWeb())
+	assert.ErrorIs(err, ErrDIDWebRedirect)
+}
+
+func TestCacheExpiryFakeClock(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		did := strings.TrimPrefix(r.URL.Path, "/")
+		if strings.HasSuffix(did, "missing") {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(DIDDocument{DID: syntax.DID(did)})
+	}))
+	defer srv.Close()
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache := NewCacheDirectory(&BaseDirectory{PLCURL: srv.URL}, 100, time.Hour, time.Minute)
+	cache.Clock = clock
+
+	did := syntax.DID("did:plc:aaaa")
+	_, err := cache.LookupDID(ctx, did)
+	assert.NoError(err)
+	_, err = cache.LookupDID(ctx, "did:plc:missing")
+	assert.Error(err)
+	assert.Equal(int64(2), requests.Load())
+
+	// errors expire after ErrTTL, successes after the hit TTL
+	clock.Advance(2 * time.Minute)
+	_, hit, err := cache.LookupDIDWithCacheState(ctx, did)
+	assert.NoError(err)
+	assert.True(hit)
+	_, hit, err = cache.LookupDIDWithCacheState(ctx, "did:plc:missing")
+	assert.Error(err)
+	assert.False(hit)
+	assert.Equal(int64(3), requests.Load())
+
+	clock.Advance(time.Hour)
+	_, hit, err = cache.LookupDIDWithCacheState(ctx, did)
+	assert.NoError(err)
+	assert.False(hit)
+	assert.Equal(int64(4), requests.Load())
+}
+
+func TestCacheColdMissCoalesce(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+	var hits atomic.Int64
+	gate := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-gate
+		w.Header().Set("ETag", `"v1"`)
+		json.NewEncoder(w).Encode(DIDDocument{DID: did})
+	}))
+	defer srv.Close()
+
+	// two caches over one base directory, so the lookups are only coalesced by the base directory
+	base := &BaseDirectory{PLCURL: srv.URL}
+	caches := []CacheDirectory{
+		NewCacheDirectory(base, 100, time.Hour, time.Hour),
+		NewCacheDirectory(base, 100, time.Hour, time.Hour),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(cache *CacheDirectory) {
+			defer wg.Done()
+			ident, err := cache.LookupDID(ctx, did)
+			if assert.NoError(err) {
+				assert.Equal(did, ident.DID)
+			}
+		}(&caches[i%2])
+	}
+
+	assert.Eventually(func() bool { return hits.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	assert.Equal(int64(1), hits.Load())
+
+	// validators from the coalesced request are kept, for revalidating later
+	for i := range caches {
+		entry, ok := caches[i].revalidateCache.Peek(did)
+		if assert.True(ok) && assert.NotNil(entry.Validators) {
+			assert.Equal(`"v1"`, entry.Validators.ETag)
+		}
+	}
+}
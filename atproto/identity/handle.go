@@ -14,7 +14,9 @@ import (
 	"github.com/bluesky-social/indigo/atproto/syntax"
 )
 
+// Returns ErrHandleNotFound if there is no "did=" record, and ErrHandleConflict if there are multiple records with different DIDs.
 func parseTXTResp(res []string) (syntax.DID, error) {
+	var found syntax.DID
 	for _, s := range res {
 		if strings.HasPrefix(s, "did=") {
 			parts := strings.SplitN(s, "=", 2)
@@ -22,10 +24,16 @@ func parseTXTResp(res []string) (syntax.DID, error) {
 			if err != nil {
 				return "", fmt.Errorf("%w: invalid DID in handle DNS record: %w", ErrHandleResolutionFailed, err)
 			}
-			return did, nil
+			if found != "" && found != did {
+				return "", fmt.Errorf("%w: multiple DNS TXT records (%s, %s)", ErrHandleConflict, found, did)
+			}
+			found = did
 		}
 	}
-	return "", ErrHandleNotFound
+	if found == "" {
+		return "", ErrHandleNotFound
+	}
+	return found, nil
 }
 
 // Does not cross-verify, only does the handle resolution step.
@@ -127,9 +135,9 @@ func (d *BaseDirectory) ResolveHandleDNSFallback(ctx context.Context, handle syn
 }
 
 func (d *BaseDirectory) ResolveHandleWellKnown(ctx context.Context, handle syntax.Handle) (syntax.DID, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/.well-known/atproto-did", handle), nil)
+	req, err := d.newRequest(ctx, fmt.Sprintf("https://%s/.well-known/atproto-did", handle))
 	if err != nil {
-		return "", fmt.Errorf("constructing HTTP request for handle resolution: %w", err)
+		return "", err
 	}
 
 	resp, err := d.HTTPClient.Do(req)
@@ -143,6 +151,7 @@ func (d *BaseDirectory) ResolveHandleWellKnown(ctx context.Context, handle synta
 		}
 		return "", fmt.Errorf("%w: HTTP well-known request error: %w", ErrHandleResolutionFailed, err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotFound {
 		return "", fmt.Errorf("%w: HTTP 404 for %s", ErrHandleNotFound, handle)
 	}
@@ -171,6 +180,11 @@ func (d *BaseDirectory) ResolveHandle(ctx context.Context, handle syntax.Handle)
 		return "", ErrHandleReservedTLD
 	}
 
+	ctx, err := enterResolution(ctx, handle.String())
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrHandleResolutionFailed, err)
+	}
+
 	tryDNS := true
 	for _, suffix := range d.SkipDNSDomainSuffixes {
 		if strings.HasSuffix(handle.String(), suffix) {
@@ -199,8 +213,14 @@ func (d *BaseDirectory) ResolveHandle(ctx context.Context, handle syntax.Handle)
 		elapsed := time.Since(start)
 		slog.Debug("resolve handle DNS", "handle", handle, "err", dnsErr, "did", did, "authoritative", triedAuthoritative, "fallback", triedFallback, "duration_ms", elapsed.Milliseconds())
 		if nil == dnsErr { // if *not* an error
+			if d.HandleCrossCheck {
+				return d.crossCheckHandle(ctx, handle, did)
+			}
 			return did, nil
 		}
+		if errors.Is(dnsErr, ErrHandleConflict) {
+			return "", dnsErr
+		}
 	}
 
 	start := time.Now()
@@ -220,3 +240,16 @@ func (d *BaseDirectory) ResolveHandle(ctx context.Context, handle syntax.Handle)
 	}
 	return "", dnsErr
 }
+
+// Checks a DNS-resolved handle against HTTP well-known resolution. A missing well-known record is not a conflict, since most handles only use one mechanism.
+func (d *BaseDirectory) crossCheckHandle(ctx context.Context, handle syntax.Handle, dnsDID syntax.DID) (syntax.DID, error) {
+	httpDID, err := d.ResolveHandleWellKnown(ctx, handle)
+	if err != nil {
+		slog.Debug("handle cross-check HTTP well-known resolution failed", "handle", handle, "err", err)
+		return dnsDID, nil
+	}
+	if httpDID != dnsDID {
+		return "", fmt.Errorf("%w: DNS TXT (%s) and HTTP well-known (%s) disagree for %s", ErrHandleConflict, dnsDID, httpDID, handle)
+	}
+	return dnsDID, nil
+}
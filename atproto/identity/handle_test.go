@@ -0,0 +1,29 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTXTResp(t *testing.T) {
+	assert := assert.New(t)
+
+	did, err := parseTXTResp([]string{"blah", "did=did:plc:ewvi7nxzyoun6zhxrhs64oiz"})
+	assert.NoError(err)
+	assert.Equal("did:plc:ewvi7nxzyoun6zhxrhs64oiz", did.String())
+
+	// duplicate records are fine if they agree
+	did, err = parseTXTResp([]string{"did=did:plc:ewvi7nxzyoun6zhxrhs64oiz", "did=did:plc:ewvi7nxzyoun6zhxrhs64oiz"})
+	assert.NoError(err)
+	assert.Equal("did:plc:ewvi7nxzyoun6zhxrhs64oiz", did.String())
+
+	_, err = parseTXTResp([]string{"did=did:plc:ewvi7nxzyoun6zhxrhs64oiz", "did=did:web:example.com"})
+	assert.ErrorIs(err, ErrHandleConflict)
+
+	_, err = parseTXTResp([]string{"blah"})
+	assert.ErrorIs(err, ErrHandleNotFound)
+
+	_, err = parseTXTResp([]string{"did=blah"})
+	assert.ErrorIs(err, ErrHandleResolutionFailed)
+}
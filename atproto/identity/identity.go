@@ -13,7 +13,9 @@ import (
 	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 
+	"github.com/carlmjohnson/versioninfo"
 	"github.com/mr-tron/base58"
+	"golang.org/x/time/rate"
 )
 
 // API for doing account lookups by DID or handle, with bi-directional verification handled automatically. Almost all atproto services and clients should use an implementation of this interface instead of resolving handles or DIDs separately
@@ -34,12 +36,42 @@ type Directory interface {
 	Purge(ctx context.Context, i syntax.AtIdentifier) error
 }
 
+// Returned by conditional DID resolution when the server reports that the DID document has not changed since the given validators were recorded
+var ErrDIDNotModified = errors.New("DID document not modified")
+
+// Optionally implemented by directories which can re-resolve a DID with a conditional HTTP request, so caching directories can cheaply revalidate entries. See BaseDirectory.LookupDIDConditional
+type ConditionalDIDLookup interface {
+	LookupDIDConditional(ctx context.Context, did syntax.DID, prev *Identity, validators *DocValidators) (*Identity, *DocValidators, error)
+}
+
+// Optionally implemented by directories which can look up an identity while bypassing any caching or request coalescing, eg to pick up a signing key rotation immediately. See CacheDirectory.Refresh
+type DIDRefresher interface {
+	Refresh(ctx context.Context, did syntax.DID) (*Identity, error)
+}
+
+// Source of time for BaseDirectory's rate limiting and PLC Retry-After backoff, and for CacheDirectory's entry expiry, so that tests can supply a fake clock (BaseDirectory.Clock, CacheDirectory.Clock) and advance time instantly. Resolution timeouts are context deadlines, and always use the real clock, as do the durations exported as metrics. The events package uses the same interface (as events.Clock).
+type Clock interface {
+	Now() time.Time
+	// Like time.After: the channel receives the current time once d has elapsed
+	After(d time.Duration) <-chan time.Time
+}
+
+// The real clock, which a nil Clock field defaults to
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+func (SystemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
 // Indicates that handle resolution failed. A wrapped error may provide more context. This is only returned when looking up a handle, not when looking up a DID.
 var ErrHandleResolutionFailed = errors.New("handle resolution failed")
 
 // Indicates that resolution process completed successfully, but handle does not exist. This is only returned when looking up a handle, not when looking up a DID.
 var ErrHandleNotFound = errors.New("handle not found")
 
+// Indicates that handle resolution found multiple records which map the handle to different DIDs (eg, multiple "did=" DNS TXT records, or DNS and HTTP well-known disagreeing). This is only returned when looking up a handle, not when looking up a DID.
+var ErrHandleConflict = errors.New("conflicting handle resolution records")
+
 // Indicates that resolution process completed successfully, handle mapped to a different DID. This is only returned when looking up a handle, not when looking up a DID.
 var ErrHandleMismatch = errors.New("handle/DID mismatch")
 
@@ -55,28 +87,51 @@ var ErrDIDNotFound = errors.New("DID not found")
 // Indicates that DID resolution process failed. A wrapped error may provide more context.
 var ErrDIDResolutionFailed = errors.New("DID resolution failed")
 
+// Indicates that a did:web could not be resolved because of a problem with the server's TLS certificate (eg, expired, self-signed, or wrong hostname), as opposed to the server being unreachable. Always returned along with (wrapped together with) ErrDIDResolutionFailed.
+var ErrDIDWebTLS = errors.New("did:web TLS certificate error")
+
+// Indicates that a resolution was abandoned because it would re-enter a DID or handle already being resolved further up the same chain, or because the chain of nested resolutions was too deep. Always returned along with (wrapped together with) ErrDIDResolutionFailed or ErrHandleResolutionFailed.
+var ErrResolutionLoop = errors.New("identity resolution loop")
+
+// Indicates that a did:web document names a verification method controller other than the DID itself (or one of the allowed controllers), when controller verification is enabled (see BaseDirectory.VerifyDIDWebControllers). Always returned along with (wrapped together with) ErrDIDResolutionFailed.
+var ErrUntrustedController = errors.New("DID document has untrusted verification method controller")
+
+// Indicates that a did:web server redirected the DID document request somewhere it isn't trusted to: another host (or port), from https to http, or more than a few redirects deep. Only the DID's own host is authoritative for its document. Always returned along with (wrapped together with) ErrDIDResolutionFailed.
+var ErrDIDWebRedirect = errors.New("untrusted did:web redirect")
+
+// Indicates a misconfigured PLC directory URL (BaseDirectory.PLCURL, or WithPLCURL), which must be an absolute http or https URL
+var ErrInvalidPLCURL = errors.New("invalid PLC directory URL")
+
 var ErrKeyNotDeclared = errors.New("identity has no public repo signing key")
 
 var DefaultPLCURL = "https://plc.directory"
 
+// Default request rate (per second) and burst for the PLC limiter set up by NewBaseDirectory. These are conservative, comfortably inside the public directory's limits for a single client; services doing bulk resolution should tune them (and coordinate with the directory operator)
+var (
+	DefaultPLCRateLimit rate.Limit = 10
+	DefaultPLCBurst                = 10
+)
+
+var DefaultResolveTimeout = 10 * time.Second
+
+var DefaultUserAgent = "indigo-identity/" + versioninfo.Short()
+
 // Returns a reasonable Directory implementation for applications
 func DefaultDirectory() Directory {
-	base := BaseDirectory{
-		PLCURL: DefaultPLCURL,
-		HTTPClient: http.Client{
-			Timeout: time.Second * 15,
-		},
-		Resolver: net.Resolver{
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{Timeout: time.Second * 5}
-				return d.DialContext(ctx, network, address)
-			},
+	base := NewBaseDirectory(DefaultPLCURL, DefaultPLCRateLimit, DefaultPLCBurst)
+	base.HTTPClient = http.Client{
+		Timeout: time.Second * 15,
+	}
+	base.Resolver = net.Resolver{
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: time.Second * 5}
+			return d.DialContext(ctx, network, address)
 		},
-		TryAuthoritativeDNS: true,
-		// primary Bluesky PDS instance only supports HTTP resolution method
-		SkipDNSDomainSuffixes: []string{".bsky.social"},
 	}
-	cached := NewCacheDirectory(&base, 10000, time.Hour*24, time.Minute*2)
+	base.TryAuthoritativeDNS = true
+	// primary Bluesky PDS instance only supports HTTP resolution method
+	base.SkipDNSDomainSuffixes = []string{".bsky.social"}
+	cached := NewCacheDirectory(base, 10000, time.Hour*24, time.Minute*2)
 	return &cached
 }
 
@@ -94,6 +149,9 @@ type Identity struct {
 
 	// If a valid atproto repo signing public key was parsed, it can be cached here. This is a nullable/optional field (crypto.PublicKey is an interface). Calling code should use [Identity.PublicKey] instead of accessing this member.
 	ParsedPublicKey crypto.PublicKey
+
+	// The DID document this identity was parsed from, for advanced use (eg, fields not represented above). This is a nullable/optional field: identities which did not come from [ParseIdentity] (eg, mocks) may not have it. Treat as read-only; it may be shared with other copies of the identity.
+	Doc *DIDDocument
 }
 
 type Key struct {
@@ -152,6 +210,7 @@ func ParseIdentity(doc *DIDDocument) Identity {
 		AlsoKnownAs: doc.AlsoKnownAs,
 		Services:    svc,
 		Keys:        keys,
+		Doc:         doc,
 	}
 }
 
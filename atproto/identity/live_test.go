@@ -57,14 +57,14 @@ func testDirectoryLive(t *testing.T, d Directory) {
 
 func TestBaseDirectory(t *testing.T) {
 	t.Skip("TODO: skipping live network test")
-	d := BaseDirectory{}
-	testDirectoryLive(t, &d)
+	d := &BaseDirectory{}
+	testDirectoryLive(t, d)
 }
 
 func TestCacheDirectory(t *testing.T) {
 	t.Skip("TODO: skipping live network test")
-	inner := BaseDirectory{}
-	d := NewCacheDirectory(&inner, 1000, time.Hour*1, time.Hour*1)
+	inner := &BaseDirectory{}
+	d := NewCacheDirectory(inner, 1000, time.Hour*1, time.Hour*1)
 	for i := 0; i < 3; i = i + 1 {
 		testDirectoryLive(t, &d)
 	}
@@ -77,7 +77,7 @@ func TestCacheCoalesce(t *testing.T) {
 	handle := syntax.Handle("atproto.com")
 	did := syntax.DID("did:plc:ewvi7nxzyoun6zhxrhs64oiz")
 
-	base := BaseDirectory{
+	base := &BaseDirectory{
 		PLCURL: "https://plc.directory",
 		HTTPClient: http.Client{
 			Timeout: time.Second * 15,
@@ -87,7 +87,7 @@ func TestCacheCoalesce(t *testing.T) {
 		TryAuthoritativeDNS:   true,
 		SkipDNSDomainSuffixes: []string{".bsky.social"},
 	}
-	dir := NewCacheDirectory(&base, 1000, time.Hour*1, time.Hour*1)
+	dir := NewCacheDirectory(base, 1000, time.Hour*1, time.Hour*1)
 	// All 60 routines launch at the same time, so they should all miss the cache initially
 	routines := 60
 	wg := sync.WaitGroup{}
@@ -123,7 +123,7 @@ func TestFallbackDNS(t *testing.T) {
 	assert := assert.New(t)
 	ctx := context.Background()
 	handle := syntax.Handle("no-such-record.atproto.com")
-	dir := BaseDirectory{
+	dir := &BaseDirectory{
 		FallbackDNSServers: []string{"1.1.1.1:53", "8.8.8.8:53"},
 	}
 
@@ -0,0 +1,168 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// A single entry from a PLC directory audit log. Only the fields needed to inspect the history of an identity are parsed; the full signed operation is available as raw JSON.
+type PLCOp struct {
+	DID syntax.DID `json:"did"`
+	// CID of the signed operation
+	CID string `json:"cid"`
+	// Whether this operation was later invalidated by a fork (eg, a rotation key "recovery" within the 72 hour window)
+	Nullified bool `json:"nullified"`
+	// When the PLC directory received the operation
+	CreatedAt time.Time `json:"createdAt"`
+	// The signed operation itself
+	Operation PLCOperation `json:"operation"`
+}
+
+type PLCOperation struct {
+	// "plc_operation", "plc_tombstone", or the legacy "create"
+	Type string `json:"type"`
+	// CID of the previous operation; nil for the genesis operation
+	Prev *string `json:"prev"`
+	Sig  string  `json:"sig"`
+	// Full operation JSON, including type-specific fields (rotation keys, services, etc)
+	Raw json.RawMessage `json:"-"`
+}
+
+func (op *PLCOperation) UnmarshalJSON(b []byte) error {
+	type plcOperation PLCOperation
+	var inner plcOperation
+	if err := json.Unmarshal(b, &inner); err != nil {
+		return err
+	}
+	*op = PLCOperation(inner)
+	op.Raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// Returns the URL of a path under the PLC directory at base (DefaultPLCURL if empty). The base may have a trailing slash, or a path prefix for directories not hosted at the root, but must be an absolute http or https URL.
+func plcEndpoint(base string, elem ...string) (string, error) {
+	if base == "" {
+		base = DefaultPLCURL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidPLCURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%w: not an absolute http or https URL: %q", ErrInvalidPLCURL, base)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%w: query and fragment not allowed: %q", ErrInvalidPLCURL, base)
+	}
+	return u.JoinPath(elem...).String(), nil
+}
+
+// Validate checks the directory's configuration, returning ErrInvalidPLCURL if PLCURL is malformed. Otherwise the problem is only reported when a did:plc is resolved, so callers should check this at startup.
+func (d *BaseDirectory) Validate() error {
+	_, err := plcEndpoint(d.PLCURL)
+	return err
+}
+
+// Fetches the full operation history for a did:plc from the PLC directory ("/log/audit" endpoint), in the order they were received. Unlike [BaseDirectory.ResolveDIDPLC], this includes nullified operations, which can be used to detect suspicious key rotations.
+func (d *BaseDirectory) ResolvePLCAuditLog(ctx context.Context, did syntax.DID) ([]PLCOp, error) {
+	if did.Method() != "plc" {
+		return nil, fmt.Errorf("expected a did:plc, got: %s", did)
+	}
+
+	auditURL, err := plcEndpoint(d.PLCURL, did.String(), "log", "audit")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.waitPLC(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := d.newRequest(ctx, auditURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: PLC audit log lookup: %w", ErrDIDResolutionFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: PLC directory 404", ErrDIDNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, d.plcStatusError(resp, true)
+	}
+
+	var ops []PLCOp
+	if err := json.NewDecoder(resp.Body).Decode(&ops); err != nil {
+		return nil, fmt.Errorf("%w: JSON PLC audit log parse: %w", ErrDIDResolutionFailed, err)
+	}
+	return ops, nil
+}
+
+// Upper bound on how long a PLC Retry-After header can pause requests, so a misbehaving server can't stall resolution indefinitely
+var maxPLCRetryAfter = 5 * time.Minute
+
+// Blocks until any Retry-After backoff has passed, then waits on the PLC rate limiter (if configured).
+func (d *BaseDirectory) waitPLC(ctx context.Context) error {
+	d.plcBackoffLk.Lock()
+	until := d.plcBackoffUntil
+	d.plcBackoffLk.Unlock()
+
+	if delay := until.Sub(d.clock().Now()); delay > 0 {
+		select {
+		case <-d.clock().After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for PLC rate-limit backoff: %w", ctx.Err())
+		}
+	}
+
+	return d.waitMethodLimiter(ctx, "plc")
+}
+
+// Builds the error for a non-200 PLC response. For 429s, the Retry-After header is parsed, and (if backoff is true) all subsequent PLC requests from this directory are paused until it has passed.
+func (d *BaseDirectory) plcStatusError(resp *http.Response, backoff bool) error {
+	httpErr := &DIDHTTPError{StatusCode: resp.StatusCode, Method: "plc"}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return httpErr
+	}
+
+	now := d.clock().Now()
+	httpErr.RetryAfter = min(parseRetryAfter(resp.Header.Get("Retry-After"), now), maxPLCRetryAfter)
+	if httpErr.RetryAfter > 0 && backoff {
+		until := now.Add(httpErr.RetryAfter)
+		d.plcBackoffLk.Lock()
+		if until.After(d.plcBackoffUntil) {
+			d.plcBackoffUntil = until
+		}
+		d.plcBackoffLk.Unlock()
+	}
+	return httpErr
+}
+
+// Parses an HTTP Retry-After header value, which is either an integer number of seconds or an HTTP date. Returns zero if missing or invalid.
+func parseRetryAfter(val string, now time.Time) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -518,7 +518,7 @@ func (s *Slurper) handleConnection(ctx context.Context, host *models.PDS, con *w
 		// TODO: all the other event types (handle change, migration, etc)
 		Error: func(errf *events.ErrorFrame) error {
 			switch errf.Error {
-			case "FutureCursor":
+			case events.ErrorFrameFutureCursor:
 				// if we get a FutureCursor frame, reset our sequence number for this host
 				if err := s.db.Table("pds").Where("id = ?", host.ID).Update("cursor", 0).Error; err != nil {
 					return err
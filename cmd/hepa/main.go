@@ -133,7 +133,7 @@ func run(args []string) error {
 }
 
 func configDirectory(cctx *cli.Context) (identity.Directory, error) {
-	baseDir := identity.BaseDirectory{
+	baseDir := &identity.BaseDirectory{
 		PLCURL: cctx.String("atp-plc-host"),
 		HTTPClient: http.Client{
 			Timeout: time.Second * 15,
@@ -142,15 +142,18 @@ func configDirectory(cctx *cli.Context) (identity.Directory, error) {
 		TryAuthoritativeDNS:   true,
 		SkipDNSDomainSuffixes: []string{".bsky.social", ".staging.bsky.dev"},
 	}
+	if err := baseDir.Validate(); err != nil {
+		return nil, err
+	}
 	var dir identity.Directory
 	if cctx.String("redis-url") != "" {
-		rdir, err := redisdir.NewRedisDirectory(&baseDir, cctx.String("redis-url"), time.Hour*24, time.Minute*2, 10_000)
+		rdir, err := redisdir.NewRedisDirectory(baseDir, cctx.String("redis-url"), time.Hour*24, time.Minute*2, 10_000)
 		if err != nil {
 			return nil, err
 		}
 		dir = rdir
 	} else {
-		cdir := identity.NewCacheDirectory(&baseDir, 1_500_000, time.Hour*24, time.Minute*2)
+		cdir := identity.NewCacheDirectory(baseDir, 1_500_000, time.Hour*24, time.Minute*2)
 		dir = &cdir
 	}
 	return dir, nil
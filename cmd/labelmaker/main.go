@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/labeler"
@@ -131,6 +132,48 @@ func run(args []string) error {
 			Usage:   "'micro-nsfw-img' classifier endpoint (full URL)",
 			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_URL"},
 		},
+		&cli.StringFlag{
+			Name:    "micro-nsfw-img-policy-file",
+			Usage:   "'micro-nsfw-img' label policy rules, as JSON file (default: fixed per-score cutoffs)",
+			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_POLICY_FILE"},
+		},
+		&cli.IntFlag{
+			Name:    "micro-nsfw-img-max-edge",
+			Usage:   "downscale images with an edge longer than this many pixels before sending them to 'micro-nsfw-img' (eg, 1024; 0 disables downscaling)",
+			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_MAX_EDGE"},
+		},
+		&cli.IntFlag{
+			Name:    "micro-nsfw-img-max-upload-bytes",
+			Usage:   "also re-encode images larger than this many bytes, when downscaling is enabled (0 for no limit)",
+			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_MAX_UPLOAD_BYTES"},
+		},
+		&cli.BoolFlag{
+			Name:    "micro-nsfw-img-only-supported-types",
+			Usage:   "only send blobs with image MIME types supported by 'micro-nsfw-img' (jpeg, png, gif, webp)",
+			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_ONLY_SUPPORTED_TYPES"},
+		},
+		&cli.IntFlag{
+			Name:    "micro-nsfw-img-cache-size",
+			Usage:   "number of 'micro-nsfw-img' results to cache by blob CID (0 disables caching)",
+			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_CACHE_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "micro-nsfw-img-cache-ttl",
+			Usage:   "how long to cache 'micro-nsfw-img' results for blobs which got labels",
+			Value:   24 * time.Hour,
+			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_CACHE_TTL"},
+		},
+		&cli.DurationFlag{
+			Name:    "micro-nsfw-img-cache-clean-ttl",
+			Usage:   "how long to cache 'micro-nsfw-img' results for blobs which got no labels",
+			Value:   6 * time.Hour,
+			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_CACHE_CLEAN_TTL"},
+		},
+		&cli.IntFlag{
+			Name:    "micro-nsfw-img-breaker-failures",
+			Usage:   "fail 'micro-nsfw-img' requests fast for 30s after this many consecutive failures within 30s (0 disables the circuit breaker)",
+			EnvVars: []string{"LABELMAKER_MICRO_NSFW_IMG_BREAKER_FAILURES"},
+		},
 		&cli.StringFlag{
 			Name:    "hiveai-api-token",
 			Usage:   "thehive.ai API token",
@@ -252,7 +295,23 @@ func run(args []string) error {
 		}
 
 		if microNSFWImgURL != "" {
-			srv.AddMicroNSFWImgLabeler(microNSFWImgURL)
+			var policy *labeler.LabelPolicy
+			if policyFile := cctx.String("micro-nsfw-img-policy-file"); policyFile != "" {
+				policy, err = labeler.LoadLabelPolicyFile(policyFile)
+				if err != nil {
+					return err
+				}
+			}
+			mnil := labeler.NewMicroNSFWImgLabeler(microNSFWImgURL)
+			mnil.Policy = policy
+			mnil.MaxImageEdge = cctx.Int("micro-nsfw-img-max-edge")
+			mnil.MaxUploadBytes = cctx.Int("micro-nsfw-img-max-upload-bytes")
+			if cctx.Bool("micro-nsfw-img-only-supported-types") {
+				mnil.AllowedMimeTypes = labeler.DefaultMicroNSFWImgMimeTypes
+			}
+			mnil.SetCache(cctx.Int("micro-nsfw-img-cache-size"), cctx.Duration("micro-nsfw-img-cache-ttl"), cctx.Duration("micro-nsfw-img-cache-clean-ttl"))
+			mnil.SetCircuitBreaker(cctx.Int("micro-nsfw-img-breaker-failures"), 30*time.Second, 30*time.Second)
+			srv.SetMicroNSFWImgLabeler(&mnil)
 		}
 
 		if hiveAIToken != "" {
@@ -211,7 +211,7 @@ var runCmd = &cli.Command{
 		}
 
 		// TODO: replace this with "bingo" resolver
-		base := identity.BaseDirectory{
+		base := &identity.BaseDirectory{
 			PLCURL: cctx.String("atp-plc-host"),
 			HTTPClient: http.Client{
 				Timeout: time.Second * 15,
@@ -220,7 +220,10 @@ var runCmd = &cli.Command{
 			TryAuthoritativeDNS:   true,
 			SkipDNSDomainSuffixes: []string{".bsky.social"},
 		}
-		dir := identity.NewCacheDirectory(&base, 1_500_000, time.Hour*24, time.Minute*2)
+		if err := base.Validate(); err != nil {
+			return err
+		}
+		dir := identity.NewCacheDirectory(base, 1_500_000, time.Hour*24, time.Minute*2)
 
 		srv, err := search.NewServer(
 			db,
@@ -0,0 +1,147 @@
+package events_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+)
+
+func addHandleEvents(t *testing.T, em *events.EventManager, n int) {
+	for i := 0; i < n; i++ {
+		if err := em.AddEvent(context.Background(), &events.XRPCStreamEvent{
+			RepoHandle: &atproto.SyncSubscribeRepos_Handle{
+				Did:    "did:plc:testuser",
+				Handle: "test.example.com",
+				Time:   "2024-01-01T00:00:00.000Z",
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportRange(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+	addHandleEvents(t, em, 5)
+
+	buf := new(bytes.Buffer)
+	n, err := em.ExportRange(ctx, 2, 4, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 events exported, got %d", n)
+	}
+
+	r := bufio.NewReader(buf)
+	for want := int64(2); want <= 4; want++ {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, l)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.Fatal(err)
+		}
+		fr := bytes.NewReader(frame)
+		var header events.EventHeader
+		if err := header.UnmarshalCBOR(fr); err != nil {
+			t.Fatal(err)
+		}
+		if header.MsgType != "#handle" {
+			t.Fatalf("unexpected frame type: %s", header.MsgType)
+		}
+		var evt atproto.SyncSubscribeRepos_Handle
+		if err := evt.UnmarshalCBOR(fr); err != nil {
+			t.Fatal(err)
+		}
+		if evt.Seq != want {
+			t.Fatalf("expected seq %d, got %d", want, evt.Seq)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("expected end of export")
+	}
+
+	// range past the end of the persister stops cleanly
+	n, err = em.ExportRange(ctx, 4, 100, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 events exported, got %d", n)
+	}
+}
+
+func TestImportFrames(t *testing.T) {
+	ctx := context.Background()
+	src := events.NewEventManager(events.NewMemPersister())
+	addHandleEvents(t, src, 3)
+
+	archive := new(bytes.Buffer)
+	if _, err := src.ExportRange(ctx, 1, 3, archive); err != nil {
+		t.Fatal(err)
+	}
+	archiveBytes := archive.Bytes()
+
+	// import with broadcast
+	dst := events.NewEventManager(events.NewMemPersister())
+	evts, cleanup, err := dst.Subscribe(ctx, "live", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	n, err := dst.ImportFrames(ctx, bytes.NewReader(archiveBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 events imported, got %d", n)
+	}
+	for i := 1; i <= 3; i++ {
+		evt := <-evts
+		if evt.RepoHandle == nil || evt.RepoHandle.Seq != int64(i) || evt.RepoHandle.Handle != "test.example.com" {
+			t.Fatalf("unexpected imported event: %+v", evt)
+		}
+	}
+
+	// import without broadcast; events are persisted, but not sent live
+	quiet := events.NewEventManager(events.NewMemPersister())
+	qevts, qcleanup, err := quiet.Subscribe(ctx, "live", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qcleanup()
+	if _, err := quiet.ImportFramesWithOptions(ctx, bytes.NewReader(archiveBytes), &events.ImportOptions{SkipBroadcast: true}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evt := <-qevts:
+		t.Fatalf("unexpected broadcast of imported event: %+v", evt)
+	default:
+	}
+	n, err = quiet.ExportRange(ctx, 1, 3, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 persisted events, got %d", n)
+	}
+
+	// truncated archive imports what it can, then errors
+	truncated := events.NewEventManager(events.NewMemPersister())
+	n, err = truncated.ImportFrames(ctx, bytes.NewReader(archiveBytes[:len(archiveBytes)-5]))
+	if err == nil {
+		t.Fatal("expected error for truncated archive")
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 events imported before truncation, got %d", n)
+	}
+}
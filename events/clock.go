@@ -0,0 +1,10 @@
+package events
+
+import (
+	"github.com/bluesky-social/indigo/atproto/identity"
+)
+
+// Clock is the source of time for the event manager's time-based behavior: stall detection, the timeout for delivering a final frame to an evicted consumer, and subscription rate limits. Tests can supply a fake clock (EventManagerOptions.Clock) to exercise these deterministically, without sleeping. Latencies and durations exported as metrics are always measured with the real clock.
+//
+// This is the identity package's Clock, so one fake clock can drive both an event manager and the identity directory it verifies commits with.
+type Clock = identity.Clock
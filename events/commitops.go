@@ -0,0 +1,302 @@
+package events
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	cid "github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+)
+
+// A single repo operation from a #commit event, with the op path split out into collection and record key.
+type CommitOp struct {
+	// one of "create", "update", or "delete"
+	Action     string
+	Collection string
+	Rkey       string
+	// nil for delete ops
+	CID *cid.Cid
+}
+
+// Path returns the repo path ("<collection>/<rkey>") for the op
+func (op *CommitOp) Path() string {
+	return op.Collection + "/" + op.Rkey
+}
+
+// CommitOps returns the normalized set of repo operations in a #commit event. Returns an error if the event is not a commit, or if any op is malformed (eg, an invalid path, or a create/update with no CID).
+//
+// If the event manager was configured with PreparseCommitOps, live events carry ops parsed once at ingestion, and the returned slice is shared between all subscribers of the event, so it must not be modified.
+func (e *XRPCStreamEvent) CommitOps() ([]CommitOp, error) {
+	// the commit pointer is checked in case the caller swapped in a different commit after the event was parsed
+	if p := e.parsedOps; p != nil && p.commit == e.RepoCommit {
+		return p.ops, p.err
+	}
+	return e.parseCommitOps()
+}
+
+// The result of parsing a commit's ops, cached on the event
+type parsedCommitOps struct {
+	commit *comatproto.SyncSubscribeRepos_Commit
+	ops    []CommitOp
+	err    error
+}
+
+// Parses and caches the ops of a commit event (errors included, so that every subscriber sees the same result). Only called by the event manager, before the event is shared with any subscriber
+func (e *XRPCStreamEvent) preparseCommitOps() {
+	if e.RepoCommit == nil {
+		return
+	}
+	ops, err := e.parseCommitOps()
+	e.parsedOps = &parsedCommitOps{commit: e.RepoCommit, ops: ops, err: err}
+}
+
+func (e *XRPCStreamEvent) parseCommitOps() ([]CommitOp, error) {
+	if e.RepoCommit == nil {
+		return nil, fmt.Errorf("not a repo commit event")
+	}
+	ops := make([]CommitOp, 0, len(e.RepoCommit.Ops))
+	for _, op := range e.RepoCommit.Ops {
+		if op == nil {
+			continue
+		}
+		parts := strings.SplitN(op.Path, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid repo op path: %q", op.Path)
+		}
+		cop := CommitOp{
+			Action:     op.Action,
+			Collection: parts[0],
+			Rkey:       parts[1],
+		}
+		switch op.Action {
+		case "create", "update":
+			if op.Cid == nil || !cid.Cid(*op.Cid).Defined() {
+				return nil, fmt.Errorf("repo op missing CID (action=%s path=%s)", op.Action, op.Path)
+			}
+			c := cid.Cid(*op.Cid)
+			cop.CID = &c
+		case "delete":
+			// delete ops may or may not have a (null) CID; either way, ignore it
+		default:
+			return nil, fmt.Errorf("unknown repo op action: %q", op.Action)
+		}
+		ops = append(ops, cop)
+	}
+	return ops, nil
+}
+
+// Returned (wrapped) by CommitRecords when a create or update op references a record block which is not included in the commit's CAR slice (eg, "tooBig" commits, which have no blocks at all)
+var ErrMissingRecordBlock = errors.New("record block missing from commit")
+
+// Returned (wrapped) by CommitRecords when a commit's CAR slice exceeds the configured limits
+var ErrCommitTooLarge = errors.New("commit CAR slice exceeds limits")
+
+// Limits on commit CAR slices, which come from (untrusted) repo hosts
+type CommitDecodeOptions struct {
+	// Maximum total size of the CAR slice, in bytes. Zero means no limit
+	MaxCARSize int
+	// Maximum number of blocks in the CAR slice. Zero means no limit
+	MaxBlocks int
+	// If true, block data is not hashed to check that it matches its CID (as with go-car's WithTrustedCAR). Only for CAR slices which were already verified, eg by the relay they came from
+	TrustedCAR bool
+}
+
+// Defaults are a comfortable margin above what the reference relay accepts
+func DefaultCommitDecodeOptions() *CommitDecodeOptions {
+	return &CommitDecodeOptions{
+		MaxCARSize: 4 << 20,
+		MaxBlocks:  10_000,
+	}
+}
+
+// CommitRecords parses the CAR slice ("blocks") of a #commit event, and returns the raw CBOR bytes of each created or updated record, keyed by op path ("<collection>/<rkey>"). Delete ops have no record, and are not included in the map. The default CommitDecodeOptions limits are applied.
+func (e *XRPCStreamEvent) CommitRecords() (map[string][]byte, error) {
+	return e.CommitRecordsWithOptions(nil)
+}
+
+// CommitRecordsWithOptions is like CommitRecords, with configurable limits. A nil opts uses the defaults.
+func (e *XRPCStreamEvent) CommitRecordsWithOptions(opts *CommitDecodeOptions) (map[string][]byte, error) {
+	if opts == nil {
+		opts = DefaultCommitDecodeOptions()
+	}
+
+	ops, err := e.CommitOps()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string][]byte)
+	needed := 0
+	for _, op := range ops {
+		if op.CID != nil {
+			needed++
+		}
+	}
+	if needed == 0 {
+		return out, nil
+	}
+	if len(e.RepoCommit.Blocks) == 0 {
+		return nil, fmt.Errorf("%w: commit has no blocks (tooBig=%v)", ErrMissingRecordBlock, e.RepoCommit.TooBig)
+	}
+
+	if opts.MaxCARSize > 0 && len(e.RepoCommit.Blocks) > opts.MaxCARSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrCommitTooLarge, len(e.RepoCommit.Blocks), opts.MaxCARSize)
+	}
+
+	readOpts := []car.ReadOption{car.WithTrustedCAR(opts.TrustedCAR)}
+	if opts.MaxCARSize > 0 {
+		// otherwise a bogus section length prefix could trigger a huge allocation
+		readOpts = append(readOpts, car.MaxAllowedSectionSize(uint64(opts.MaxCARSize)))
+	}
+
+	blocks := make(map[cid.Cid][]byte)
+	br, err := car.NewBlockReader(bytes.NewReader(e.RepoCommit.Blocks), readOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("reading commit CAR: %w", err)
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading commit CAR: %w", err)
+		}
+		if opts.MaxBlocks > 0 && len(blocks) >= opts.MaxBlocks {
+			return nil, fmt.Errorf("%w: more than %d blocks", ErrCommitTooLarge, opts.MaxBlocks)
+		}
+		blocks[blk.Cid()] = blk.RawData()
+	}
+
+	for _, op := range ops {
+		if op.CID == nil {
+			continue
+		}
+		b, ok := blocks[*op.CID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s (%s)", ErrMissingRecordBlock, op.Path(), op.CID)
+		}
+		out[op.Path()] = b
+	}
+	return out, nil
+}
+
+// Returned (wrapped) by CommitBlocks when a commit's CAR slice is malformed
+var ErrMalformedCAR = errors.New("malformed commit CAR slice")
+
+// An index over the CAR slice ("blocks") of a #commit event, for fetching individual blocks by CID. Only block offsets are held: block data is returned as sub-slices of the event's CAR bytes, without copying, so a consumer which only needs a few records of a large commit doesn't hold a second copy of everything. See CommitRecords for decoding all of the commit's records at once.
+type CommitBlocks struct {
+	car   []byte
+	index map[cid.Cid]blockSpan
+}
+
+type blockSpan struct {
+	offset int
+	length int
+}
+
+// CommitBlocks indexes the CAR slice of a #commit event, with the default CommitDecodeOptions limits applied.
+func (e *XRPCStreamEvent) CommitBlocks() (*CommitBlocks, error) {
+	return e.CommitBlocksWithOptions(nil)
+}
+
+// CommitBlocksWithOptions is like CommitBlocks, with configurable limits. A nil opts uses the defaults. Unless opts.TrustedCAR is set, each block is hashed while indexing, and a block whose data doesn't match its CID is an ErrMalformedCAR error.
+func (e *XRPCStreamEvent) CommitBlocksWithOptions(opts *CommitDecodeOptions) (*CommitBlocks, error) {
+	if opts == nil {
+		opts = DefaultCommitDecodeOptions()
+	}
+	if e.RepoCommit == nil {
+		return nil, fmt.Errorf("not a repo commit event")
+	}
+	data := e.RepoCommit.Blocks
+	if opts.MaxCARSize > 0 && len(data) > opts.MaxCARSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrCommitTooLarge, len(data), opts.MaxCARSize)
+	}
+
+	cb := &CommitBlocks{car: data, index: make(map[cid.Cid]blockSpan)}
+	if len(data) == 0 {
+		// eg, "tooBig" commits
+		return cb, nil
+	}
+
+	// the header is skipped; only the sections matter
+	_, offset, err := carSection(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %w", ErrMalformedCAR, err)
+	}
+	for offset < len(data) {
+		body, end, err := carSection(data, offset)
+		if err != nil {
+			return nil, fmt.Errorf("%w: section at offset %d: %w", ErrMalformedCAR, offset, err)
+		}
+		n, c, err := cid.CidFromBytes(data[body:end])
+		if err != nil {
+			return nil, fmt.Errorf("%w: section at offset %d: %w", ErrMalformedCAR, offset, err)
+		}
+		if opts.MaxBlocks > 0 && len(cb.index) >= opts.MaxBlocks {
+			return nil, fmt.Errorf("%w: more than %d blocks", ErrCommitTooLarge, opts.MaxBlocks)
+		}
+		if !opts.TrustedCAR {
+			sum, err := c.Prefix().Sum(data[body+n : end])
+			if err != nil {
+				return nil, fmt.Errorf("%w: section at offset %d: %w", ErrMalformedCAR, offset, err)
+			}
+			if !sum.Equals(c) {
+				return nil, fmt.Errorf("%w: section at offset %d: block data does not match CID %s", ErrMalformedCAR, offset, c)
+			}
+		}
+		cb.index[c] = blockSpan{offset: body + n, length: end - (body + n)}
+		offset = end
+	}
+	return cb, nil
+}
+
+// Parses the varint length prefix of the CAR section starting at offset, returning the offsets of the start of the section body and of the end of the section
+func carSection(data []byte, offset int) (int, int, error) {
+	l, n := binary.Uvarint(data[offset:])
+	if n <= 0 {
+		return 0, 0, fmt.Errorf("bad section length")
+	}
+	body := offset + n
+	if l == 0 || l > uint64(len(data)-body) {
+		return 0, 0, fmt.Errorf("section length %d out of bounds", l)
+	}
+	return body, body + int(l), nil
+}
+
+// Get returns the data of the block with the given CID, or an error wrapping ErrMissingRecordBlock if the CAR slice doesn't include it. The returned slice shares memory with the event, and must not be modified.
+func (cb *CommitBlocks) Get(c cid.Cid) ([]byte, error) {
+	span, ok := cb.index[c]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMissingRecordBlock, c)
+	}
+	return cb.car[span.offset : span.offset+span.length : span.offset+span.length], nil
+}
+
+// Has reports whether the CAR slice includes the block with the given CID
+func (cb *CommitBlocks) Has(c cid.Cid) bool {
+	_, ok := cb.index[c]
+	return ok
+}
+
+// Len returns the number of blocks in the CAR slice
+func (cb *CommitBlocks) Len() int {
+	return len(cb.index)
+}
+
+// Record returns the raw CBOR bytes of the record written by a create or update op, as with CommitRecords, but for a single op
+func (cb *CommitBlocks) Record(op CommitOp) ([]byte, error) {
+	if op.CID == nil {
+		return nil, fmt.Errorf("repo op has no record (action=%s path=%s)", op.Action, op.Path())
+	}
+	b, err := cb.Get(*op.CID)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s)", err, op.Path())
+	}
+	return b, nil
+}
@@ -0,0 +1,371 @@
+package events_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	car "github.com/ipld/go-car"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestCommitOps(t *testing.T) {
+	c, err := cid.Decode("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := lexutil.LexLink(c)
+
+	evt := &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+				{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+				{Action: "update", Path: "app.bsky.actor.profile/self", Cid: &link},
+				{Action: "delete", Path: "app.bsky.feed.like/3k2akerrsrn2c", Cid: nil},
+			},
+		},
+	}
+
+	ops, err := evt.CommitOps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 ops, got %d", len(ops))
+	}
+	if ops[0].Collection != "app.bsky.feed.post" || ops[0].Rkey != "3k2akerrsrn2b" || ops[0].CID == nil || *ops[0].CID != c {
+		t.Fatalf("bad create op: %+v", ops[0])
+	}
+	if ops[1].Action != "update" || ops[1].Path() != "app.bsky.actor.profile/self" {
+		t.Fatalf("bad update op: %+v", ops[1])
+	}
+	if ops[2].Action != "delete" || ops[2].CID != nil {
+		t.Fatalf("bad delete op: %+v", ops[2])
+	}
+
+	// create with no CID is malformed
+	evt.RepoCommit.Ops[0].Cid = nil
+	if _, err := evt.CommitOps(); err == nil {
+		t.Fatal("expected error for create op with nil CID")
+	}
+
+	if _, err := (&events.XRPCStreamEvent{}).CommitOps(); err == nil {
+		t.Fatal("expected error for non-commit event")
+	}
+}
+
+// builds a CAR slice containing the given DAG-CBOR blocks, with the first as the root. Returns the CID of the first block.
+func testCAR(t *testing.T, blks ...[]byte) (cid.Cid, []byte) {
+	var cids []cid.Cid
+	for _, blk := range blks {
+		c, err := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: multihash.SHA2_256, MhLength: -1}.Sum(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, c)
+	}
+
+	buf := new(bytes.Buffer)
+	hb, err := cbor.DumpObject(&car.CarHeader{Roots: cids[:1], Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carstore.LdWrite(buf, hb); err != nil {
+		t.Fatal(err)
+	}
+	for i, blk := range blks {
+		if _, err := carstore.LdWrite(buf, cids[i].Bytes(), blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cids[0], buf.Bytes()
+}
+
+func TestCommitRecords(t *testing.T) {
+	// CBOR for {"a": 1}
+	recBytes := []byte{0xa1, 0x61, 0x61, 0x01}
+	recCid, carBytes := testCAR(t, recBytes)
+	link := lexutil.LexLink(recCid)
+
+	evt := &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Blocks: carBytes,
+			Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+				{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+				{Action: "delete", Path: "app.bsky.feed.like/3k2akerrsrn2c", Cid: nil},
+			},
+		},
+	}
+
+	recs, err := evt.CommitRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || !bytes.Equal(recs["app.bsky.feed.post/3k2akerrsrn2b"], recBytes) {
+		t.Fatalf("unexpected records: %v", recs)
+	}
+
+	// deletes only; no blocks needed
+	evt.RepoCommit.Ops = evt.RepoCommit.Ops[1:]
+	evt.RepoCommit.Blocks = nil
+	recs, err = evt.CommitRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 0 {
+		t.Fatalf("expected no records, got: %v", recs)
+	}
+
+	// create with no blocks
+	evt.RepoCommit.Ops = []*atproto.SyncSubscribeRepos_RepoOp{
+		{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+	}
+	if _, err := evt.CommitRecords(); !errors.Is(err, events.ErrMissingRecordBlock) {
+		t.Fatalf("expected ErrMissingRecordBlock, got: %v", err)
+	}
+}
+
+func TestDebugJSON(t *testing.T) {
+	recCid, carBytes := testCAR(t, []byte{0xa1, 0x61, 0x61, 0x01})
+	link := lexutil.LexLink(recCid)
+
+	evt := &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Repo:   "did:plc:testuser",
+			Seq:    123,
+			Commit: link,
+			Blocks: carBytes,
+		},
+	}
+
+	out, err := evt.DebugJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed struct {
+		RepoCommit struct {
+			Repo   string `json:"repo"`
+			Seq    int64  `json:"seq"`
+			Blocks struct {
+				Size   int `json:"size"`
+				Blocks []struct {
+					CID  string `json:"cid"`
+					Size int    `json:"size"`
+				} `json:"blocks"`
+			} `json:"blocks"`
+		}
+	}
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.RepoCommit.Repo != "did:plc:testuser" || parsed.RepoCommit.Seq != 123 {
+		t.Fatalf("unexpected commit fields: %s", out)
+	}
+	blks := parsed.RepoCommit.Blocks
+	if blks.Size != len(carBytes) || len(blks.Blocks) != 1 || blks.Blocks[0].CID != recCid.String() || blks.Blocks[0].Size != 4 {
+		t.Fatalf("unexpected blocks summary: %s", out)
+	}
+}
+
+func TestCommitRecordsLimits(t *testing.T) {
+	// a record, plus a large junk block
+	recBytes := []byte{0xa1, 0x61, 0x61, 0x01}
+	junk := append([]byte{0x5a, 0x00, 0x01, 0x00, 0x00}, make([]byte, 64<<10)...)
+	recCid, carBytes := testCAR(t, recBytes, junk, []byte{0xa0})
+	link := lexutil.LexLink(recCid)
+
+	evt := &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Blocks: carBytes,
+			Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+				{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+			},
+		},
+	}
+
+	// within default limits
+	if _, err := evt.CommitRecords(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := evt.CommitRecordsWithOptions(&events.CommitDecodeOptions{MaxCARSize: 32 << 10}); !errors.Is(err, events.ErrCommitTooLarge) {
+		t.Fatalf("expected ErrCommitTooLarge for CAR size, got: %v", err)
+	}
+	if _, err := evt.CommitRecordsWithOptions(&events.CommitDecodeOptions{MaxBlocks: 2}); !errors.Is(err, events.ErrCommitTooLarge) {
+		t.Fatalf("expected ErrCommitTooLarge for block count, got: %v", err)
+	}
+	if _, err := evt.CommitRecordsWithOptions(&events.CommitDecodeOptions{}); err != nil {
+		t.Fatalf("unexpected error with no limits: %v", err)
+	}
+}
+
+func TestPreparseCommitOps(t *testing.T) {
+	ctx := context.Background()
+	c, err := cid.Decode("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := lexutil.LexLink(c)
+
+	opts := events.DefaultEventManagerOptions()
+	opts.PreparseCommitOps = true
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	var subs []*events.Subscription
+	for _, ident := range []string{"a", "b"} {
+		sub, err := em.SubscribeWithOptions(ctx, ident, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		subs = append(subs, sub)
+	}
+
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Repo: "did:plc:testuser",
+			Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+				{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed [][]events.CommitOp
+	for _, sub := range subs {
+		select {
+		case evt := <-sub.Events():
+			ops, err := evt.CommitOps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != 1 || ops[0].Path() != "app.bsky.feed.post/3k2akerrsrn2b" {
+				t.Fatalf("bad ops: %+v", ops)
+			}
+			parsed = append(parsed, ops)
+
+			// swapping in a different commit is not hidden by the cache
+			other := *evt
+			other.RepoCommit = &atproto.SyncSubscribeRepos_Commit{}
+			if ops, err := other.CommitOps(); err != nil || len(ops) != 0 {
+				t.Fatalf("expected stale parsed ops to be ignored, got: %+v %v", ops, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	// parsed once, and shared
+	if &parsed[0][0] != &parsed[1][0] {
+		t.Fatal("expected subscribers to share the parsed ops")
+	}
+}
+
+func TestCommitBlocks(t *testing.T) {
+	recBytes := []byte{0xa1, 0x61, 0x61, 0x01}
+	otherBytes := []byte{0xa1, 0x61, 0x62, 0x02}
+	recCid, carBytes := testCAR(t, recBytes, otherBytes)
+	link := lexutil.LexLink(recCid)
+
+	evt := &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Blocks: carBytes,
+			Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+				{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+				{Action: "delete", Path: "app.bsky.feed.like/3k2akerrsrn2c"},
+			},
+		},
+	}
+
+	cb, err := evt.CommitBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cb.Len() != 2 || !cb.Has(recCid) {
+		t.Fatalf("unexpected index: %d blocks", cb.Len())
+	}
+	ops, err := evt.CommitOps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := cb.Record(ops[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec, recBytes) {
+		t.Fatalf("unexpected record bytes: %x", rec)
+	}
+	// a view into the event's CAR bytes, not a copy
+	if i := bytes.Index(carBytes, recBytes); i < 0 || &rec[0] != &carBytes[i] {
+		t.Fatal("expected record bytes to share memory with the CAR slice")
+	}
+	if _, err := cb.Record(ops[1]); err == nil {
+		t.Fatal("expected error for delete op")
+	}
+
+	missing, err := cid.Decode("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cb.Get(missing); !errors.Is(err, events.ErrMissingRecordBlock) {
+		t.Fatalf("expected ErrMissingRecordBlock, got: %v", err)
+	}
+
+	if _, err := evt.CommitBlocksWithOptions(&events.CommitDecodeOptions{MaxBlocks: 1}); !errors.Is(err, events.ErrCommitTooLarge) {
+		t.Fatalf("expected ErrCommitTooLarge, got: %v", err)
+	}
+
+	// truncated
+	evt.RepoCommit.Blocks = carBytes[:len(carBytes)-2]
+	if _, err := evt.CommitBlocks(); !errors.Is(err, events.ErrMalformedCAR) {
+		t.Fatalf("expected ErrMalformedCAR, got: %v", err)
+	}
+}
+
+func TestCommitBlocksTamperedBlock(t *testing.T) {
+	// CBOR for {"a": 1}
+	recBytes := []byte{0xa1, 0x61, 0x61, 0x01}
+	recCid, carBytes := testCAR(t, recBytes)
+	link := lexutil.LexLink(recCid)
+
+	// {"a": 2}, in place of the record, under the original CID
+	tampered := bytes.Clone(carBytes)
+	i := bytes.LastIndex(tampered, recBytes)
+	tampered[i+3] = 0x02
+
+	evt := &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Blocks: tampered,
+			Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+				{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+			},
+		},
+	}
+	if _, err := evt.CommitBlocks(); !errors.Is(err, events.ErrMalformedCAR) {
+		t.Fatalf("expected ErrMalformedCAR, got: %v", err)
+	}
+	if _, err := evt.CommitRecords(); err == nil {
+		t.Fatal("expected CommitRecords to reject the tampered block")
+	}
+
+	// skipped for trusted CAR slices
+	cb, err := evt.CommitBlocksWithOptions(&events.CommitDecodeOptions{TrustedCAR: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cb.Has(recCid) {
+		t.Fatal("expected the block to be indexed")
+	}
+}
@@ -0,0 +1,301 @@
+package events
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/bluesky-social/indigo/models"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codec applied to persisted commit blocks by CompressingPersister
+type CompressionCodec string
+
+const (
+	CompressionGzip CompressionCodec = "gzip"
+	CompressionZstd CompressionCodec = "zstd"
+)
+
+type CompressingPersisterOptions struct {
+	// Codec used for newly persisted events. Playback decompresses either codec (and passes uncompressed events through), whatever this is set to
+	Codec CompressionCodec
+	// Codec-specific compression level: 1-9 for gzip, or the zstd command line level (1-22, mapped to the nearest supported encoder level). Zero means the codec's default
+	Level int
+	// Payloads smaller than this many bytes are stored uncompressed, as the codec overhead outweighs any saving
+	MinSize int
+}
+
+func DefaultCompressingPersisterOptions() *CompressingPersisterOptions {
+	return &CompressingPersisterOptions{
+		Codec:   CompressionZstd,
+		MinSize: 256,
+	}
+}
+
+// Upper bound on the decompressed size of a single payload, to avoid huge allocations from a corrupt (or malicious) frame
+const maxDecompressedSize = 64 << 20
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// CompressingPersister wraps another EventPersistence, compressing the bulk of each event (the CAR slice in RepoCommit.Blocks) before it is persisted, and decompressing it again on Playback. Events are never modified in place: the inner persister is handed a copy, and live subscribers receive the original, uncompressed event.
+//
+// Only the commit blocks are compressed, not the whole serialized frame, since the inner persister does its own encoding. Other event kinds, and the rest of each commit, are stored as is. This makes it a no-op for persisters which do not store commit blocks themselves: DbPersistence keeps them in the carstore, so gains nothing, while DiskPersistence and MemPersister benefit.
+//
+// Compressed payloads are recognised by the codec's magic number, which cannot begin a CAR file, so Playback handles a mix of uncompressed, gzip and zstd frames. This means compression can be enabled on (or the codec switched for) an existing persister, without migrating its history.
+type CompressingPersister struct {
+	inner EventPersistence
+	opts  CompressingPersisterOptions
+
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+
+	// copies handed to the inner persister, mapped to a pendingEvent, so the inner persister's broadcast can be redirected to the original. Entries are removed when the copy is broadcast, when persisting it fails, or (for any the inner persister dropped) by the next successful Flush
+	pending sync.Map
+	// guards gen: held for reading by Persist, and for writing by Flush to start a new generation
+	genLk sync.RWMutex
+	gen   uint64
+
+	broadcast func(*XRPCStreamEvent)
+}
+
+type pendingEvent struct {
+	orig *XRPCStreamEvent
+	// the Flush generation the copy was persisted in
+	gen uint64
+}
+
+var _ EventPersistence = (*CompressingPersister)(nil)
+var _ LastSequencePersister = (*CompressingPersister)(nil)
+var _ FloorSequencePersister = (*CompressingPersister)(nil)
+var _ CountSincePersister = (*CompressingPersister)(nil)
+
+// NewCompressingPersister wraps inner with compression. If opts is nil, DefaultCompressingPersisterOptions is used.
+func NewCompressingPersister(inner EventPersistence, opts *CompressingPersisterOptions) (*CompressingPersister, error) {
+	if opts == nil {
+		opts = DefaultCompressingPersisterOptions()
+	}
+
+	cp := &CompressingPersister{
+		inner: inner,
+		opts:  *opts,
+	}
+
+	switch opts.Codec {
+	case CompressionGzip:
+		if opts.Level != 0 && (opts.Level < gzip.BestSpeed || opts.Level > gzip.BestCompression) {
+			return nil, fmt.Errorf("invalid gzip compression level: %d", opts.Level)
+		}
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if opts.Level != 0 {
+			if opts.Level < 1 || opts.Level > 22 {
+				return nil, fmt.Errorf("invalid zstd compression level: %d", opts.Level)
+			}
+			level = zstd.EncoderLevelFromZstd(opts.Level)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		cp.zenc = enc
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %q", opts.Codec)
+	}
+
+	// always able to decode zstd, for frames written before a switch to gzip
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	cp.zdec = dec
+
+	return cp, nil
+}
+
+func (cp *CompressingPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+	if e.RepoCommit == nil || len(e.RepoCommit.Blocks) < cp.opts.MinSize {
+		return cp.inner.Persist(ctx, e)
+	}
+
+	blocks, err := cp.compress(e.RepoCommit.Blocks)
+	if err != nil {
+		return fmt.Errorf("failed to compress event: %w", err)
+	}
+	if len(blocks) >= len(e.RepoCommit.Blocks) {
+		// incompressible; not worth the cost of decompressing on playback
+		return cp.inner.Persist(ctx, e)
+	}
+
+	evt := *e
+	commit := *e.RepoCommit
+	commit.Blocks = blocks
+	evt.RepoCommit = &commit
+
+	// held until the inner persister has the event, so a concurrent Flush can't mistake it for one which was dropped
+	cp.genLk.RLock()
+	defer cp.genLk.RUnlock()
+	cp.pending.Store(&evt, pendingEvent{orig: e, gen: cp.gen})
+	if err := cp.inner.Persist(ctx, &evt); err != nil {
+		cp.pending.Delete(&evt)
+		return err
+	}
+	// the sequence number is assigned to the copy
+	e.RepoCommit.Seq = commit.Seq
+	return nil
+}
+
+func (cp *CompressingPersister) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	return cp.inner.Playback(ctx, since, func(e *XRPCStreamEvent) error {
+		if e.RepoCommit == nil || !isCompressed(e.RepoCommit.Blocks) {
+			return cb(e)
+		}
+
+		blocks, err := cp.decompress(e.RepoCommit.Blocks)
+		if err != nil {
+			return fmt.Errorf("failed to decompress event (seq=%d): %w", e.RepoCommit.Seq, err)
+		}
+
+		// the inner persister may hand out events it retains (eg, MemPersister), so they are copied rather than modified
+		evt := *e
+		commit := *e.RepoCommit
+		commit.Blocks = blocks
+		evt.RepoCommit = &commit
+		return cb(&evt)
+	})
+}
+
+// FloorSequence forwards to the inner persister, returning zero if it does not implement FloorSequencePersister
+func (cp *CompressingPersister) FloorSequence(ctx context.Context) (int64, error) {
+	fsp, ok := cp.inner.(FloorSequencePersister)
+	if !ok {
+		return 0, nil
+	}
+	return fsp.FloorSequence(ctx)
+}
+
+// CountSince forwards to the inner persister, returning ErrCountUnsupported if it does not implement CountSincePersister
+func (cp *CompressingPersister) CountSince(ctx context.Context, since int64) (int64, error) {
+	csp, ok := cp.inner.(CountSincePersister)
+	if !ok {
+		return 0, ErrCountUnsupported
+	}
+	return csp.CountSince(ctx, since)
+}
+
+// LastSequence forwards to the inner persister, returning zero if it does not implement LastSequencePersister
+func (cp *CompressingPersister) LastSequence(ctx context.Context) (int64, error) {
+	lsp, ok := cp.inner.(LastSequencePersister)
+	if !ok {
+		return 0, nil
+	}
+	return lsp.LastSequence(ctx)
+}
+
+func (cp *CompressingPersister) TakeDownRepo(ctx context.Context, usr models.Uid) error {
+	return cp.inner.TakeDownRepo(ctx, usr)
+}
+
+// Flush flushes the inner persister. Once that succeeds, everything persisted before the flush started has been broadcast, so any remaining pending entries from then are for events the inner persister dropped, and are discarded
+func (cp *CompressingPersister) Flush(ctx context.Context) error {
+	cp.genLk.Lock()
+	gen := cp.gen
+	cp.gen++
+	cp.genLk.Unlock()
+
+	if err := cp.inner.Flush(ctx); err != nil {
+		return err
+	}
+	cp.pending.Range(func(k, v any) bool {
+		if v.(pendingEvent).gen <= gen {
+			cp.pending.Delete(k)
+		}
+		return true
+	})
+	return nil
+}
+
+func (cp *CompressingPersister) Shutdown(ctx context.Context) error {
+	err := cp.inner.Shutdown(ctx)
+	cp.pending.Range(func(k, _ any) bool {
+		cp.pending.Delete(k)
+		return true
+	})
+	if cp.zenc != nil {
+		cp.zenc.Close()
+	}
+	cp.zdec.Close()
+	return err
+}
+
+func (cp *CompressingPersister) SetEventBroadcaster(brc func(*XRPCStreamEvent)) {
+	cp.broadcast = brc
+	cp.inner.SetEventBroadcaster(func(e *XRPCStreamEvent) {
+		if pe, ok := cp.pending.LoadAndDelete(e); ok {
+			o := pe.(pendingEvent).orig
+			o.RepoCommit.Seq = e.RepoCommit.Seq
+			e = o
+		}
+		cp.broadcast(e)
+	})
+}
+
+func (cp *CompressingPersister) compress(data []byte) ([]byte, error) {
+	switch cp.opts.Codec {
+	case CompressionZstd:
+		return cp.zenc.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case CompressionGzip:
+		level := cp.opts.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+		w, err := gzip.NewWriterLevel(buf, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %q", cp.opts.Codec)
+	}
+}
+
+var errDecompressedTooLarge = errors.New("decompressed payload too large")
+
+func (cp *CompressingPersister) decompress(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, zstdMagic) {
+		return cp.zdec.DecodeAll(data, nil)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, errDecompressedTooLarge
+	}
+	return out, nil
+}
+
+// A CAR file starts with a varint header length followed by a CBOR map, which neither magic number can be mistaken for
+func isCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, zstdMagic) || bytes.HasPrefix(data, gzipMagic)
+}
@@ -0,0 +1,72 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+)
+
+// accepts events without ever broadcasting them (eg, like a persister which filters some out), or fails every Persist
+type droppingPersister struct {
+	*MemPersister
+	fail bool
+}
+
+func (dp *droppingPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+	if dp.fail {
+		return errors.New("persist failed")
+	}
+	return nil
+}
+
+func countPending(cp *CompressingPersister) int {
+	n := 0
+	cp.pending.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestCompressingPersisterPending(t *testing.T) {
+	ctx := context.Background()
+	blocks := bytes.Repeat([]byte("not really a car file "), 100)
+	commit := func() *XRPCStreamEvent {
+		return &XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser", Blocks: append([]byte{}, blocks...)},
+		}
+	}
+
+	inner := &droppingPersister{MemPersister: NewMemPersister()}
+	cp, err := NewCompressingPersister(inner, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.SetEventBroadcaster(func(*XRPCStreamEvent) {})
+
+	for i := 0; i < 3; i++ {
+		if err := cp.Persist(ctx, commit()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countPending(cp); n != 3 {
+		t.Fatalf("expected 3 pending events before flush, got %d", n)
+	}
+	if err := cp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPending(cp); n != 0 {
+		t.Fatalf("expected dropped events to be discarded by flush, got %d pending", n)
+	}
+
+	inner.fail = true
+	if err := cp.Persist(ctx, commit()); err == nil {
+		t.Fatal("expected persist error")
+	}
+	if n := countPending(cp); n != 0 {
+		t.Fatalf("expected failed event not to be pending, got %d", n)
+	}
+}
@@ -0,0 +1,129 @@
+package events_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+)
+
+func TestCompressingPersister(t *testing.T) {
+	ctx := context.Background()
+
+	// compressible, and big enough to be worth it
+	blocks := bytes.Repeat([]byte("not really a car file "), 100)
+	commit := func() *events.XRPCStreamEvent {
+		return &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser", Blocks: append([]byte{}, blocks...)},
+		}
+	}
+
+	inner := events.NewMemPersister()
+	inner.SetEventBroadcaster(func(*events.XRPCStreamEvent) {})
+
+	// history from before compression was enabled, then a codec switch
+	if err := inner.Persist(ctx, commit()); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := events.NewCompressingPersister(inner, &events.CompressingPersisterOptions{Codec: events.CompressionGzip, Level: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz.SetEventBroadcaster(func(*events.XRPCStreamEvent) {})
+	if err := gz.Persist(ctx, commit()); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := events.NewCompressingPersister(inner, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	em := events.NewEventManager(cp)
+	sub, err := em.SubscribeWithOptions(ctx, "live", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	evt := commit()
+	if err := em.AddEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	if evt.RepoCommit.Seq != 3 {
+		t.Fatalf("expected sequence number to be assigned to the caller's event, got %d", evt.RepoCommit.Seq)
+	}
+	// a small event is stored as is
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser", Blocks: []byte("tiny")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// live subscribers get the original event
+	select {
+	case got := <-sub.Events():
+		if got.RepoCommit != evt.RepoCommit {
+			t.Fatal("expected live subscriber to receive the original event")
+		}
+		if !bytes.Equal(got.RepoCommit.Blocks, blocks) {
+			t.Fatal("live event was modified")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for live event")
+	}
+
+	// stored compressed
+	var stored [][]byte
+	if err := inner.Playback(ctx, 0, func(e *events.XRPCStreamEvent) error {
+		stored = append(stored, e.RepoCommit.Blocks)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 4 {
+		t.Fatalf("expected 4 stored events, got %d", len(stored))
+	}
+	if !bytes.Equal(stored[0], blocks) || !bytes.Equal(stored[3], []byte("tiny")) {
+		t.Fatal("expected uncompressed events to be stored as is")
+	}
+	for _, b := range stored[1:3] {
+		if len(b) >= len(blocks) {
+			t.Fatalf("expected compressed payload, got %d bytes", len(b))
+		}
+	}
+
+	// and played back decompressed, whichever codec wrote them
+	var seqs []int64
+	if err := cp.Playback(ctx, 0, func(e *events.XRPCStreamEvent) error {
+		seqs = append(seqs, e.RepoCommit.Seq)
+		if e.RepoCommit.Seq <= 3 && !bytes.Equal(e.RepoCommit.Blocks, blocks) {
+			t.Fatalf("event %d not decompressed", e.RepoCommit.Seq)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 4 {
+		t.Fatalf("expected 4 events played back, got %v", seqs)
+	}
+
+	// playback must not decompress the inner persister's copy in place
+	if err := inner.Playback(ctx, 1, func(e *events.XRPCStreamEvent) error {
+		if e.RepoCommit.Seq == 2 && bytes.Equal(e.RepoCommit.Blocks, blocks) {
+			t.Fatal("stored event was modified by playback")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := events.NewCompressingPersister(inner, &events.CompressingPersisterOptions{Codec: "lz4"}); err == nil {
+		t.Fatal("expected error for unknown codec")
+	}
+	if _, err := events.NewCompressingPersister(inner, &events.CompressingPersisterOptions{Codec: events.CompressionZstd, Level: 30}); err == nil {
+		t.Fatal("expected error for invalid level")
+	}
+}
@@ -23,6 +23,8 @@ type RepoStreamCallbacks struct {
 	LabelLabels   func(evt *comatproto.LabelSubscribeLabels_Labels) error
 	LabelInfo     func(evt *comatproto.LabelSubscribeLabels_Info) error
 	Error         func(evt *ErrorFrame) error
+	// Called for message types this package does not model natively (see XRPCStreamEvent.Extra), with the raw DAG-CBOR body
+	Extra func(msgType string, body []byte) error
 }
 
 func (rsc *RepoStreamCallbacks) EventHandler(ctx context.Context, xev *XRPCStreamEvent) error {
@@ -43,6 +45,13 @@ func (rsc *RepoStreamCallbacks) EventHandler(ctx context.Context, xev *XRPCStrea
 		return rsc.LabelInfo(xev.LabelInfo)
 	case xev.Error != nil && rsc.Error != nil:
 		return rsc.Error(xev.Error)
+	case len(xev.Extra) > 0 && rsc.Extra != nil:
+		for t, body := range xev.Extra {
+			if err := rsc.Extra(t, body); err != nil {
+				return err
+			}
+		}
+		return nil
 	default:
 		return nil
 	}
@@ -250,6 +259,18 @@ func HandleRepoStream(ctx context.Context, con *websocket.Conn, sched Scheduler)
 				}); err != nil {
 					return err
 				}
+			default:
+				// pass through message types we don't model, rather than dropping them
+				body, err := io.ReadAll(r)
+				if err != nil {
+					return fmt.Errorf("reading %s event: %w", header.MsgType, err)
+				}
+
+				if err := sched.AddWork(ctx, "", &XRPCStreamEvent{
+					Extra: map[string][]byte{header.MsgType: body},
+				}); err != nil {
+					return err
+				}
 			}
 
 		case EvtKindErrorFrame:
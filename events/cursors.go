@@ -0,0 +1,87 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// CursorStore persists the last-acknowledged sequence number for named consumers, so they can reconnect and resume without tracking their own cursor. Implementations must be safe for concurrent use.
+type CursorStore interface {
+	// Returns the stored cursor for the consumer, and false if there is none
+	GetCursor(ctx context.Context, consumer string) (int64, bool, error)
+	PutCursor(ctx context.Context, consumer string, seq int64) error
+}
+
+// Returned by AckSequence if the EventManager was not configured with a CursorStore
+var ErrNoCursorStore = errors.New("event manager has no cursor store configured")
+
+// MemCursorStore is an in-memory CursorStore. Cursors do not survive a restart, so this is mostly useful for tests and for consumers which only need to survive reconnects.
+type MemCursorStore struct {
+	lk      sync.Mutex
+	cursors map[string]int64
+}
+
+func NewMemCursorStore() *MemCursorStore {
+	return &MemCursorStore{
+		cursors: make(map[string]int64),
+	}
+}
+
+func (s *MemCursorStore) GetCursor(ctx context.Context, consumer string) (int64, bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	seq, ok := s.cursors[consumer]
+	return seq, ok, nil
+}
+
+func (s *MemCursorStore) PutCursor(ctx context.Context, consumer string, seq int64) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.cursors[consumer] = seq
+	return nil
+}
+
+// AckSequence records that the named consumer has processed all events up to and including seq. A consumer which later subscribes with the same ConsumerName (and no explicit Since) resumes after this point. Acks which would move the cursor backwards are ignored.
+func (em *EventManager) AckSequence(consumer string, seq int64) error {
+	if em.cursors == nil {
+		return ErrNoCursorStore
+	}
+
+	// serialize read-modify-write so concurrent acks can't move the cursor backwards
+	em.cursorsLk.Lock()
+	defer em.cursorsLk.Unlock()
+
+	ctx := context.Background()
+	cur, ok, err := em.cursors.GetCursor(ctx, consumer)
+	if err != nil {
+		return fmt.Errorf("failed to read consumer cursor: %w", err)
+	}
+	if ok && seq <= cur {
+		return nil
+	}
+	if err := em.cursors.PutCursor(ctx, consumer, seq); err != nil {
+		return fmt.Errorf("failed to store consumer cursor: %w", err)
+	}
+	return nil
+}
+
+// resolves the starting cursor for a subscription, falling back to the consumer's stored cursor (if any)
+func (em *EventManager) consumerSince(ctx context.Context, opts *SubscribeOptions) (*int64, error) {
+	if opts.Since != nil || opts.ConsumerName == "" {
+		return opts.Since, nil
+	}
+	if em.cursors == nil {
+		return nil, ErrNoCursorStore
+	}
+	seq, ok, err := em.cursors.GetCursor(ctx, opts.ConsumerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consumer cursor: %w", err)
+	}
+	if !ok {
+		// first connection for this consumer; start live
+		return nil, nil
+	}
+	return &seq, nil
+}
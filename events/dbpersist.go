@@ -82,6 +82,10 @@ type RepoEventRecord struct {
 	Ops []byte
 }
 
+var _ EventPersistence = (*DbPersistence)(nil)
+var _ FloorSequencePersister = (*DbPersistence)(nil)
+var _ CountSincePersister = (*DbPersistence)(nil)
+
 func NewDbPersistence(db *gorm.DB, cs *carstore.CarStore, options *Options) (*DbPersistence, error) {
 	if err := db.AutoMigrate(&RepoEventRecord{}); err != nil {
 		return nil, err
@@ -365,6 +369,25 @@ func (p *DbPersistence) Playback(ctx context.Context, since int64, cb func(*XRPC
 	return nil
 }
 
+func (p *DbPersistence) FloorSequence(ctx context.Context) (int64, error) {
+	var floor *int64
+	if err := p.db.WithContext(ctx).Model(&RepoEventRecord{}).Select("min(seq)").Scan(&floor).Error; err != nil {
+		return 0, err
+	}
+	if floor == nil {
+		return 0, nil
+	}
+	return *floor, nil
+}
+
+func (p *DbPersistence) CountSince(ctx context.Context, since int64) (int64, error) {
+	var n int64
+	if err := p.db.WithContext(ctx).Model(&RepoEventRecord{}).Where("seq > ?", since).Count(&n).Error; err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (p *DbPersistence) hydrateBatch(ctx context.Context, batch []*RepoEventRecord, cb func(*XRPCStreamEvent) error) error {
 	events := make([]*XRPCStreamEvent, len(batch))
 
@@ -0,0 +1,91 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+
+	car "github.com/ipld/go-car/v2"
+)
+
+// Summary of a commit's CAR slice, used in place of the raw bytes in DebugJSON output
+type debugBlocks struct {
+	Size   int          `json:"size"`
+	Blocks []debugBlock `json:"blocks"`
+	// set if the CAR could not be parsed; any blocks read before the error are still listed
+	Error string `json:"error,omitempty"`
+}
+
+type debugBlock struct {
+	CID  string `json:"cid"`
+	Size int    `json:"size"`
+}
+
+type debugCommit struct {
+	*comatproto.SyncSubscribeRepos_Commit
+	// shadows the embedded raw Blocks field
+	Blocks *debugBlocks `json:"blocks,omitempty"`
+}
+
+type debugEvent struct {
+	Error         *ErrorFrame                              `json:",omitempty"`
+	RepoCommit    *debugCommit                             `json:",omitempty"`
+	RepoHandle    *comatproto.SyncSubscribeRepos_Handle    `json:",omitempty"`
+	RepoInfo      *comatproto.SyncSubscribeRepos_Info      `json:",omitempty"`
+	RepoMigrate   *comatproto.SyncSubscribeRepos_Migrate   `json:",omitempty"`
+	RepoTombstone *comatproto.SyncSubscribeRepos_Tombstone `json:",omitempty"`
+	LabelLabels   *comatproto.LabelSubscribeLabels_Labels  `json:",omitempty"`
+	LabelInfo     *comatproto.LabelSubscribeLabels_Info    `json:",omitempty"`
+}
+
+// DebugJSON renders the event as indented JSON for logging and debugging. The CAR slice in commit events is summarized (block CIDs and sizes) instead of being dumped as base64.
+func (evt *XRPCStreamEvent) DebugJSON() ([]byte, error) {
+	out := debugEvent{
+		Error:         evt.Error,
+		RepoHandle:    evt.RepoHandle,
+		RepoInfo:      evt.RepoInfo,
+		RepoMigrate:   evt.RepoMigrate,
+		RepoTombstone: evt.RepoTombstone,
+		LabelLabels:   evt.LabelLabels,
+		LabelInfo:     evt.LabelInfo,
+	}
+	if evt.RepoCommit != nil {
+		out.RepoCommit = &debugCommit{
+			SyncSubscribeRepos_Commit: evt.RepoCommit,
+			Blocks:                    summarizeBlocks(evt.RepoCommit.Blocks),
+		}
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
+
+func summarizeBlocks(b []byte) *debugBlocks {
+	if b == nil {
+		return nil
+	}
+	sum := &debugBlocks{
+		Size:   len(b),
+		Blocks: []debugBlock{},
+	}
+	br, err := car.NewBlockReader(bytes.NewReader(b))
+	if err != nil {
+		sum.Error = err.Error()
+		return sum
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sum.Error = err.Error()
+			break
+		}
+		sum.Blocks = append(sum.Blocks, debugBlock{
+			CID:  blk.Cid().String(),
+			Size: len(blk.RawData()),
+		})
+	}
+	return sum
+}
@@ -69,6 +69,8 @@ const (
 )
 
 var _ (EventPersistence) = (*DiskPersistence)(nil)
+var _ FloorSequencePersister = (*DiskPersistence)(nil)
+var _ CountSincePersister = (*DiskPersistence)(nil)
 
 type DiskPersistOptions struct {
 	UIDCacheSize    int
@@ -640,6 +642,34 @@ func (dp *DiskPersistence) Playback(ctx context.Context, since int64, cb func(*X
 	return nil
 }
 
+func (dp *DiskPersistence) LastSequence(ctx context.Context) (int64, error) {
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+	// curSeq is the next sequence number to be assigned
+	return max(0, dp.curSeq-1), nil
+}
+
+func (dp *DiskPersistence) FloorSequence(ctx context.Context) (int64, error) {
+	var lfr LogFileRef
+	if err := dp.meta.WithContext(ctx).Order("seq_start asc").Limit(1).Find(&lfr).Error; err != nil {
+		return 0, err
+	}
+	return lfr.SeqStart, nil
+}
+
+// CountSince is computed from the sequence range, as sequence numbers are contiguous. Events for taken down repos are included, although playback skips them.
+func (dp *DiskPersistence) CountSince(ctx context.Context, since int64) (int64, error) {
+	floor, err := dp.FloorSequence(ctx)
+	if err != nil {
+		return 0, err
+	}
+	last, err := dp.LastSequence(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return max(0, last-max(since, floor-1, 0)), nil
+}
+
 func (dp *DiskPersistence) PlaybackLogfiles(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error, logFiles []LogFileRef) (*int64, error) {
 	for i, lf := range logFiles {
 		lastSeq, err := dp.readEventsFrom(ctx, since, filepath.Join(dp.primaryDir, lf.Path), cb)
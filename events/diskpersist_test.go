@@ -382,6 +382,16 @@ func runEventManagerTest(t *testing.T, cs *carstore.CarStore, db *gorm.DB, p eve
 	if outEvtCount != testSize {
 		t.Fatalf("expected %d events, got %d", testSize, outEvtCount)
 	}
+
+	for since, expected := range map[int64]int64{0: int64(testSize), 90: 10, int64(testSize): 0, 1000: 0} {
+		n, err := p.(events.CountSincePersister).CountSince(ctx, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatalf("expected %d events since %d, got %d", expected, since, n)
+		}
+	}
 }
 
 func TestDiskPersisterTakedowns(t *testing.T) {
@@ -4,14 +4,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/models"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	logging "github.com/ipfs/go-log"
+	cbg "github.com/whyrusleeping/cbor-gen"
 	"go.opentelemetry.io/otel"
 )
 
@@ -25,19 +33,183 @@ type Scheduler interface {
 type EventManager struct {
 	subs   []*Subscriber
 	subsLk sync.Mutex
+	// subscribers not yet attached to the live stream (mostly those playing back persisted events), for introspection and MaxSubscribers; guarded by subsLk
+	attaching map[*Subscriber]struct{}
+	// zero if unlimited
+	maxSubscribers int
+	// set by Shutdown; no new subscribers are added after this
+	shutdown bool
 
-	bufferSize int
+	bufferSize    int
+	highWater     int
+	stallTimeout  time.Duration
+	slowBroadcast time.Duration
 
 	persister EventPersistence
+
+	// optional structured logger; falls back to package logger if nil
+	logger *slog.Logger
+
+	clock Clock
+
+	// per-ident rate limiters for new subscriptions; nil if disabled
+	subLimiters   *expirable.LRU[string, *rate.Limiter]
+	subLimitersLk sync.Mutex
+	subRate       rate.Limit
+	subBurst      int
+
+	// bounds the number of concurrent subscriber playbacks; nil if unlimited
+	playbackSem chan struct{}
+
+	// if set, AddEvent broadcasts only after the event has been durably persisted (see EventManagerOptions)
+	persistBeforeBroadcast bool
+	persistLk              sync.Mutex
+
+	// closed by Shutdown, to stop background routines
+	stop chan struct{}
+
+	// optional store of named consumer cursors
+	cursors   CursorStore
+	cursorsLk sync.Mutex
+
+	allowEmptyEvents  bool
+	preparseCommitOps bool
+
+	// set of event kinds AddEvent accepts (see SetAllowedKinds); nil allows all
+	allowedKinds atomic.Pointer[map[string]bool]
+
+	// highest sequence number seen passing through the manager (zero if none yet), and the playback distance beyond which subscribers get a LargeBacklog hint
+	lastSeq          atomic.Int64
+	backlogThreshold int64
+
+	// optional tee of a random sample of incoming events (see SetSampler)
+	sampler atomic.Pointer[eventSampler]
+}
+
+type EventManagerOptions struct {
+	// Size of each subscriber's outgoing event buffer; DefaultBufferSize if zero
+	BufferSize int
+
+	// If not nil, warnings and errors are logged here instead of to the package-level "events" logger
+	Logger *slog.Logger
+
+	// If set (between 0 and 1), slow consumers are evicted once their buffer is this fraction full, instead of waiting for it to be completely full. This leaves room to reliably deliver the ConsumerTooSlow error frame.
+	HighWaterRatio float64
+
+	// If non-zero, new subscriptions are rate-limited per ident (token bucket), and Subscribe returns ErrTooManySubscriptions when the limit is exceeded
+	SubscribeRateLimit rate.Limit
+	SubscribeBurst     int
+
+	// If non-zero, Subscribe returns ErrTooManySubscribers once this many subscribers (live or replaying) are active, rather than growing without bound. Each subscriber holds a buffer of up to BufferSize events, so this caps memory use if, for example, a consuming service leaks subscriptions. The limit is exported as indigo_events_max_subscribers, for alerting against indigo_events_subscribers
+	MaxSubscribers int
+
+	// If non-zero, at most this many subscribers may be replaying from the persister at once. Others wait (in order of arrival, roughly) for a slot, which smooths out reconnect storms against the persistence backend.
+	MaxConcurrentPlaybacks int
+
+	// If true, events are only broadcast to live subscribers after they have been persisted *and* flushed successfully, so any event a consumer sees live can also be replayed. Events which fail to persist are never broadcast, and AddEvent returns the error.
+	//
+	// This adds latency: every AddEvent call synchronously flushes the persister, and calls are serialized to keep broadcast order matching sequence order. For batching persisters (DbPersistence, DiskPersistence) this gives up most of the benefit of batching. YoloPersister does not persist at all, so this has no meaning with it.
+	PersistBeforeBroadcast bool
+
+	// If non-zero, each subscriber's outgoing buffer fill ratio is sampled at this interval and exported as the indigo_events_subscriber_buffer_saturation gauge (by ident). This is useful for alerting on consumers before they are evicted.
+	SaturationSampleInterval time.Duration
+
+	// If non-zero, a subscriber whose oldest buffered event has been waiting this long (ie, which has gone this long without consuming anything) is treated as stuck and evicted (as ConsumerTooSlow), even if its buffer is not yet full. A consumer which is slow but keeps making progress is not affected. Checked whenever an event is broadcast to the subscriber.
+	StallTimeout time.Duration
+
+	// If not nil, named consumers (SubscribeOptions.ConsumerName) can record their progress with AckSequence, and resume from it on reconnect
+	CursorStore CursorStore
+
+	// If non-zero, subscribers whose cursor is more than this many events behind the tip (LastSequence, or PlaybackBacklog if no events have been seen since startup) get a LargeBacklog info frame before playback starts, suggesting they reconnect without a cursor if they don't need the full backlog. Playback proceeds regardless
+	BacklogHintThreshold int64
+
+	// If non-zero, a warning is logged whenever fanning an event out to subscribers takes longer than this. Broadcast runs synchronously in the persister's write path, so slow fanout holds up persistence (and ingestion); the full distribution is always exported as the indigo_events_broadcast_duration_seconds histogram
+	SlowBroadcastThreshold time.Duration
+
+	// By default, AddEvent rejects events with no payload set (returning ErrEmptyEvent). If true, such events are passed through to the persister and subscribers as-is, as in older versions
+	AllowEmptyEvents bool
+
+	// If true, AddEvent parses each commit's ops once, and caches the result on the event broadcast to live subscribers, so their CommitOps calls share it instead of each re-parsing the same ops. This costs a little ingestion time for every commit, in exchange for savings across a large subscriber set. Played back events are not affected
+	PreparseCommitOps bool
+
+	// Source of time for stall detection, eviction timeouts, and rate limits; the real clock if nil. See Clock
+	Clock Clock
+
+	// If not empty, the only event kinds AddEvent accepts; see SetAllowedKinds
+	AllowedKinds []string
+}
+
+// Subscriber buffer size used when EventManagerOptions.BufferSize is not set
+const DefaultBufferSize = 32 << 10
+
+func DefaultEventManagerOptions() *EventManagerOptions {
+	return &EventManagerOptions{
+		BufferSize: DefaultBufferSize,
+	}
 }
 
 func NewEventManager(persister EventPersistence) *EventManager {
+	return NewEventManagerWithOptions(persister, nil)
+}
+
+func NewEventManagerWithOptions(persister EventPersistence, opts *EventManagerOptions) *EventManager {
+	if opts == nil {
+		opts = DefaultEventManagerOptions()
+	}
+
 	em := &EventManager{
-		bufferSize: 32 << 10,
+		bufferSize: opts.BufferSize,
 		persister:  persister,
+		logger:     opts.Logger,
+		clock:      opts.Clock,
+		stop:       make(chan struct{}),
+		cursors:    opts.CursorStore,
+
+		allowEmptyEvents:  opts.AllowEmptyEvents,
+		preparseCommitOps: opts.PreparseCommitOps,
+		backlogThreshold:  opts.BacklogHintThreshold,
+		stallTimeout:      opts.StallTimeout,
+		slowBroadcast:     opts.SlowBroadcastThreshold,
+		maxSubscribers:    opts.MaxSubscribers,
 	}
 
-	persister.SetEventBroadcaster(em.broadcastEvent)
+	if em.bufferSize <= 0 {
+		em.bufferSize = DefaultBufferSize
+	}
+	if em.clock == nil {
+		em.clock = identity.SystemClock{}
+	}
+	em.SetAllowedKinds(opts.AllowedKinds)
+
+	if opts.MaxSubscribers > 0 {
+		maxSubscribersGauge.Set(float64(opts.MaxSubscribers))
+	}
+
+	if opts.HighWaterRatio > 0 && opts.HighWaterRatio < 1 {
+		em.highWater = max(1, int(float64(em.bufferSize)*opts.HighWaterRatio))
+	}
+
+	if opts.SubscribeRateLimit > 0 {
+		em.subRate = opts.SubscribeRateLimit
+		em.subBurst = max(1, opts.SubscribeBurst)
+		em.subLimiters = expirable.NewLRU[string, *rate.Limiter](100_000, nil, time.Hour)
+	}
+
+	if opts.MaxConcurrentPlaybacks > 0 {
+		em.playbackSem = make(chan struct{}, opts.MaxConcurrentPlaybacks)
+	}
+
+	if opts.PersistBeforeBroadcast {
+		em.persistBeforeBroadcast = true
+		// the persister would otherwise broadcast as soon as it has assigned a sequence number; AddEvent does it instead, after the flush
+		persister.SetEventBroadcaster(func(*XRPCStreamEvent) {})
+	} else {
+		persister.SetEventBroadcaster(em.broadcastEvent)
+	}
+
+	if opts.SaturationSampleInterval > 0 {
+		go em.sampleSaturation(opts.SaturationSampleInterval)
+	}
 
 	return em
 }
@@ -54,69 +226,343 @@ type Operation struct {
 	evt *XRPCStreamEvent
 }
 
+// Called with subsLk held, at the end of broadcastEvent
+func (em *EventManager) observeBroadcast(start time.Time, kind string) {
+	took := time.Since(start)
+	broadcastDuration.Observe(took.Seconds())
+	if em.slowBroadcast > 0 && took > em.slowBroadcast {
+		em.logWarn("slow event broadcast is holding up persistence", "duration", took, "threshold", em.slowBroadcast, "subscribers", len(em.subs), "kind", kind)
+	}
+}
+
+func (em *EventManager) logWarn(msg string, args ...any) {
+	if em.logger != nil {
+		em.logger.Warn(msg, args...)
+		return
+	}
+	log.Warnw(msg, args...)
+}
+
+func (em *EventManager) logError(msg string, args ...any) {
+	if em.logger != nil {
+		em.logger.Error(msg, args...)
+		return
+	}
+	log.Errorw(msg, args...)
+}
+
 func (em *EventManager) Shutdown(ctx context.Context) error {
-	return em.persister.Shutdown(ctx)
+	err := em.persister.Shutdown(ctx)
+
+	em.subsLk.Lock()
+	if !em.shutdown {
+		close(em.stop)
+	}
+	em.shutdown = true
+	subs := make([]*Subscriber, len(em.subs))
+	copy(subs, em.subs)
+	em.subsLk.Unlock()
+
+	shutdownFrame := &XRPCStreamEvent{
+		Error: &ErrorFrame{
+			Error: ErrorFrameShutdown,
+		},
+	}
+	for _, s := range subs {
+		// best effort: a consumer with a full buffer just sees the stream end. Subscribers being evicted already have a final frame on the way (and their lock may be held while it is sent)
+		if !s.evicting.Load() {
+			s.lk.Lock()
+			if !s.cleanedUp {
+				select {
+				case s.outgoing <- shutdownFrame:
+				default:
+				}
+			}
+			s.lk.Unlock()
+		}
+		s.close(em, CloseReasonShutdown)
+	}
+
+	return err
+}
+
+// Periodically exports the fill ratio of each subscriber's outgoing buffer. When several subscribers share an ident, the most saturated one is reported.
+func (em *EventManager) sampleSaturation(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-em.stop:
+			subscriberSaturation.Reset()
+			return
+		case <-t.C:
+		}
+
+		byIdent := make(map[string]float64)
+		em.subsLk.Lock()
+		for _, s := range em.subs {
+			if cap(s.outgoing) == 0 {
+				continue
+			}
+			sat := float64(len(s.outgoing)) / float64(cap(s.outgoing))
+			if sat >= byIdent[s.ident] {
+				byIdent[s.ident] = sat
+			}
+		}
+		em.subsLk.Unlock()
+
+		// reset so that disconnected idents don't linger
+		subscriberSaturation.Reset()
+		for ident, sat := range byIdent {
+			subscriberSaturation.WithLabelValues(ident).Set(sat)
+		}
+	}
 }
 
 func (em *EventManager) broadcastEvent(evt *XRPCStreamEvent) {
+	// timed from before taking the lock, since waiting on it also holds up the persister
+	start := time.Now()
 	em.subsLk.Lock()
 	defer em.subsLk.Unlock()
 
+	// updated under subsLk, so a subscriber added live knows exactly which events it will and won't see
+	em.advanceLastSeq(evt)
+
+	if evt.noBroadcast {
+		return
+	}
+
+	kind := eventKind(evt)
+	defer em.observeBroadcast(start, kind)
+	now := em.clock.Now()
+
 	// TODO: for a larger fanout we should probably have dedicated goroutines
 	// for subsets of the subscriber set, and tiered channels to distribute
 	// events out to them, or some similar architecture
 	// Alternatively, we might just want to not allow too many subscribers
 	// directly to the bgs, and have rebroadcasting proxies instead
 	for _, s := range em.subs {
-		if s.filter(evt) {
+		if s.evicting.Load() {
+			continue
+		}
+		if (*s.filter.Load())(evt) {
+			if s.limiter != nil && !s.limiter.AllowN(now, 1) {
+				// intentional sampling, not backpressure: the consumer is not penalized
+				s.dropped.Add(1)
+				s.droppedCounter.Inc()
+				continue
+			}
 			s.enqueuedCounter.Inc()
+			eventsEnqueuedByKind.WithLabelValues(s.ident, kind).Inc()
+			if s.highWater > 0 && len(s.outgoing) >= s.highWater {
+				// start shedding the consumer while there is still room in the buffer for the error frame
+				em.logWarn("dropping slow consumer due to buffer high-water mark", "bufferSize", len(s.outgoing), "highWater", s.highWater, "ident", s.ident)
+				em.evictSlowConsumer(s)
+				continue
+			}
+			if em.stallTimeout > 0 {
+				if stalled := em.stalledFor(s, now); stalled > em.stallTimeout {
+					em.logWarn("dropping stalled consumer", "bufferSize", len(s.outgoing), "stalledFor", stalled, "ident", s.ident)
+					em.evictSlowConsumer(s)
+					continue
+				}
+			}
+			caughtUp := len(s.outgoing) == 0
 			select {
 			case s.outgoing <- evt:
+				if caughtUp {
+					// the consumer had nothing left to take, so it is not stalled as of this send
+					s.lastProgress = now
+				}
+				s.sendDepth = len(s.outgoing)
+				if !evt.receivedAt.IsZero() {
+					eventEnqueueLatency.WithLabelValues(s.ident).Observe(time.Since(evt.receivedAt).Seconds())
+				}
 			case <-s.done:
 			default:
-				log.Warnw("dropping slow consumer due to event overflow", "bufferSize", len(s.outgoing), "ident", s.ident)
-				go func(torem *Subscriber) {
-					torem.lk.Lock()
-					if !torem.cleanedUp {
-						select {
-						case torem.outgoing <- &XRPCStreamEvent{
-							Error: &ErrorFrame{
-								Error: "ConsumerTooSlow",
-							},
-						}:
-						case <-time.After(time.Second * 5):
-							log.Warnw("failed to send error frame to backed up consumer", "ident", torem.ident)
-						}
-					}
-					torem.lk.Unlock()
-					torem.cleanup()
-				}(s)
+				em.logWarn("dropping slow consumer due to event overflow", "bufferSize", len(s.outgoing), "ident", s.ident)
+				em.evictSlowConsumer(s)
 			}
 			s.broadcastCounter.Inc()
 		}
 	}
 }
 
+// How long the subscriber has had events buffered without taking any of them (zero if its buffer is empty). This is time without progress, independent of queue depth: a slow consumer which keeps taking events is never considered stalled, however deep its queue, while one which stops is, however few events it has left buffered. The consumer is seen to make progress when its buffer is shorter than it was just after the last successful send; progress is timed from when it is seen (so it errs on the side of a later eviction). Must be called with subsLk held.
+func (em *EventManager) stalledFor(s *Subscriber, now time.Time) time.Duration {
+	depth := len(s.outgoing)
+	if depth == 0 {
+		return 0
+	}
+	if depth < s.sendDepth || s.lastProgress.IsZero() {
+		s.lastProgress = now
+		s.sendDepth = depth
+		return 0
+	}
+	return now.Sub(s.lastProgress)
+}
+
+// evictSlowConsumer sends a ConsumerTooSlow error frame (best effort) and then cleans up the subscriber. Only the first call for a given subscriber has any effect.
+func (em *EventManager) evictSlowConsumer(s *Subscriber) {
+	em.evict(s, &XRPCStreamEvent{
+		Error: &ErrorFrame{
+			Error: ErrorFrameConsumerTooSlow,
+		},
+	}, CloseReasonConsumerTooSlow)
+}
+
+// evict sends a final frame to the subscriber (best effort, in the background) and then cleans it up. Returns false if the subscriber was already being evicted.
+func (em *EventManager) evict(s *Subscriber, frame *XRPCStreamEvent, reason CloseReason) bool {
+	if !s.evicting.CompareAndSwap(false, true) {
+		return false
+	}
+	go func(torem *Subscriber) {
+		torem.lk.Lock()
+		if !torem.cleanedUp {
+			select {
+			case torem.outgoing <- frame:
+			case <-em.clock.After(time.Second * 5):
+				em.logWarn("failed to send final frame to backed up consumer", "ident", torem.ident, "reason", reason)
+			case <-torem.done:
+			}
+		}
+		torem.lk.Unlock()
+		torem.close(em, reason)
+	}(s)
+	return true
+}
+
+var disconnectedMessage = "Disconnected by server operator"
+
+// Disconnect forcibly closes all live subscribers with the given ident, after sending each a final Disconnected info frame. Returns the number of subscribers disconnected. Teardown happens in the background, so subscribers may still be closing when this returns.
+//
+// Subscribers which are still replaying from the persister are not yet attached to the live stream, and are not affected.
+func (em *EventManager) Disconnect(ident string) int {
+	em.subsLk.Lock()
+	var matched []*Subscriber
+	for _, s := range em.subs {
+		if s.ident == ident {
+			matched = append(matched, s)
+		}
+	}
+	em.subsLk.Unlock()
+
+	n := 0
+	for _, s := range matched {
+		if em.evict(s, &XRPCStreamEvent{
+			RepoInfo: &comatproto.SyncSubscribeRepos_Info{
+				Name:    "Disconnected",
+				Message: &disconnectedMessage,
+			},
+		}, CloseReasonDisconnected) {
+			n++
+		}
+	}
+	return n
+}
+
+type SubscriberInfo struct {
+	Ident string
+	State SubscriberState
+	// Whether the subscriber is attached to the live stream. A subscriber catching up attaches once its first pass over the persister is done, and buffers live events while the remainder is played back
+	Attached bool
+	// Number of events waiting in the subscriber's outgoing buffer, and the buffer's capacity
+	Buffered   int
+	BufferSize int
+	// Number of live events dropped by the subscriber's MaxEventRate cap
+	Dropped int64
+}
+
+// Subscribers lists the active subscribers (not including any being evicted), both those attached to the live stream and those still replaying from the persister. State distinguishes consumers catching up from those tailing the live stream. Buffered counts only live events, so it is zero for subscribers which have not yet attached.
+func (em *EventManager) Subscribers() []SubscriberInfo {
+	em.subsLk.Lock()
+	defer em.subsLk.Unlock()
+
+	out := make([]SubscriberInfo, 0, len(em.subs)+len(em.attaching))
+	add := func(s *Subscriber, attached bool) {
+		if s.evicting.Load() {
+			return
+		}
+		out = append(out, SubscriberInfo{
+			Ident:      s.ident,
+			State:      s.State(),
+			Attached:   attached,
+			Buffered:   len(s.outgoing),
+			BufferSize: cap(s.outgoing),
+			Dropped:    s.dropped.Load(),
+		})
+	}
+	for s := range em.attaching {
+		add(s, false)
+	}
+	for _, s := range em.subs {
+		add(s, true)
+	}
+	return out
+}
+
+// persistFlushAndSendEvent is the PersistBeforeBroadcast variant of persistAndSendEvent
+func (em *EventManager) persistFlushAndSendEvent(ctx context.Context, evt *XRPCStreamEvent) error {
+	em.persistLk.Lock()
+	defer em.persistLk.Unlock()
+
+	if err := em.persister.Persist(ctx, evt); err != nil {
+		em.logError("failed to persist outbound event", "err", err)
+		return fmt.Errorf("failed to persist event: %w", err)
+	}
+	if err := em.persister.Flush(ctx); err != nil {
+		em.logError("failed to flush outbound event", "err", err)
+		return fmt.Errorf("failed to flush event: %w", err)
+	}
+
+	em.broadcastEvent(evt)
+	return nil
+}
+
 func (em *EventManager) persistAndSendEvent(ctx context.Context, evt *XRPCStreamEvent) {
 	// TODO: can cut 5-10% off of disk persister benchmarks by making this function
 	// accept a uid. The lookup inside the persister is notably expensive (despite
 	// being an lru cache?)
 	if err := em.persister.Persist(ctx, evt); err != nil {
-		log.Errorf("failed to persist outbound event: %s", err)
+		em.logError("failed to persist outbound event", "err", err)
 	}
 }
 
 type Subscriber struct {
 	outgoing chan *XRPCStreamEvent
 
-	filter func(*XRPCStreamEvent) bool
+	// swapped atomically so the filter can be updated while broadcasting
+	filter atomic.Pointer[func(*XRPCStreamEvent) bool]
 
 	done chan struct{}
 
 	cleanup func()
 
-	lk        sync.Mutex
-	cleanedUp bool
+	lk          sync.Mutex
+	cleanedUp   bool
+	closeOnce   sync.Once
+	closeReason CloseReason
+	onClose     func(CloseReason)
+
+	// if non-zero, the consumer is evicted once this many events are buffered, before the buffer is completely full
+	highWater int
+	evicting  atomic.Bool
+
+	// latest sequence number seen by the manager when the subscriber was attached to the live stream
+	startSeq int64
+
+	// a SubscriberState; written under lk, so transitions never race with close
+	state atomic.Value
+
+	// caps the rate of live events delivered (SubscribeOptions.MaxEventRate); nil if unlimited. Only used by broadcastEvent, under subsLk
+	limiter        *rate.Limiter
+	dropped        atomic.Int64
+	droppedCounter prometheus.Counter
+
+	// for stall detection (see stalledFor): the buffer depth just after the last successful send, and when the consumer was last seen taking events. Only accessed by broadcastEvent, under subsLk
+	sendDepth    int
+	lastProgress time.Time
 
 	ident            string
 	enqueuedCounter  prometheus.Counter
@@ -143,10 +589,29 @@ type XRPCStreamEvent struct {
 	LabelLabels   *comatproto.LabelSubscribeLabels_Labels
 	LabelInfo     *comatproto.LabelSubscribeLabels_Info
 
+	// Message types this package does not model natively, keyed by message type (eg, "#experiment"), with the raw DAG-CBOR body as the value. Frame decoding routes unrecognized types here instead of dropping them, and Serialize writes them back out as-is, so they can be passed through; an event framed this way should carry exactly one entry. See RegisterExtensionType for decoding. The persisters in this package do not store extension messages
+	Extra map[string][]byte `json:",omitempty" cborgen:"-"`
+
 	// some private fields for internal routing perf
 	PrivUid         models.Uid `json:"-" cborgen:"-"`
 	PrivPdsId       uint       `json:"-" cborgen:"-"`
 	PrivRelevantPds []uint     `json:"-" cborgen:"-"`
+
+	// set for imported events which should be persisted but not sent to live subscribers
+	noBroadcast bool
+
+	// when the event was handed to AddEvent, for measuring fanout latency. Not serialized
+	receivedAt time.Time
+
+	// commit ops parsed once by AddEvent (see EventManagerOptions.PreparseCommitOps), shared by every subscriber's CommitOps call
+	parsedOps *parsedCommitOps
+}
+
+// stampReceived returns a shallow copy of the event with receivedAt set, leaving the caller's event untouched. The nested message structs are shared, so sequence numbers assigned by the persister are still visible to the caller
+func (evt *XRPCStreamEvent) stampReceived() *XRPCStreamEvent {
+	out := *evt
+	out.receivedAt = time.Now()
+	return &out
 }
 
 type ErrorFrame struct {
@@ -154,87 +619,330 @@ type ErrorFrame struct {
 	Message string `cborgen:"message"`
 }
 
+// Names of error frames (the ErrorFrame.Error field), for consumers to branch on. The subscription ends after any of these
+const (
+	// the consumer fell too far behind and was evicted
+	ErrorFrameConsumerTooSlow = "ConsumerTooSlow"
+	// persisted events could not be played back from the requested cursor
+	ErrorFramePlaybackFailed = "PlaybackFailed"
+	// the server is shutting down
+	ErrorFrameShutdown = "Shutdown"
+	// the requested cursor is ahead of the server's latest sequence number. Not sent by this package, but by upstream relays and PDSs
+	ErrorFrameFutureCursor = "FutureCursor"
+)
+
+// Serialize writes the event as a single firehose frame: a CBOR EventHeader followed by the CBOR message body
+func (evt *XRPCStreamEvent) Serialize(w io.Writer) error {
+	header := EventHeader{Op: EvtKindMessage}
+	var obj lexutil.CBOR
+	var raw []byte
+
+	switch {
+	case evt.Error != nil:
+		header.Op = EvtKindErrorFrame
+		obj = evt.Error
+	case evt.RepoCommit != nil:
+		header.MsgType = "#commit"
+		obj = evt.RepoCommit
+	case evt.RepoHandle != nil:
+		header.MsgType = "#handle"
+		obj = evt.RepoHandle
+	case evt.RepoInfo != nil:
+		header.MsgType = "#info"
+		obj = evt.RepoInfo
+	case evt.RepoMigrate != nil:
+		header.MsgType = "#migrate"
+		obj = evt.RepoMigrate
+	case evt.RepoTombstone != nil:
+		header.MsgType = "#tombstone"
+		obj = evt.RepoTombstone
+	case evt.LabelLabels != nil:
+		header.MsgType = "#labels"
+		obj = evt.LabelLabels
+	case evt.LabelInfo != nil:
+		header.MsgType = "#info"
+		obj = evt.LabelInfo
+	case len(evt.Extra) > 0:
+		t, body, err := evt.extraFrame()
+		if err != nil {
+			return err
+		}
+		header.MsgType = t
+		raw = body
+	default:
+		return fmt.Errorf("unrecognized event kind")
+	}
+
+	cborWriter := cbg.NewCborWriter(w)
+	if err := header.MarshalCBOR(cborWriter); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	if raw != nil {
+		_, err := cborWriter.Write(raw)
+		return err
+	}
+	return obj.MarshalCBOR(cborWriter)
+}
+
 func (em *EventManager) AddEvent(ctx context.Context, ev *XRPCStreamEvent) error {
 	ctx, span := otel.Tracer("events").Start(ctx, "AddEvent")
 	defer span.End()
 
-	em.persistAndSendEvent(ctx, ev)
+	return em.addEvent(ctx, ev, false)
+}
+
+// AddEventBlocking is like AddEvent, but returns any persistence error to the caller instead of logging it, so producers can detect failures (and are slowed down by a slow persister). Batching persisters may still have the event buffered when this returns; use the PersistBeforeBroadcast option to also wait for a flush.
+func (em *EventManager) AddEventBlocking(ctx context.Context, ev *XRPCStreamEvent) error {
+	ctx, span := otel.Tracer("events").Start(ctx, "AddEventBlocking")
+	defer span.End()
+
+	return em.addEvent(ctx, ev, true)
+}
+
+// Shared by AddEvent and AddEventBlocking, which differ only in whether a persistence error is returned (blocking) or just logged. With PersistBeforeBroadcast, errors are always returned
+func (em *EventManager) addEvent(ctx context.Context, ev *XRPCStreamEvent, blocking bool) error {
+	if err := em.validateEvent(ev); err != nil {
+		return err
+	}
+	if !em.kindAllowed(ev) {
+		return nil
+	}
+	ev = ev.stampReceived()
+	if em.preparseCommitOps {
+		ev.preparseCommitOps()
+	}
+
+	switch {
+	case em.persistBeforeBroadcast:
+		if err := em.persistFlushAndSendEvent(ctx, ev); err != nil {
+			return err
+		}
+	case blocking:
+		if err := em.persister.Persist(ctx, ev); err != nil {
+			return fmt.Errorf("failed to persist event: %w", err)
+		}
+	default:
+		em.persistAndSendEvent(ctx, ev)
+	}
+
+	em.maybeSample(ev)
 	return nil
 }
 
 var (
 	ErrPlaybackShutdown = fmt.Errorf("playback shutting down")
 	ErrCaughtUp         = fmt.Errorf("caught up")
+
+	// Returned by Subscribe when an ident is opening new subscriptions faster than the configured rate limit
+	ErrTooManySubscriptions = errors.New("too many subscriptions for ident")
+
+	// Returned by Subscribe when the manager already has EventManagerOptions.MaxSubscribers subscribers
+	ErrTooManySubscribers = errors.New("too many subscribers")
+
+	// Returned by AddEvent for events with no recognized payload set (unless EventManagerOptions.AllowEmptyEvents)
+	ErrEmptyEvent = errors.New("event has no payload")
 )
 
+var playbackFailedMessage = "Failed to replay events from the requested cursor"
+
+var outdatedCursorMessage = "Requested cursor exceeded limit. Possibly missing events"
+
 func (em *EventManager) Subscribe(ctx context.Context, ident string, filter func(*XRPCStreamEvent) bool, since *int64) (<-chan *XRPCStreamEvent, func(), error) {
+	s, err := em.SubscribeWithOptions(ctx, ident, &SubscribeOptions{
+		Filter: filter,
+		Since:  since,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.Events(), s.Close, nil
+}
+
+// SubscribeWithOptions is like Subscribe, but returns a handle which can be used to inspect the subscriber, including why it was torn down.
+func (em *EventManager) SubscribeWithOptions(ctx context.Context, ident string, opts *SubscribeOptions) (*Subscription, error) {
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+
+	if !em.allowSubscribe(ident) {
+		subscriptionsRateLimited.Inc()
+		return nil, ErrTooManySubscriptions
+	}
+
+	filter := opts.Filter
 	if filter == nil {
 		filter = func(*XRPCStreamEvent) bool { return true }
 	}
+	since, err := em.consumerSince(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	done := make(chan struct{})
 	sub := &Subscriber{
 		ident:            ident,
 		outgoing:         make(chan *XRPCStreamEvent, em.bufferSize),
-		filter:           filter,
 		done:             done,
+		highWater:        em.highWater,
+		onClose:          opts.OnClose,
 		enqueuedCounter:  eventsEnqueued.WithLabelValues(ident),
 		broadcastCounter: eventsBroadcast.WithLabelValues(ident),
 	}
+	if opts.MaxEventRate > 0 {
+		sub.limiter = rate.NewLimiter(opts.MaxEventRate, max(1, opts.MaxEventBurst))
+		sub.droppedCounter = eventsRateDropped.WithLabelValues(ident)
+	}
 
-	sub.cleanup = sync.OnceFunc(func() {
-		sub.lk.Lock()
-		defer sub.lk.Unlock()
-		close(done)
-		em.rmSubscriber(sub)
-		close(sub.outgoing)
-		sub.cleanedUp = true
-	})
+	sub.filter.Store(&filter)
+
+	sub.cleanup = func() {
+		sub.close(em, CloseReasonNormal)
+	}
+
+	if since != nil && *since == SinceTip {
+		em.seedLastSeq(ctx)
+		since = nil
+	}
+
+	if err := em.reserveSubscriber(sub); err != nil {
+		return nil, err
+	}
 
 	if since == nil {
+		sub.setState(SubscriberLive)
 		em.addSubscriber(sub)
-		return sub.outgoing, sub.cleanup, nil
+		return &Subscription{events: sub.outgoing, sub: sub, startSeq: sub.startSeq}, nil
+	}
+
+	playbackBuf := opts.PlaybackBufferSize
+	if playbackBuf <= 0 {
+		playbackBuf = em.bufferSize
+	}
+	// room for at least the info frames below, which are sent before the playback goroutine starts
+	out := make(chan *XRPCStreamEvent, max(playbackBuf, 2))
+
+	// if the requested cursor is older than anything we have retained, let the consumer know that events were missed, like the upstream firehose does
+	if fsp, ok := em.persister.(FloorSequencePersister); ok {
+		floor, err := fsp.FloorSequence(ctx)
+		if err != nil {
+			em.logWarn("failed to check persister floor sequence", "err", err, "ident", ident)
+		} else if *since+1 < floor {
+			out <- &XRPCStreamEvent{
+				RepoInfo: &comatproto.SyncSubscribeRepos_Info{
+					Name:    "OutdatedCursor",
+					Message: &outdatedCursorMessage,
+				},
+			}
+		}
+	}
+
+	// warn consumers about to replay a huge backlog, so they can choose to reset instead of adding to a replay storm
+	if em.backlogThreshold > 0 {
+		// the distance to the tip is free if any events have passed through since startup; otherwise ask the persister
+		var n int64
+		var err error
+		if last := em.LastSequence(); last > 0 {
+			n = last - *since
+		} else {
+			n, err = em.PlaybackBacklog(ctx, *since)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrCountUnsupported) {
+				em.logWarn("failed to count playback backlog", "err", err, "ident", ident)
+			}
+		} else if n > em.backlogThreshold {
+			msg := fmt.Sprintf("Requested cursor is %d events behind the current sequence. Consider reconnecting without a cursor if the backlog is not needed", n)
+			out <- &XRPCStreamEvent{
+				RepoInfo: &comatproto.SyncSubscribeRepos_Info{
+					Name:    "LargeBacklog",
+					Message: &msg,
+				},
+			}
+		}
 	}
 
-	out := make(chan *XRPCStreamEvent, em.bufferSize)
+	sub.setState(SubscriberCatchingUp)
 
 	go func() {
+		// every exit path from here ends the subscription, so the consumer always sees the channel close
+		defer close(out)
+
+		// tells the consumer why the stream is ending, best effort (with a full buffer, it just sees the channel close)
+		playbackFailed := func() {
+			select {
+			case out <- &XRPCStreamEvent{Error: &ErrorFrame{Error: ErrorFramePlaybackFailed, Message: playbackFailedMessage}}:
+			default:
+			}
+			sub.close(em, CloseReasonPlaybackFailed)
+		}
+
+		// wait for a playback slot; the subscriber is not yet receiving live events, so nothing backs up while queued
+		release, err := em.acquirePlayback(ctx, done)
+		if err != nil {
+			em.logWarn("events playback", "err", err, "ident", ident)
+			sub.close(em, CloseReasonPlaybackFailed)
+			return
+		}
+		defer release()
+
 		lastSeq := *since
 		// run playback to get through *most* of the events, getting our current cursor close to realtime
 		if err := em.persister.Playback(ctx, *since, func(e *XRPCStreamEvent) error {
+			// the cursor advances past filtered-out events too, so they are not replayed again below
+			if seq, ok := sequenceForEvent(e); ok && seq > 0 {
+				lastSeq = seq
+			}
+			// filter here, rather than making the consumer pay to receive (and discard) the whole backlog
+			if !(*sub.filter.Load())(e) {
+				return nil
+			}
 			select {
 			case <-done:
 				return ErrPlaybackShutdown
 			case out <- e:
-				seq := sequenceForEvent(e)
-				if seq > 0 {
-					lastSeq = seq
-				}
 				return nil
 			}
 		}); err != nil {
 			if errors.Is(err, ErrPlaybackShutdown) {
-				log.Warnf("events playback: %s", err)
+				// the consumer has gone away, so there is no one to tell
+				em.logWarn("events playback", "err", err, "ident", ident)
+				sub.close(em, CloseReasonPlaybackFailed)
 			} else {
-				log.Errorf("events playback: %s", err)
+				em.logError("events playback", "err", err, "ident", ident)
+				playbackFailed()
 			}
-
-			// TODO: send an error frame or something?
-			close(out)
 			return
 		}
 
 		// now, start buffering events from the live stream
-		em.addSubscriber(sub)
+		if !em.addSubscriber(sub) {
+			return
+		}
 
-		first := <-sub.outgoing
+		// wait for the first *sequenced* live event. unsequenced events (eg, info frames) are not persisted, so they are held aside and delivered once we are caught up
+		var firstSeq int64
+		var pending []*XRPCStreamEvent
+		for {
+			first, ok := <-sub.outgoing
+			if !ok {
+				// subscriber was torn down
+				return
+			}
+			if seq, ok := sequenceForEvent(first); ok {
+				firstSeq = seq
+				break
+			}
+			pending = append(pending, first)
+		}
 
 		// run playback again to get us to the events that have started buffering
 		if err := em.persister.Playback(ctx, lastSeq, func(e *XRPCStreamEvent) error {
-			seq := sequenceForEvent(e)
-			if seq > sequenceForEvent(first) {
+			if seq, ok := sequenceForEvent(e); ok && seq > firstSeq {
 				return ErrCaughtUp
 			}
+			if !(*sub.filter.Load())(e) {
+				return nil
+			}
 
 			select {
 			case <-done:
@@ -243,12 +951,24 @@ func (em *EventManager) Subscribe(ctx context.Context, ident string, filter func
 				return nil
 			}
 		}); err != nil {
+			if errors.Is(err, ErrPlaybackShutdown) {
+				em.logWarn("events playback", "err", err, "ident", ident)
+				sub.close(em, CloseReasonPlaybackFailed)
+				return
+			}
 			if !errors.Is(err, ErrCaughtUp) {
-				log.Errorf("events playback: %s", err)
+				em.logError("events playback", "err", err, "ident", ident)
+				playbackFailed()
+				return
+			}
+		}
+		sub.setState(SubscriberLive)
+		release()
 
-				// TODO: send an error frame or something?
-				close(out)
-				em.rmSubscriber(sub)
+		for _, evt := range pending {
+			select {
+			case out <- evt:
+			case <-done:
 				return
 			}
 		}
@@ -258,40 +978,212 @@ func (em *EventManager) Subscribe(ctx context.Context, ident string, filter func
 			select {
 			case out <- evt:
 			case <-done:
-				em.rmSubscriber(sub)
 				return
 			}
 		}
 	}()
 
-	return out, sub.cleanup, nil
+	return &Subscription{events: out, sub: sub, startSeq: *since}, nil
+}
+
+// Waits for a free playback slot, if concurrency is bounded. The returned release func is idempotent.
+func (em *EventManager) acquirePlayback(ctx context.Context, done <-chan struct{}) (func(), error) {
+	if em.playbackSem == nil {
+		return func() {}, nil
+	}
+
+	playbacksQueued.Inc()
+	select {
+	case em.playbackSem <- struct{}{}:
+		playbacksQueued.Dec()
+	case <-ctx.Done():
+		playbacksQueued.Dec()
+		return nil, ctx.Err()
+	case <-done:
+		playbacksQueued.Dec()
+		return nil, ErrPlaybackShutdown
+	}
+
+	playbacksInFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-em.playbackSem
+			playbacksInFlight.Dec()
+		})
+	}, nil
+}
+
+func (em *EventManager) allowSubscribe(ident string) bool {
+	if em.subLimiters == nil {
+		return true
+	}
+
+	em.subLimitersLk.Lock()
+	defer em.subLimitersLk.Unlock()
+
+	lim, ok := em.subLimiters.Get(ident)
+	if !ok {
+		lim = rate.NewLimiter(em.subRate, em.subBurst)
+		em.subLimiters.Add(ident, lim)
+	}
+	return lim.AllowN(em.clock.Now(), 1)
 }
 
-func sequenceForEvent(evt *XRPCStreamEvent) int64 {
+// sequenceForEvent returns the sequence number of the event, and whether the event carries one at all. Info and error frames are never sequenced, and neither are unrecognized or empty events; these return (-1, false) and must not be used for cursor comparisons.
+func sequenceForEvent(evt *XRPCStreamEvent) (int64, bool) {
 	switch {
 	case evt == nil:
-		return -1
+		return -1, false
 	case evt.RepoCommit != nil:
-		return evt.RepoCommit.Seq
+		return evt.RepoCommit.Seq, true
 	case evt.RepoHandle != nil:
-		return evt.RepoHandle.Seq
+		return evt.RepoHandle.Seq, true
 	case evt.RepoMigrate != nil:
-		return evt.RepoMigrate.Seq
+		return evt.RepoMigrate.Seq, true
 	case evt.RepoTombstone != nil:
-		return evt.RepoTombstone.Seq
-	case evt.RepoInfo != nil:
-		return -1
+		return evt.RepoTombstone.Seq, true
+	case evt.LabelLabels != nil:
+		return evt.LabelLabels.Seq, true
+	case evt.RepoInfo != nil, evt.LabelInfo != nil, evt.Error != nil:
+		return -1, false
+	default:
+		return -1, false
+	}
+}
+
+func (em *EventManager) advanceLastSeq(evt *XRPCStreamEvent) {
+	seq, ok := sequenceForEvent(evt)
+	if !ok {
+		return
+	}
+	for {
+		last := em.lastSeq.Load()
+		if seq <= last || em.lastSeq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// LastSequence returns the highest sequence number of any event which has passed through the manager (whether or not it was broadcast), without touching the persister. This is the current tip of the stream, cheap enough to poll from health checks. It is zero if no event has been seen since startup, unless a SinceTip subscriber has since initialized it from the persister.
+func (em *EventManager) LastSequence() int64 {
+	return em.lastSeq.Load()
+}
+
+// PlaybackBacklog returns the number of persisted events a subscription with the given cursor would replay before switching to the live stream, without reading them. Events which arrive while the playback is running are not included. Returns ErrCountUnsupported if the persister does not implement CountSincePersister.
+func (em *EventManager) PlaybackBacklog(ctx context.Context, since int64) (int64, error) {
+	if since == SinceTip {
+		return 0, nil
+	}
+	csp, ok := em.persister.(CountSincePersister)
+	if !ok {
+		return 0, ErrCountUnsupported
+	}
+	return csp.CountSince(ctx, since)
+}
+
+// If no event has passed through since startup, initializes lastSeq from the persister (if it supports that), so SinceTip subscribers get a meaningful starting point
+func (em *EventManager) seedLastSeq(ctx context.Context) {
+	if em.lastSeq.Load() > 0 {
+		return
+	}
+	lsp, ok := em.persister.(LastSequencePersister)
+	if !ok {
+		return
+	}
+	seq, err := lsp.LastSequence(ctx)
+	if err != nil {
+		em.logWarn("failed to check persister last sequence", "err", err)
+		return
+	}
+	em.lastSeq.CompareAndSwap(0, seq)
+}
+
+// SetAllowedKinds restricts the kinds of event AddEvent (and AddEventBlocking) accept, as a global policy independent of subscriber filters, eg to stop forwarding a kind of event which is causing problems downstream during an incident. Events of other kinds are dropped before they are persisted or broadcast, without an error, and counted in indigo_events_dropped_by_policy_total. Kinds are named as in the indigo_events_enqueued_by_kind_total metric: "commit", "handle", "info", "migrate", "tombstone", "labels", "label_info", "error", and "extra" (for extension message types). An empty set allows all kinds. Safe to call while events are being added.
+func (em *EventManager) SetAllowedKinds(kinds []string) {
+	if len(kinds) == 0 {
+		em.allowedKinds.Store(nil)
+		return
+	}
+	set := make(map[string]bool, len(kinds))
+	for _, k := range kinds {
+		set[k] = true
+	}
+	em.allowedKinds.Store(&set)
+}
+
+// Whether an event's kind is allowed by SetAllowedKinds, counting it if not
+func (em *EventManager) kindAllowed(evt *XRPCStreamEvent) bool {
+	allowed := em.allowedKinds.Load()
+	if allowed == nil {
+		return true
+	}
+	kind := eventKind(evt)
+	if (*allowed)[kind] {
+		return true
+	}
+	eventsDroppedByPolicy.WithLabelValues(kind).Inc()
+	return false
+}
+
+// validateEvent catches malformed events from producers before they reach the persister or any subscriber
+func (em *EventManager) validateEvent(evt *XRPCStreamEvent) error {
+	if em.allowEmptyEvents {
+		return nil
+	}
+	if evt == nil || eventKind(evt) == "unknown" {
+		return ErrEmptyEvent
+	}
+	return nil
+}
+
+// eventKind returns a short name for the type of event, for use in metrics
+func eventKind(evt *XRPCStreamEvent) string {
+	switch {
 	case evt.Error != nil:
-		return -1
+		return "error"
+	case evt.RepoCommit != nil:
+		return "commit"
+	case evt.RepoHandle != nil:
+		return "handle"
+	case evt.RepoInfo != nil:
+		return "info"
+	case evt.RepoMigrate != nil:
+		return "migrate"
+	case evt.RepoTombstone != nil:
+		return "tombstone"
+	case evt.LabelLabels != nil:
+		return "labels"
+	case evt.LabelInfo != nil:
+		return "label_info"
+	case len(evt.Extra) > 0:
+		return "extra"
 	default:
-		return -1
+		return "unknown"
+	}
+}
+
+// reserveSubscriber registers a new subscriber as attaching, counting it against MaxSubscribers from then until it is closed. Returns ErrTooManySubscribers, without registering, if the limit has been reached.
+func (em *EventManager) reserveSubscriber(sub *Subscriber) error {
+	em.subsLk.Lock()
+	defer em.subsLk.Unlock()
+
+	if em.maxSubscribers > 0 && len(em.subs)+len(em.attaching) >= em.maxSubscribers {
+		subscriptionsRejected.Inc()
+		return ErrTooManySubscribers
 	}
+	if em.attaching == nil {
+		em.attaching = make(map[*Subscriber]struct{})
+	}
+	em.attaching[sub] = struct{}{}
+	return nil
 }
 
 func (em *EventManager) rmSubscriber(sub *Subscriber) {
 	em.subsLk.Lock()
 	defer em.subsLk.Unlock()
 
+	delete(em.attaching, sub)
 	for i, s := range em.subs {
 		if s == sub {
 			em.subs[i] = em.subs[len(em.subs)-1]
@@ -301,13 +1193,71 @@ func (em *EventManager) rmSubscriber(sub *Subscriber) {
 	}
 }
 
-func (em *EventManager) addSubscriber(sub *Subscriber) {
+// addSubscriber registers the subscriber for live events. Returns false, without registering, if the subscriber has already been closed, or if the manager is shutting down (in which case the subscriber is closed).
+//
+// Lock order is sub.lk then em.subsLk, same as in close. Holding sub.lk here ensures a subscriber can never be added (and broadcast to) after its outgoing channel is closed.
+func (em *EventManager) addSubscriber(sub *Subscriber) bool {
+	sub.lk.Lock()
+	if sub.cleanedUp {
+		sub.lk.Unlock()
+		return false
+	}
 	em.subsLk.Lock()
-	defer em.subsLk.Unlock()
+	shutdown := em.shutdown
+	if !shutdown {
+		delete(em.attaching, sub)
+		em.subs = append(em.subs, sub)
+		sub.startSeq = em.lastSeq.Load()
+	}
+	em.subsLk.Unlock()
+	sub.lk.Unlock()
 
-	em.subs = append(em.subs, sub)
+	if shutdown {
+		sub.close(em, CloseReasonShutdown)
+		return false
+	}
+	return true
 }
 
 func (em *EventManager) TakeDownRepo(ctx context.Context, user models.Uid) error {
 	return em.persister.TakeDownRepo(ctx, user)
 }
+
+// Number of repos TakeDownRepos processes at once
+const takedownConcurrency = 8
+
+// TakeDownRepos takes down the events of many repos, for bulk moderation actions. The persister is flushed first, so events still buffered in a batching persister are written out and scrubbed along with everything else. Repos are then processed concurrently (bounded), and a failure for one does not stop the others.
+//
+// Returns the error for each UID which failed; UIDs which succeeded are not in the map. If the initial flush fails, the takedowns are still attempted, and the flush error is included for each UID which otherwise succeeded (its buffered events may not have been scrubbed).
+func (em *EventManager) TakeDownRepos(ctx context.Context, uids []models.Uid) map[models.Uid]error {
+	flushErr := em.persister.Flush(ctx)
+	if flushErr != nil {
+		em.logError("failed to flush persister before takedowns", "err", flushErr)
+		flushErr = fmt.Errorf("failed to flush buffered events: %w", flushErr)
+	}
+
+	errs := make(map[models.Uid]error)
+	var errsLk sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, takedownConcurrency)
+	for _, uid := range uids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(uid models.Uid) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := em.persister.TakeDownRepo(ctx, uid)
+			if err == nil {
+				err = flushErr
+			}
+			if err != nil {
+				errsLk.Lock()
+				errs[uid] = err
+				errsLk.Unlock()
+			}
+		}(uid)
+	}
+	wg.Wait()
+	return errs
+}
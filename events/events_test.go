@@ -0,0 +1,1212 @@
+package events_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/models"
+)
+
+func TestSubscribeRateLimit(t *testing.T) {
+	ctx := context.Background()
+
+	opts := events.DefaultEventManagerOptions()
+	opts.SubscribeRateLimit = 0.001
+	opts.SubscribeBurst = 2
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	for i := 0; i < 2; i++ {
+		_, cleanup, err := em.Subscribe(ctx, "client-a", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+	}
+
+	if _, _, err := em.Subscribe(ctx, "client-a", nil, nil); !errors.Is(err, events.ErrTooManySubscriptions) {
+		t.Fatalf("expected ErrTooManySubscriptions, got: %v", err)
+	}
+
+	// other idents are limited independently
+	_, cleanup, err := em.Subscribe(ctx, "client-b", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+}
+
+func TestPartialOptionsBufferSize(t *testing.T) {
+	ctx := context.Background()
+
+	// options built by hand, without DefaultEventManagerOptions, still get a buffer
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), &events.EventManagerOptions{
+		Logger:         slog.Default(),
+		HighWaterRatio: 0.5,
+	})
+
+	sub, err := em.SubscribeWithOptions(ctx, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos := em.Subscribers()
+	if len(infos) != 1 {
+		t.Fatalf("expected subscriber to survive broadcast, got %d subscribers", len(infos))
+	}
+	if infos[0].BufferSize != events.DefaultBufferSize || infos[0].Buffered != 3 {
+		t.Fatalf("expected 3 of %d events buffered, got %d of %d", events.DefaultBufferSize, infos[0].Buffered, infos[0].BufferSize)
+	}
+}
+
+func TestHighWaterEviction(t *testing.T) {
+	ctx := context.Background()
+
+	opts := events.DefaultEventManagerOptions()
+	opts.BufferSize = 10
+	opts.HighWaterRatio = 0.5
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	reasons := make(chan events.CloseReason, 1)
+	sub, err := em.SubscribeWithOptions(ctx, "slow", &events.SubscribeOptions{
+		OnClose: func(r events.CloseReason) { reasons <- r },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch := sub.Events()
+
+	for i := 0; i < 8; i++ {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []*events.XRPCStreamEvent
+	for evt := range ch {
+		got = append(got, evt)
+	}
+
+	if len(got) != 6 {
+		t.Fatalf("expected 5 events and an error frame, got %d events", len(got))
+	}
+	last := got[len(got)-1]
+	if last.Error == nil || last.Error.Error != "ConsumerTooSlow" {
+		t.Fatalf("expected ConsumerTooSlow error frame, got: %+v", last)
+	}
+
+	if r := <-reasons; r != events.CloseReasonConsumerTooSlow {
+		t.Fatalf("expected OnClose with ConsumerTooSlow, got: %s", r)
+	}
+	if sub.Reason() != events.CloseReasonConsumerTooSlow {
+		t.Fatalf("expected close reason ConsumerTooSlow, got: %s", sub.Reason())
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	sub, err := em.SubscribeWithOptions(ctx, "normal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Reason() != events.CloseReasonNone {
+		t.Fatalf("expected active subscription, got: %s", sub.Reason())
+	}
+	sub.Close()
+	sub.Close()
+	if sub.Reason() != events.CloseReasonNormal {
+		t.Fatalf("expected close reason Normal, got: %s", sub.Reason())
+	}
+
+	sub, err = em.SubscribeWithOptions(ctx, "shutdown", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := em.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if evt, ok := <-sub.Events(); !ok || evt.Error == nil || evt.Error.Error != events.ErrorFrameShutdown {
+		t.Fatalf("expected Shutdown error frame, got: %+v", evt)
+	}
+	if _, ok := <-sub.Events(); ok {
+		t.Fatal("expected events channel to be closed")
+	}
+	if sub.Reason() != events.CloseReasonShutdown {
+		t.Fatalf("expected close reason Shutdown, got: %s", sub.Reason())
+	}
+}
+
+func TestUpdateFilter(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	sub, err := em.SubscribeWithOptions(ctx, "watcher", &events.SubscribeOptions{
+		Filter: func(evt *events.XRPCStreamEvent) bool {
+			return evt.RepoCommit != nil && evt.RepoCommit.Repo == "did:plc:first"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for _, did := range []string{"did:plc:first", "did:plc:second"} {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: did}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub.UpdateFilter(func(evt *events.XRPCStreamEvent) bool {
+		return evt.RepoCommit != nil && evt.RepoCommit.Repo == "did:plc:second"
+	})
+
+	for _, did := range []string{"did:plc:first", "did:plc:second"} {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: did}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := <-sub.Events()
+	second := <-sub.Events()
+	if first.RepoCommit.Repo != "did:plc:first" || second.RepoCommit.Repo != "did:plc:second" {
+		t.Fatalf("unexpected events after filter update: %s, %s", first.RepoCommit.Repo, second.RepoCommit.Repo)
+	}
+	if len(sub.Events()) != 0 {
+		t.Fatalf("expected no more buffered events, got %d", len(sub.Events()))
+	}
+}
+
+// blocks every playback until gate is closed
+type gatedPersister struct {
+	*events.MemPersister
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (gp *gatedPersister) Playback(ctx context.Context, since int64, cb func(*events.XRPCStreamEvent) error) error {
+	gp.entered <- struct{}{}
+	<-gp.gate
+	return gp.MemPersister.Playback(ctx, since, cb)
+}
+
+func TestMaxConcurrentPlaybacks(t *testing.T) {
+	gp := &gatedPersister{
+		MemPersister: events.NewMemPersister(),
+		entered:      make(chan struct{}, 10),
+		gate:         make(chan struct{}),
+	}
+	opts := events.DefaultEventManagerOptions()
+	opts.MaxConcurrentPlaybacks = 1
+	em := events.NewEventManagerWithOptions(gp, opts)
+
+	since := int64(0)
+	first, err := em.SubscribeWithOptions(context.Background(), "first", &events.SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	<-gp.entered
+
+	// second subscriber queues behind the first, and gives up when its context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	second, err := em.SubscribeWithOptions(ctx, "second", &events.SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-gp.entered:
+		t.Fatal("second playback started while first was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	for range second.Events() {
+	}
+	if second.Reason() != events.CloseReasonPlaybackFailed {
+		t.Fatalf("expected PlaybackFailed, got %q", second.Reason())
+	}
+
+	close(gp.gate)
+}
+
+// Races subscriber churn, slow-consumer eviction, caller cleanup, and manager shutdown against each other. Mostly useful under -race; any double-close or send on a closed channel panics.
+func TestTeardownRace(t *testing.T) {
+	ctx := context.Background()
+
+	for round := 0; round < 20; round++ {
+		opts := events.DefaultEventManagerOptions()
+		opts.BufferSize = 4
+		em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+
+		// event producer, which regularly overflows the small buffers
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				em.AddEvent(ctx, &events.XRPCStreamEvent{
+					RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+				})
+			}
+		}()
+
+		var subs []*events.Subscription
+		var subsLk sync.Mutex
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				sopts := &events.SubscribeOptions{}
+				if i%2 == 0 {
+					since := int64(0)
+					sopts.Since = &since
+				}
+				sub, err := em.SubscribeWithOptions(ctx, "churn", sopts)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				subsLk.Lock()
+				subs = append(subs, sub)
+				subsLk.Unlock()
+
+				// some subscribers read a little, some never read (and get evicted)
+				if i%3 == 0 {
+					for j := 0; j < 3; j++ {
+						<-sub.Events()
+					}
+				}
+				if i%4 == 0 {
+					sub.Close()
+					sub.Close()
+				}
+			}(i)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(round%5))
+		if err := em.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		close(stop)
+		wg.Wait()
+
+		// every subscription channel must eventually be closed, whatever path tore it down
+		for _, sub := range subs {
+			sub.Close()
+			timeout := time.After(10 * time.Second)
+		drain:
+			for {
+				select {
+				case _, ok := <-sub.Events():
+					if !ok {
+						break drain
+					}
+				case <-timeout:
+					t.Fatalf("subscription channel never closed (reason=%q)", sub.Reason())
+				}
+			}
+		}
+	}
+}
+
+// persists immediately, but only considers events durable after a slow Flush
+type slowFlushPersister struct {
+	*events.MemPersister
+	flushed atomic.Int64
+	seq     atomic.Int64
+	failing atomic.Bool
+}
+
+func (sp *slowFlushPersister) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	if sp.failing.Load() {
+		return errors.New("disk full")
+	}
+	if err := sp.MemPersister.Persist(ctx, e); err != nil {
+		return err
+	}
+	sp.seq.Store(e.RepoCommit.Seq)
+	return nil
+}
+
+func (sp *slowFlushPersister) Flush(ctx context.Context) error {
+	time.Sleep(20 * time.Millisecond)
+	sp.flushed.Store(sp.seq.Load())
+	return nil
+}
+
+func TestPersistBeforeBroadcast(t *testing.T) {
+	ctx := context.Background()
+
+	sp := &slowFlushPersister{MemPersister: events.NewMemPersister()}
+	opts := events.DefaultEventManagerOptions()
+	opts.PersistBeforeBroadcast = true
+	em := events.NewEventManagerWithOptions(sp, opts)
+
+	evts, cleanup, err := em.Subscribe(ctx, "ordered", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			em.AddEvent(ctx, &events.XRPCStreamEvent{
+				RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+			})
+		}
+	}()
+
+	for i := 1; i <= 5; i++ {
+		evt := <-evts
+		if evt.RepoCommit.Seq != int64(i) {
+			t.Fatalf("expected seq %d, got %d", i, evt.RepoCommit.Seq)
+		}
+		if flushed := sp.flushed.Load(); flushed < evt.RepoCommit.Seq {
+			t.Fatalf("event %d broadcast before flush (flushed=%d)", evt.RepoCommit.Seq, flushed)
+		}
+	}
+
+	// failed persistence is surfaced, and the event is never broadcast
+	sp.failing.Store(true)
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+	}); err == nil {
+		t.Fatal("expected persistence error from AddEvent")
+	}
+	select {
+	case evt := <-evts:
+		t.Fatalf("unexpected broadcast of unpersisted event: %+v", evt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConsumerCursor(t *testing.T) {
+	ctx := context.Background()
+
+	opts := events.DefaultEventManagerOptions()
+	opts.CursorStore = events.NewMemCursorStore()
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	for i := 0; i < 3; i++ {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := em.AckSequence("indexer", 2); err != nil {
+		t.Fatal(err)
+	}
+	// stale acks don't move the cursor backwards
+	if err := em.AckSequence("indexer", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := em.SubscribeWithOptions(ctx, "127.0.0.1", &events.SubscribeOptions{ConsumerName: "indexer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	evt := <-sub.Events()
+	if evt.RepoCommit == nil || evt.RepoCommit.Seq != 3 {
+		t.Fatalf("expected to resume at seq 3, got: %+v", evt)
+	}
+
+	noStore := events.NewEventManager(events.NewMemPersister())
+	if err := noStore.AckSequence("indexer", 1); !errors.Is(err, events.ErrNoCursorStore) {
+		t.Fatalf("expected ErrNoCursorStore, got: %v", err)
+	}
+}
+
+func TestAddEventBlocking(t *testing.T) {
+	ctx := context.Background()
+
+	sp := &slowFlushPersister{MemPersister: events.NewMemPersister()}
+	em := events.NewEventManager(sp)
+
+	evt := &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+	}
+	if err := em.AddEventBlocking(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	if evt.RepoCommit.Seq != 1 {
+		t.Fatalf("expected event to be sequenced on return, got seq %d", evt.RepoCommit.Seq)
+	}
+
+	sp.failing.Store(true)
+	if err := em.AddEventBlocking(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+	}); err == nil {
+		t.Fatal("expected persistence error")
+	}
+	// fire-and-forget variant still swallows the error
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmptyEvent(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{}); !errors.Is(err, events.ErrEmptyEvent) {
+		t.Fatalf("expected ErrEmptyEvent, got: %v", err)
+	}
+	if err := em.AddEventBlocking(ctx, &events.XRPCStreamEvent{}); !errors.Is(err, events.ErrEmptyEvent) {
+		t.Fatalf("expected ErrEmptyEvent, got: %v", err)
+	}
+
+	// lenient mode passes the event through to the persister
+	opts := events.DefaultEventManagerOptions()
+	opts.AllowEmptyEvents = true
+	cp := &countingPersister{MemPersister: events.NewMemPersister()}
+	em = events.NewEventManagerWithOptions(cp, opts)
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if cp.count.Load() != 1 {
+		t.Fatalf("expected event to reach the persister, got %d persist calls", cp.count.Load())
+	}
+}
+
+type countingPersister struct {
+	*events.MemPersister
+	count atomic.Int64
+}
+
+func (cp *countingPersister) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	cp.count.Add(1)
+	return nil
+}
+
+func TestBacklogHint(t *testing.T) {
+	ctx := context.Background()
+
+	opts := events.DefaultEventManagerOptions()
+	opts.BacklogHintThreshold = 5
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	for i := 0; i < 10; i++ {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// far behind: hint first, then the full playback
+	since := int64(2)
+	out, cleanup, err := em.Subscribe(ctx, "behind", nil, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	first := <-out
+	if first.RepoInfo == nil || first.RepoInfo.Name != "LargeBacklog" {
+		t.Fatalf("expected LargeBacklog info frame, got: %+v", first)
+	}
+	next := <-out
+	if next.RepoCommit == nil || next.RepoCommit.Seq != 3 {
+		t.Fatalf("expected playback to continue from seq 3, got: %+v", next)
+	}
+
+	// within the threshold: no hint
+	since = 6
+	out2, cleanup2, err := em.Subscribe(ctx, "close", nil, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup2()
+	first = <-out2
+	if first.RepoCommit == nil || first.RepoCommit.Seq != 7 {
+		t.Fatalf("expected playback with no hint, got: %+v", first)
+	}
+
+	if n, err := em.PlaybackBacklog(ctx, 2); err != nil || n != 8 {
+		t.Fatalf("expected backlog of 8 events, got %d (err: %v)", n, err)
+	}
+}
+
+func TestOptionalPersisterInterfaces(t *testing.T) {
+	ctx := context.Background()
+
+	// YoloPersister implements neither FloorSequencePersister nor CountSincePersister
+	opts := events.DefaultEventManagerOptions()
+	opts.BacklogHintThreshold = 1
+	em := events.NewEventManagerWithOptions(events.NewYoloPersister(), opts)
+
+	if _, err := em.PlaybackBacklog(ctx, 0); !errors.Is(err, events.ErrCountUnsupported) {
+		t.Fatalf("expected ErrCountUnsupported, got: %v", err)
+	}
+
+	// subscribing with a cursor skips the OutdatedCursor and LargeBacklog checks, rather than failing
+	since := int64(0)
+	out, cleanup, err := em.Subscribe(ctx, "yolo", nil, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	first := <-out
+	if first.RepoInfo != nil {
+		t.Fatalf("expected no info frames, got: %+v", first.RepoInfo)
+	}
+}
+
+func TestBacklogHintAfterRestart(t *testing.T) {
+	ctx := context.Background()
+
+	mp := events.NewMemPersister()
+	em := events.NewEventManager(mp)
+	for i := 0; i < 10; i++ {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a fresh manager has not seen any events, but the backlog is counted by the persister
+	opts := events.DefaultEventManagerOptions()
+	opts.BacklogHintThreshold = 5
+	em = events.NewEventManagerWithOptions(mp, opts)
+	since := int64(2)
+	out, cleanup, err := em.Subscribe(ctx, "behind", nil, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if first := <-out; first.RepoInfo == nil || first.RepoInfo.Name != "LargeBacklog" {
+		t.Fatalf("expected LargeBacklog info frame, got: %+v", first)
+	}
+}
+
+func TestSubscribeSinceTip(t *testing.T) {
+	ctx := context.Background()
+
+	mp := events.NewMemPersister()
+	addCommit := func(em *events.EventManager) {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	em := events.NewEventManager(mp)
+	for i := 0; i < 3; i++ {
+		addCommit(em)
+	}
+
+	// a fresh manager over the same persister has not seen any events yet, so the tip comes from the persister
+	em = events.NewEventManager(mp)
+	since := events.SinceTip
+	sub, err := em.SubscribeWithOptions(ctx, "tip", &events.SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if sub.StartSeq() != 3 {
+		t.Fatalf("expected start seq 3, got %d", sub.StartSeq())
+	}
+
+	addCommit(em)
+	evt := <-sub.Events()
+	if evt.RepoCommit == nil || evt.RepoCommit.Seq != 4 {
+		t.Fatalf("expected first live event to be seq 4, got: %+v", evt)
+	}
+
+	since = 1
+	sub2, err := em.SubscribeWithOptions(ctx, "playback", &events.SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub2.Close()
+	if sub2.StartSeq() != 1 {
+		t.Fatalf("expected start seq 1 for playback, got %d", sub2.StartSeq())
+	}
+}
+
+type takedownPersister struct {
+	*events.MemPersister
+	flushed atomic.Bool
+	lk      sync.Mutex
+	done    []models.Uid
+}
+
+func (tp *takedownPersister) Flush(ctx context.Context) error {
+	tp.flushed.Store(true)
+	return nil
+}
+
+func (tp *takedownPersister) TakeDownRepo(ctx context.Context, uid models.Uid) error {
+	if !tp.flushed.Load() {
+		return errors.New("takedown before flush")
+	}
+	if uid == 3 {
+		return errors.New("takedown failed")
+	}
+	tp.lk.Lock()
+	defer tp.lk.Unlock()
+	tp.done = append(tp.done, uid)
+	return nil
+}
+
+func TestTakeDownRepos(t *testing.T) {
+	tp := &takedownPersister{MemPersister: events.NewMemPersister()}
+	em := events.NewEventManager(tp)
+
+	var uids []models.Uid
+	for i := 1; i <= 20; i++ {
+		uids = append(uids, models.Uid(i))
+	}
+	errs := em.TakeDownRepos(context.Background(), uids)
+	if len(errs) != 1 || errs[3] == nil {
+		t.Fatalf("expected a single error for uid 3, got: %v", errs)
+	}
+	if len(tp.done) != 19 {
+		t.Fatalf("expected 19 successful takedowns, got %d", len(tp.done))
+	}
+}
+
+func TestSampler(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+	defer em.Shutdown(ctx)
+
+	sampled := make(chan *events.XRPCStreamEvent, 100)
+	em.SetSampler(1, func(evt *events.XRPCStreamEvent) {
+		sampled <- evt
+	})
+	addHandleEvents(t, em, 5)
+	for i := 0; i < 5; i++ {
+		select {
+		case evt := <-sampled:
+			if evt.RepoHandle == nil || evt.RepoHandle.Seq != int64(i+1) {
+				t.Fatalf("unexpected sampled event: %+v", evt)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for sample %d", i)
+		}
+	}
+
+	// removing the sampler stops the samples
+	em.SetSampler(0, nil)
+	addHandleEvents(t, em, 5)
+	select {
+	case evt := <-sampled:
+		t.Fatalf("unexpected sample after removing sampler: %+v", evt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStallTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	opts := events.DefaultEventManagerOptions()
+	opts.BufferSize = 100
+	opts.StallTimeout = 50 * time.Millisecond
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	stuck, err := em.SubscribeWithOptions(ctx, "stuck", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	healthy, err := em.SubscribeWithOptions(ctx, "healthy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer healthy.Close()
+
+	for i := 0; i < 4; i++ {
+		addHandleEvents(t, em, 1)
+		<-healthy.Events()
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stuck.Reason() != events.CloseReasonConsumerTooSlow {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected stuck consumer to be evicted, reason: %q", stuck.Reason())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if healthy.Reason() != events.CloseReasonNone {
+		t.Fatalf("healthy consumer was closed: %q", healthy.Reason())
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	var subs []*events.Subscription
+	for _, ident := range []string{"abusive", "abusive", "fine"} {
+		sub, err := em.SubscribeWithOptions(ctx, ident, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		subs = append(subs, sub)
+	}
+	if n := len(em.Subscribers()); n != 3 {
+		t.Fatalf("expected 3 subscribers listed, got %d", n)
+	}
+
+	if n := em.Disconnect("abusive"); n != 2 {
+		t.Fatalf("expected 2 subscribers disconnected, got %d", n)
+	}
+	for _, sub := range subs[:2] {
+		evt, ok := <-sub.Events()
+		if !ok || evt.RepoInfo == nil || evt.RepoInfo.Name != "Disconnected" {
+			t.Fatalf("expected Disconnected info frame, got: %+v", evt)
+		}
+		if _, ok := <-sub.Events(); ok {
+			t.Fatal("expected channel to be closed after the info frame")
+		}
+		if sub.Reason() != events.CloseReasonDisconnected {
+			t.Fatalf("unexpected close reason: %q", sub.Reason())
+		}
+	}
+
+	infos := em.Subscribers()
+	if len(infos) != 1 || infos[0].Ident != "fine" {
+		t.Fatalf("unexpected remaining subscribers: %+v", infos)
+	}
+	if n := em.Disconnect("nobody"); n != 0 {
+		t.Fatalf("expected no subscribers disconnected, got %d", n)
+	}
+}
+
+func TestPlaybackBufferSize(t *testing.T) {
+	ctx := context.Background()
+	opts := events.DefaultEventManagerOptions()
+	opts.BufferSize = 16
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	since := int64(0)
+	sub, err := em.SubscribeWithOptions(ctx, "bulk", &events.SubscribeOptions{Since: &since, PlaybackBufferSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if n := cap(sub.Events()); n != 1000 {
+		t.Fatalf("expected playback buffer of 1000, got %d", n)
+	}
+
+	// once playback is done, the live buffer is attached at the manager's size
+	deadline := time.Now().Add(time.Second)
+	for infos := em.Subscribers(); len(infos) == 0 || !infos[0].Attached; infos = em.Subscribers() {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber never switched to live")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if infos := em.Subscribers(); infos[0].BufferSize != 16 {
+		t.Fatalf("expected live buffer of 16, got %d", infos[0].BufferSize)
+	}
+
+	// defaults to the live buffer size
+	sub2, err := em.SubscribeWithOptions(ctx, "default", &events.SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub2.Close()
+	if n := cap(sub2.Events()); n != 16 {
+		t.Fatalf("expected default playback buffer of 16, got %d", n)
+	}
+}
+
+func TestPlaybackFilter(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	for i := 0; i < 10; i++ {
+		repo := "did:plc:other"
+		if i%3 == 0 {
+			repo = "did:plc:wanted"
+		}
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: repo},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := int64(0)
+	sub, err := em.SubscribeWithOptions(ctx, "filtered", &events.SubscribeOptions{
+		Since: &since,
+		Filter: func(evt *events.XRPCStreamEvent) bool {
+			return evt.RepoCommit != nil && evt.RepoCommit.Repo == "did:plc:wanted"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	var seqs []int64
+	for len(seqs) < 4 {
+		select {
+		case evt := <-sub.Events():
+			if evt.RepoCommit.Repo != "did:plc:wanted" {
+				t.Fatalf("filtered-out event delivered during playback: %+v", evt.RepoCommit)
+			}
+			seqs = append(seqs, evt.RepoCommit.Seq)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for playback, got seqs %v", seqs)
+		}
+	}
+	if fmt.Sprint(seqs) != "[1 4 7 10]" {
+		t.Fatalf("unexpected playback seqs: %v", seqs)
+	}
+}
+
+func BenchmarkFanout(b *testing.B) {
+	for _, nsubs := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("subs=%d", nsubs), func(b *testing.B) {
+			ctx := context.Background()
+			em := events.NewEventManager(events.NewNullPersister())
+
+			var wg sync.WaitGroup
+			for i := 0; i < nsubs; i++ {
+				evts, cleanup, err := em.Subscribe(ctx, fmt.Sprintf("bench-%d", i), nil, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer cleanup()
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for n := 0; n < b.N; n++ {
+						<-evts
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+					RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestNullPersister(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewNullPersister())
+
+	since := int64(0)
+	sub, err := em.SubscribeWithOptions(ctx, "null", &events.SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// playback of nothing, then live; poll until the subscriber is attached
+	deadline := time.Now().Add(time.Second)
+	for infos := em.Subscribers(); len(infos) == 0 || !infos[0].Attached; infos = em.Subscribers() {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber never switched to live")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first live event hands the subscriber off from playback, and can't be replayed
+	for i := int64(2); i <= 3; i++ {
+		select {
+		case evt := <-sub.Events():
+			if evt.RepoCommit.Seq != i {
+				t.Fatalf("expected seq %d, got %d", i, evt.RepoCommit.Seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+}
+
+func TestLastSequence(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	if seq := em.LastSequence(); seq != 0 {
+		t.Fatalf("expected no sequence before any events, got %d", seq)
+	}
+	for i := 0; i < 3; i++ {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seq := em.LastSequence(); seq != 3 {
+		t.Fatalf("expected last sequence 3, got %d", seq)
+	}
+}
+
+func TestMaxSubscribers(t *testing.T) {
+	ctx := context.Background()
+	opts := events.DefaultEventManagerOptions()
+	opts.MaxSubscribers = 2
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	live, err := em.SubscribeWithOptions(ctx, "live", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+
+	// replaying subscribers count too
+	since := int64(0)
+	replay, err := em.SubscribeWithOptions(ctx, "replay", &events.SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+
+	if _, err := em.SubscribeWithOptions(ctx, "extra", nil); !errors.Is(err, events.ErrTooManySubscribers) {
+		t.Fatalf("expected ErrTooManySubscribers, got: %v", err)
+	}
+	if n := len(em.Subscribers()); n != 2 {
+		t.Fatalf("expected 2 subscribers, got %d", n)
+	}
+
+	// closing one frees a slot
+	replay.Close()
+	sub, err := em.SubscribeWithOptions(ctx, "extra", nil)
+	if err != nil {
+		t.Fatalf("expected subscribe to succeed after a close, got: %v", err)
+	}
+	sub.Close()
+}
+
+type failingPlaybackPersister struct {
+	*events.MemPersister
+}
+
+func (fp *failingPlaybackPersister) Playback(ctx context.Context, since int64, cb func(*events.XRPCStreamEvent) error) error {
+	return fmt.Errorf("storage unavailable")
+}
+
+func TestPlaybackFailedFrame(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(&failingPlaybackPersister{events.NewMemPersister()})
+
+	since := int64(0)
+	sub, err := em.SubscribeWithOptions(ctx, "replay", &events.SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evt, ok := <-sub.Events()
+	if !ok || evt.Error == nil || evt.Error.Error != events.ErrorFramePlaybackFailed {
+		t.Fatalf("expected PlaybackFailed error frame, got: %+v", evt)
+	}
+	if _, ok := <-sub.Events(); ok {
+		t.Fatal("expected events channel to be closed")
+	}
+	if sub.Reason() != events.CloseReasonPlaybackFailed {
+		t.Fatalf("expected close reason PlaybackFailed, got: %s", sub.Reason())
+	}
+}
+
+func TestMaxEventRate(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	sub, err := em.SubscribeWithOptions(ctx, "sampled", &events.SubscribeOptions{MaxEventRate: 0.001, MaxEventBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the burst is delivered, the rest are dropped rather than buffered
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sub.Events():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+	select {
+	case evt := <-sub.Events():
+		t.Fatalf("expected excess events to be dropped, got seq %d", evt.RepoCommit.Seq)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	infos := em.Subscribers()
+	if len(infos) != 1 || infos[0].Dropped != 3 {
+		t.Fatalf("expected 3 dropped events, got: %+v", infos)
+	}
+	if sub.Reason() != events.CloseReasonNone {
+		t.Fatalf("rate-limited subscriber should not be evicted, got: %s", sub.Reason())
+	}
+}
+
+// a manually advanced events.Clock
+type fakeClock struct {
+	lk      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.now = c.now.Add(d)
+	var waiting []fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+func TestStallTimeoutFakeClock(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+
+	opts := events.DefaultEventManagerOptions()
+	opts.StallTimeout = time.Minute
+	opts.Clock = clock
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	stuck, err := em.SubscribeWithOptions(ctx, "stuck", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+
+	addHandleEvents(t, em, 1)
+	clock.Advance(30 * time.Second)
+	addHandleEvents(t, em, 1)
+	if stuck.Reason() != events.CloseReasonNone {
+		t.Fatalf("consumer evicted before the stall timeout: %q", stuck.Reason())
+	}
+
+	// no real time needs to pass
+	clock.Advance(time.Minute)
+	addHandleEvents(t, em, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for stuck.Reason() != events.CloseReasonConsumerTooSlow {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected stuck consumer to be evicted, reason: %q", stuck.Reason())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStallTimeoutProgress(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+
+	opts := events.DefaultEventManagerOptions()
+	opts.StallTimeout = time.Minute
+	opts.Clock = clock
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	slow, err := em.SubscribeWithOptions(ctx, "slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	stopped, err := em.SubscribeWithOptions(ctx, "stopped", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopped.Close()
+
+	// a deep queue, which the slow consumer works through one event at a time, well past the stall timeout in total
+	addHandleEvents(t, em, 10)
+	for i := 0; i < 5; i++ {
+		clock.Advance(30 * time.Second)
+		<-slow.Events()
+		addHandleEvents(t, em, 1)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stopped.Reason() != events.CloseReasonConsumerTooSlow {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected stopped consumer to be evicted, reason: %q", stopped.Reason())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if slow.Reason() != events.CloseReasonNone {
+		t.Fatalf("slow but progressing consumer was evicted: %q", slow.Reason())
+	}
+}
@@ -0,0 +1,77 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Decodes the raw DAG-CBOR body of an extension message type (one this package does not model natively), eg into a caller-defined cbor-gen struct
+type ExtensionDecoder func(body []byte) (any, error)
+
+// Returned by XRPCStreamEvent.DecodeExtra when no decoder has been registered for the message type
+var ErrNoExtensionDecoder = errors.New("no decoder registered for extension message type")
+
+// message types decoded natively by this package, which can't be registered as extensions
+var builtinMsgTypes = map[string]bool{
+	"#commit":    true,
+	"#handle":    true,
+	"#info":      true,
+	"#migrate":   true,
+	"#tombstone": true,
+	"#labels":    true,
+}
+
+var (
+	extensionDecodersLk sync.RWMutex
+	extensionDecoders   = map[string]ExtensionDecoder{}
+)
+
+// RegisterExtensionType registers a decoder for a firehose message type (the "t" header field, eg "#experiment") which this package does not model natively. Frames of any unrecognized type are passed through in XRPCStreamEvent.Extra whether or not a decoder is registered; the registry only backs XRPCStreamEvent.DecodeExtra.
+//
+// Intended to be called from init functions. Panics if the type is handled natively or already registered.
+func RegisterExtensionType(msgType string, dec ExtensionDecoder) {
+	if builtinMsgTypes[msgType] {
+		panic(fmt.Sprintf("events: cannot register built-in message type %q as an extension", msgType))
+	}
+
+	extensionDecodersLk.Lock()
+	defer extensionDecodersLk.Unlock()
+	if _, ok := extensionDecoders[msgType]; ok {
+		panic(fmt.Sprintf("events: extension message type %q registered twice", msgType))
+	}
+	extensionDecoders[msgType] = dec
+}
+
+// DecodeExtra decodes the extension message of the given type carried by this event, using the decoder registered with RegisterExtensionType
+func (evt *XRPCStreamEvent) DecodeExtra(msgType string) (any, error) {
+	body, ok := evt.Extra[msgType]
+	if !ok {
+		return nil, fmt.Errorf("event has no %q extension message", msgType)
+	}
+
+	extensionDecodersLk.RLock()
+	dec, ok := extensionDecoders[msgType]
+	extensionDecodersLk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoExtensionDecoder, msgType)
+	}
+	return dec(body)
+}
+
+// Returns the single extension message type and body carried by the event, for framing
+func (evt *XRPCStreamEvent) extraFrame() (string, []byte, error) {
+	if len(evt.Extra) != 1 {
+		types := make([]string, 0, len(evt.Extra))
+		for t := range evt.Extra {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return "", nil, fmt.Errorf("event must carry exactly one extension message to be framed, has: %v", types)
+	}
+	for t, body := range evt.Extra {
+		return t, body, nil
+	}
+	panic("unreachable")
+}
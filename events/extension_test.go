@@ -0,0 +1,59 @@
+package events
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestExtensionFrames(t *testing.T) {
+	// CBOR for {"a": 1}
+	body := []byte{0xa1, 0x61, 0x61, 0x01}
+
+	RegisterExtensionType("#testExtension", func(body []byte) (any, error) {
+		return len(body), nil
+	})
+
+	evt := &XRPCStreamEvent{Extra: map[string][]byte{"#testExtension": body}}
+	if kind := eventKind(evt); kind != "extra" {
+		t.Fatalf("unexpected event kind: %q", kind)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := evt.Serialize(buf); err != nil {
+		t.Fatal(err)
+	}
+	out, err := decodeFrame(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Extra) != 1 || !bytes.Equal(out.Extra["#testExtension"], body) {
+		t.Fatalf("extension message did not round-trip: %+v", out.Extra)
+	}
+
+	decoded, err := out.DecodeExtra("#testExtension")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != len(body) {
+		t.Fatalf("unexpected decoded value: %v", decoded)
+	}
+	out.Extra["#unregistered"] = body
+	if _, err := out.DecodeExtra("#unregistered"); !errors.Is(err, ErrNoExtensionDecoder) {
+		t.Fatalf("expected ErrNoExtensionDecoder, got: %v", err)
+	}
+
+	// ambiguous framing
+	if err := out.Serialize(new(bytes.Buffer)); err == nil {
+		t.Fatal("expected error serializing event with two extension messages")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic registering a built-in message type")
+			}
+		}()
+		RegisterExtensionType("#commit", nil)
+	}()
+}
@@ -0,0 +1,60 @@
+package events
+
+import (
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// NewLabelFilter returns a subscriber filter which only passes label events (#labels and label #info). A #labels event passes if any of its labels matches both the source and value sets. An empty set matches anything.
+func NewLabelFilter(srcs []syntax.DID, vals []string) func(*XRPCStreamEvent) bool {
+	srcSet := make(map[string]bool, len(srcs))
+	for _, s := range srcs {
+		srcSet[s.String()] = true
+	}
+	valSet := make(map[string]bool, len(vals))
+	for _, v := range vals {
+		valSet[v] = true
+	}
+
+	return func(evt *XRPCStreamEvent) bool {
+		switch {
+		case evt.LabelInfo != nil:
+			return true
+		case evt.LabelLabels != nil:
+			for _, l := range evt.LabelLabels.Labels {
+				if l == nil {
+					continue
+				}
+				if len(srcSet) > 0 && !srcSet[l.Src] {
+					continue
+				}
+				if len(valSet) > 0 && !valSet[l.Val] {
+					continue
+				}
+				return true
+			}
+			return false
+		default:
+			return false
+		}
+	}
+}
+
+// NewActionFilter returns a subscriber filter which passes #commit events containing at least one op whose action ("create", "update" or "delete") is in the given set. The whole commit is delivered, including any ops with other actions. Events other than commits always pass. An empty set matches any commit.
+func NewActionFilter(actions []string) func(*XRPCStreamEvent) bool {
+	actionSet := make(map[string]bool, len(actions))
+	for _, a := range actions {
+		actionSet[a] = true
+	}
+
+	return func(evt *XRPCStreamEvent) bool {
+		if evt.RepoCommit == nil || len(actionSet) == 0 {
+			return true
+		}
+		for _, op := range evt.RepoCommit.Ops {
+			if op != nil && actionSet[op.Action] {
+				return true
+			}
+		}
+		return false
+	}
+}
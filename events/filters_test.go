@@ -0,0 +1,67 @@
+package events_test
+
+import (
+	"testing"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+)
+
+func TestLabelFilter(t *testing.T) {
+	labelEvt := func(src, val string) *events.XRPCStreamEvent {
+		return &events.XRPCStreamEvent{
+			LabelLabels: &atproto.LabelSubscribeLabels_Labels{
+				Labels: []*atproto.LabelDefs_Label{{Src: src, Val: val, Uri: "at://did:plc:abc123"}},
+			},
+		}
+	}
+
+	f := events.NewLabelFilter([]syntax.DID{"did:plc:labeler"}, []string{"porn", "gore"})
+	if !f(labelEvt("did:plc:labeler", "porn")) {
+		t.Fatal("expected matching label to pass")
+	}
+	if f(labelEvt("did:plc:other", "porn")) {
+		t.Fatal("expected label from other source to be dropped")
+	}
+	if f(labelEvt("did:plc:labeler", "spam")) {
+		t.Fatal("expected label with other value to be dropped")
+	}
+	if f(&events.XRPCStreamEvent{RepoCommit: &atproto.SyncSubscribeRepos_Commit{}}) {
+		t.Fatal("expected non-label event to be dropped")
+	}
+
+	all := events.NewLabelFilter(nil, nil)
+	if !all(labelEvt("did:plc:other", "spam")) {
+		t.Fatal("expected empty filter to pass all labels")
+	}
+}
+
+func TestActionFilter(t *testing.T) {
+	commitEvt := func(actions ...string) *events.XRPCStreamEvent {
+		commit := &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:abc123"}
+		for _, a := range actions {
+			commit.Ops = append(commit.Ops, &atproto.SyncSubscribeRepos_RepoOp{Action: a, Path: "app.bsky.feed.post/3jzfcijpj2z2a"})
+		}
+		return &events.XRPCStreamEvent{RepoCommit: commit}
+	}
+
+	f := events.NewActionFilter([]string{"delete"})
+	if !f(commitEvt("create", "delete")) {
+		t.Fatal("expected commit with a matching op to pass")
+	}
+	if f(commitEvt("create", "update")) {
+		t.Fatal("expected commit without matching ops to be dropped")
+	}
+	if f(commitEvt()) {
+		t.Fatal("expected commit with no ops to be dropped")
+	}
+	if !f(&events.XRPCStreamEvent{RepoHandle: &atproto.SyncSubscribeRepos_Handle{}}) {
+		t.Fatal("expected non-commit event to pass")
+	}
+
+	all := events.NewActionFilter(nil)
+	if !all(commitEvt("update")) {
+		t.Fatal("expected empty filter to pass all commits")
+	}
+}
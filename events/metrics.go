@@ -24,3 +24,70 @@ var eventsBroadcast = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "indigo_events_broadcast_total",
 	Help: "Total number of events broadcast to subscribers",
 }, []string{"pool"})
+
+var eventsDroppedByPolicy = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_dropped_by_policy_total",
+	Help: "Total number of events dropped by AddEvent because their kind is not in the allowed set",
+}, []string{"kind"})
+
+var eventsRateDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_rate_dropped_total",
+	Help: "Total number of live events dropped by subscribers' MaxEventRate caps",
+}, []string{"pool"})
+
+var eventsEnqueuedByKind = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indigo_events_enqueued_by_kind_total",
+	Help: "Total number of events enqueued to broadcast to subscribers, by subscriber ident and event kind",
+}, []string{"pool", "kind"})
+
+var subscriptionsRateLimited = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_subscriptions_rate_limited_total",
+	Help: "Total number of subscription attempts rejected by the per-ident rate limit",
+})
+
+var playbacksInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_events_playbacks_in_flight",
+	Help: "Number of subscriber playbacks currently reading from the persister",
+})
+
+var playbacksQueued = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_events_playbacks_queued",
+	Help: "Number of subscribers waiting for a playback slot",
+})
+
+var subscribersByState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "indigo_events_subscribers",
+	Help: "Number of active subscribers, by whether they are catching up on persisted events or receiving the live stream",
+}, []string{"state"})
+
+var maxSubscribersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indigo_events_max_subscribers",
+	Help: "Configured limit on the number of active subscribers (EventManagerOptions.MaxSubscribers), if any",
+})
+
+var subscriptionsRejected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_subscriptions_rejected_total",
+	Help: "Number of subscriptions rejected because the subscriber limit was reached",
+})
+
+var subscriberSaturation = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "indigo_events_subscriber_buffer_saturation",
+	Help: "Fraction (0 to 1) of the outgoing event buffer in use, for the most backed-up subscriber with each ident. Only sampled if enabled",
+}, []string{"ident"})
+
+var eventEnqueueLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "indigo_events_enqueue_latency_seconds",
+	Help:    "Time from an event being added to the event manager to it being enqueued for each subscriber, by subscriber ident",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+}, []string{"pool"})
+
+var eventSamplesDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "indigo_events_samples_dropped_total",
+	Help: "Total number of sampled events dropped because the sampler func fell behind",
+})
+
+var broadcastDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "indigo_events_broadcast_duration_seconds",
+	Help:    "Time taken to fan each event out to all live subscribers, including waiting for the subscriber lock. Persistence is blocked for this long",
+	Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+})
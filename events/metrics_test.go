@@ -0,0 +1,301 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSaturationSampler(t *testing.T) {
+	ctx := context.Background()
+
+	opts := DefaultEventManagerOptions()
+	opts.BufferSize = 10
+	opts.SaturationSampleInterval = 5 * time.Millisecond
+	em := NewEventManagerWithOptions(NewMemPersister(), opts)
+	defer em.Shutdown(ctx)
+
+	_, cleanup, err := em.Subscribe(ctx, "saturation-test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	for i := 0; i < 7; i++ {
+		if err := em.AddEvent(ctx, &XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sat := testutil.ToFloat64(subscriberSaturation.WithLabelValues("saturation-test"))
+		if sat == 0.7 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected saturation 0.7, got %f", sat)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEventKindCounter(t *testing.T) {
+	ctx := context.Background()
+	em := NewEventManager(NewMemPersister())
+
+	_, cleanup, err := em.Subscribe(ctx, "kind-test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		if err := em.AddEvent(ctx, &XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := em.AddEvent(ctx, &XRPCStreamEvent{
+		RepoHandle: &atproto.SyncSubscribeRepos_Handle{Did: "did:plc:testuser"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.ToFloat64(eventsEnqueuedByKind.WithLabelValues("kind-test", "commit")); n != 2 {
+		t.Fatalf("expected 2 commits, got %f", n)
+	}
+	if n := testutil.ToFloat64(eventsEnqueuedByKind.WithLabelValues("kind-test", "handle")); n != 1 {
+		t.Fatalf("expected 1 handle, got %f", n)
+	}
+}
+
+func TestEnqueueLatency(t *testing.T) {
+	ctx := context.Background()
+	em := NewEventManager(NewMemPersister())
+
+	_, cleanup, err := em.Subscribe(ctx, "latency-test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		if err := em.AddEvent(ctx, &XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var m dto.Metric
+	if err := eventEnqueueLatency.WithLabelValues("latency-test").(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.GetHistogram().GetSampleCount(); n != 3 {
+		t.Fatalf("expected 3 latency observations, got %d", n)
+	}
+}
+
+func TestBroadcastDuration(t *testing.T) {
+	ctx := context.Background()
+
+	var logs bytes.Buffer
+	opts := DefaultEventManagerOptions()
+	opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	opts.SlowBroadcastThreshold = time.Nanosecond
+	em := NewEventManagerWithOptions(NewMemPersister(), opts)
+
+	_, cleanup, err := em.Subscribe(ctx, "broadcast-duration-test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	count := func() uint64 {
+		var m dto.Metric
+		if err := broadcastDuration.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := count()
+	for i := 0; i < 2; i++ {
+		if err := em.AddEvent(ctx, &XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := count() - before; n != 2 {
+		t.Fatalf("expected 2 broadcast duration observations, got %d", n)
+	}
+	if n := strings.Count(logs.String(), "slow event broadcast"); n != 2 {
+		t.Fatalf("expected 2 slow broadcast warnings, got %d: %s", n, logs.String())
+	}
+}
+
+func TestSubscriberState(t *testing.T) {
+	ctx := context.Background()
+	em := NewEventManager(NewMemPersister())
+	defer em.Shutdown(ctx)
+
+	addEvent := func() {
+		if err := em.AddEvent(ctx, &XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addEvent()
+
+	catchingUp := subscribersByState.WithLabelValues(string(SubscriberCatchingUp))
+	live := subscribersByState.WithLabelValues(string(SubscriberLive))
+	baseCatchingUp, baseLive := testutil.ToFloat64(catchingUp), testutil.ToFloat64(live)
+
+	tail, err := em.SubscribeWithOptions(ctx, "tail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	if st := tail.State(); st != SubscriberLive {
+		t.Fatalf("expected live subscriber without a cursor, got %q", st)
+	}
+
+	since := int64(0)
+	replay, err := em.SubscribeWithOptions(ctx, "replay", &SubscribeOptions{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	if st := replay.State(); st != SubscriberCatchingUp {
+		t.Fatalf("expected playback subscriber to be catching up, got %q", st)
+	}
+	if d := testutil.ToFloat64(catchingUp) - baseCatchingUp; d != 1 {
+		t.Fatalf("expected one subscriber catching up, got %v", d)
+	}
+	if d := testutil.ToFloat64(live) - baseLive; d != 1 {
+		t.Fatalf("expected one live subscriber, got %v", d)
+	}
+
+	// the replaying subscriber is listed before it attaches to the live stream
+	found := false
+	for _, info := range em.Subscribers() {
+		if info.Ident == "replay" {
+			found = true
+			if info.State != SubscriberCatchingUp {
+				t.Fatalf("expected replay to be listed as catching up, got %q", info.State)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("replaying subscriber not listed")
+	}
+
+	// still catching up once attached; the switch to live happens when the first live event ends playback
+	deadline := time.Now().Add(time.Second)
+	for {
+		attached := false
+		for _, info := range em.Subscribers() {
+			if info.Ident == "replay" && info.Attached {
+				attached = true
+			}
+		}
+		if attached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber never attached to the live stream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st := replay.State(); st != SubscriberCatchingUp {
+		t.Fatalf("expected attached subscriber to still be catching up, got %q", st)
+	}
+
+	addEvent()
+	for replay.State() != SubscriberLive {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber never switched to live")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if d := testutil.ToFloat64(catchingUp) - baseCatchingUp; d != 0 {
+		t.Fatalf("expected no subscribers catching up, got %v", d)
+	}
+	if d := testutil.ToFloat64(live) - baseLive; d != 2 {
+		t.Fatalf("expected two live subscribers, got %v", d)
+	}
+
+	replay.Close()
+	tail.Close()
+	if d := testutil.ToFloat64(live) - baseLive; d != 0 {
+		t.Fatalf("expected closed subscribers to leave the gauge, got %v", d)
+	}
+}
+
+func TestAllowedKinds(t *testing.T) {
+	ctx := context.Background()
+
+	opts := DefaultEventManagerOptions()
+	opts.AllowedKinds = []string{"commit"}
+	em := NewEventManagerWithOptions(NewMemPersister(), opts)
+
+	sub, err := em.SubscribeWithOptions(ctx, "policy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	before := testutil.ToFloat64(eventsDroppedByPolicy.WithLabelValues("labels"))
+	labels := &XRPCStreamEvent{LabelLabels: &atproto.LabelSubscribeLabels_Labels{}}
+	if err := em.AddEvent(ctx, labels); err != nil {
+		t.Fatal(err)
+	}
+	if err := em.AddEventBlocking(ctx, labels); err != nil {
+		t.Fatal(err)
+	}
+	if err := em.AddEvent(ctx, &XRPCStreamEvent{RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(eventsDroppedByPolicy.WithLabelValues("labels")) - before; got != 2 {
+		t.Fatalf("expected 2 events dropped by policy, got %v", got)
+	}
+
+	// dropped events are neither broadcast nor persisted
+	select {
+	case evt := <-sub.Events():
+		if evt.RepoCommit == nil || evt.RepoCommit.Seq != 1 {
+			t.Fatalf("expected the commit as the first event, got kind %s", eventKind(evt))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	// lifted at runtime
+	em.SetAllowedKinds(nil)
+	if err := em.AddEvent(ctx, labels); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evt := <-sub.Events():
+		if evt.LabelLabels == nil {
+			t.Fatalf("expected labels event, got kind %s", eventKind(evt))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
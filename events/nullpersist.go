@@ -0,0 +1,76 @@
+package events
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/bluesky-social/indigo/models"
+)
+
+// NullPersister is for benchmarking the broadcast (fanout) path in isolation: it assigns sequence numbers and immediately broadcasts, storing nothing. Unlike YoloPersister it takes no lock, accepts any event, and supports Playback (of nothing), so subscribers with a cursor can connect too. Those subscribers miss the first live event, which is normally re-read from the persister when switching from playback to live.
+type NullPersister struct {
+	seq atomic.Int64
+
+	broadcast func(*XRPCStreamEvent)
+}
+
+var _ EventPersistence = (*NullPersister)(nil)
+var _ LastSequencePersister = (*NullPersister)(nil)
+var _ FloorSequencePersister = (*NullPersister)(nil)
+var _ CountSincePersister = (*NullPersister)(nil)
+
+func NewNullPersister() *NullPersister {
+	return &NullPersister{}
+}
+
+func (np *NullPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error {
+	seq := np.seq.Add(1)
+	switch {
+	case e.RepoCommit != nil:
+		e.RepoCommit.Seq = seq
+	case e.RepoHandle != nil:
+		e.RepoHandle.Seq = seq
+	case e.RepoMigrate != nil:
+		e.RepoMigrate.Seq = seq
+	case e.RepoTombstone != nil:
+		e.RepoTombstone.Seq = seq
+	case e.LabelLabels != nil:
+		e.LabelLabels.Seq = seq
+	}
+
+	np.broadcast(e)
+	return nil
+}
+
+// Playback returns immediately, since nothing is retained
+func (np *NullPersister) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	return nil
+}
+
+func (np *NullPersister) FloorSequence(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (np *NullPersister) CountSince(ctx context.Context, since int64) (int64, error) {
+	return 0, nil
+}
+
+func (np *NullPersister) LastSequence(ctx context.Context) (int64, error) {
+	return np.seq.Load(), nil
+}
+
+func (np *NullPersister) TakeDownRepo(ctx context.Context, uid models.Uid) error {
+	return nil
+}
+
+func (np *NullPersister) SetEventBroadcaster(brc func(*XRPCStreamEvent)) {
+	np.broadcast = brc
+}
+
+func (np *NullPersister) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (np *NullPersister) Shutdown(ctx context.Context) error {
+	return nil
+}
@@ -2,6 +2,7 @@ package events
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -19,6 +20,24 @@ type EventPersistence interface {
 	SetEventBroadcaster(func(*XRPCStreamEvent))
 }
 
+// Optionally implemented by persisters which can cheaply report the highest sequence number they have assigned (zero if none)
+type LastSequencePersister interface {
+	LastSequence(ctx context.Context) (int64, error)
+}
+
+// Optionally implemented by persisters which can report the oldest sequence number they still retain (zero if nothing has been persisted yet). Subscribers whose cursor is older than this get an OutdatedCursor info frame
+type FloorSequencePersister interface {
+	FloorSequence(ctx context.Context) (int64, error)
+}
+
+// Optionally implemented by persisters which can count the events Playback would replay from since, without reading them. The count may overestimate for persisters which skip some events (eg, taken down repos) on playback
+type CountSincePersister interface {
+	CountSince(ctx context.Context, since int64) (int64, error)
+}
+
+// Returned by EventManager.PlaybackBacklog when the persister does not implement CountSincePersister
+var ErrCountUnsupported = errors.New("persister does not support counting events")
+
 // MemPersister is the most naive implementation of event persistence
 // This EventPersistence option works fine with all event types
 // ill do better later
@@ -30,6 +49,10 @@ type MemPersister struct {
 	broadcast func(*XRPCStreamEvent)
 }
 
+var _ EventPersistence = (*MemPersister)(nil)
+var _ FloorSequencePersister = (*MemPersister)(nil)
+var _ CountSincePersister = (*MemPersister)(nil)
+
 func NewMemPersister() *MemPersister {
 	return &MemPersister{}
 }
@@ -60,16 +83,17 @@ func (mp *MemPersister) Persist(ctx context.Context, e *XRPCStreamEvent) error {
 }
 
 func (mp *MemPersister) Playback(ctx context.Context, since int64, cb func(*XRPCStreamEvent) error) error {
+	// snapshot the slice header under the lock; appends never modify existing elements
 	mp.lk.Lock()
-	l := len(mp.buf)
+	buf := mp.buf
 	mp.lk.Unlock()
 
-	if since >= int64(l) {
+	if since >= int64(len(buf)) {
 		return nil
 	}
 
 	// TODO: abusing the fact that buf[0].seq is currently always 1
-	for _, e := range mp.buf[since:l] {
+	for _, e := range buf[since:] {
 		if err := cb(e); err != nil {
 			return err
 		}
@@ -78,6 +102,34 @@ func (mp *MemPersister) Playback(ctx context.Context, since int64, cb func(*XRPC
 	return nil
 }
 
+func (mp *MemPersister) FloorSequence(ctx context.Context) (int64, error) {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	if len(mp.buf) == 0 {
+		return 0, nil
+	}
+	seq, _ := sequenceForEvent(mp.buf[0])
+	return seq, nil
+}
+
+func (mp *MemPersister) CountSince(ctx context.Context, since int64) (int64, error) {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	// same indexing as Playback
+	if since >= int64(len(mp.buf)) {
+		return 0, nil
+	}
+	return int64(len(mp.buf)) - max(since, 0), nil
+}
+
+func (mp *MemPersister) LastSequence(ctx context.Context) (int64, error) {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+	return mp.seq, nil
+}
+
 func (mp *MemPersister) TakeDownRepo(ctx context.Context, uid models.Uid) error {
 	return fmt.Errorf("repo takedowns not currently supported by memory persister, test usage only")
 }
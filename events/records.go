@@ -0,0 +1,169 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// A single record operation from a #commit event, as delivered by SubscribeRecords
+type RecordEvent struct {
+	// Sequence number of the commit the op was part of. Several RecordEvents can share a commit
+	Seq int64
+	// AT-URI of the record ("at://<did>/<collection>/<rkey>")
+	URI        string
+	Repo       string
+	Collection string
+	Rkey       string
+	// one of "create", "update", or "delete"
+	Action string
+	// nil for delete ops
+	CID *cid.Cid
+	// The record's DAG-CBOR bytes, verified against CID; nil for delete ops. Shares memory with the commit's CAR slice, so must not be modified
+	RawCBOR []byte
+}
+
+// Handle to an active record subscription, returned by [EventManager.SubscribeRecords]
+type RecordSubscription struct {
+	sub    *Subscription
+	out    chan *RecordEvent
+	cancel context.CancelFunc
+}
+
+// Records returns the channel of record events. The channel is closed when the underlying subscription is torn down, or the context passed to SubscribeRecords is cancelled.
+func (rs *RecordSubscription) Records() <-chan *RecordEvent {
+	return rs.out
+}
+
+// Close tears down the subscription. It is safe to call multiple times.
+func (rs *RecordSubscription) Close() {
+	rs.cancel()
+	rs.sub.Close()
+}
+
+// Reason returns why the underlying subscription was torn down, or CloseReasonNone if it is still active.
+func (rs *RecordSubscription) Reason() CloseReason {
+	return rs.sub.Reason()
+}
+
+// SubscribeRecords is a higher level subscription for indexers, which want records rather than raw firehose events. It subscribes (playing back from since, if not nil, as with SubscribeOptions.Since), and decodes each commit into one RecordEvent per op in the given collections (all collections, if empty). Commits with no matching ops are filtered out before they reach the subscriber's buffer. Events other than commits are ignored.
+//
+// Commits whose ops or CAR slice can't be decoded are skipped, with a warning, as are commits with a block whose data doesn't match its CID (see CommitBlocksWithOptions); a create or update whose record block is missing from the CAR slice (eg, "tooBig" commits) is delivered with a nil RawCBOR.
+//
+// Records are decoded in a goroutine per subscription. The output channel is unbuffered, so a slow consumer backs up into the subscriber's buffer, and is evicted as usual if that fills.
+func (em *EventManager) SubscribeRecords(ctx context.Context, ident string, collections []string, since *int64) (*RecordSubscription, error) {
+	collectionSet := make(map[string]bool, len(collections))
+	for _, c := range collections {
+		collectionSet[c] = true
+	}
+	wanted := func(collection string) bool {
+		return len(collectionSet) == 0 || collectionSet[collection]
+	}
+
+	sub, err := em.SubscribeWithOptions(ctx, ident, &SubscribeOptions{
+		Since: since,
+		Filter: func(evt *XRPCStreamEvent) bool {
+			if evt.RepoCommit == nil {
+				return false
+			}
+			if len(collectionSet) == 0 {
+				return true
+			}
+			for _, op := range evt.RepoCommit.Ops {
+				if op == nil {
+					continue
+				}
+				if c, _, ok := strings.Cut(op.Path, "/"); ok && wanted(c) {
+					return true
+				}
+			}
+			return false
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	rs := &RecordSubscription{
+		sub:    sub,
+		out:    make(chan *RecordEvent),
+		cancel: cancel,
+	}
+	go em.runRecordSubscription(ctx, rs, wanted)
+	return rs, nil
+}
+
+func (em *EventManager) runRecordSubscription(ctx context.Context, rs *RecordSubscription, wanted func(string) bool) {
+	defer close(rs.out)
+	defer rs.sub.Close()
+
+	for {
+		var evt *XRPCStreamEvent
+		var ok bool
+		select {
+		case evt, ok = <-rs.sub.Events():
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		if evt.RepoCommit == nil {
+			// error and info frames sent by the manager itself bypass the filter
+			continue
+		}
+
+		recs, err := commitRecordEvents(evt, wanted)
+		if err != nil {
+			em.logWarn("skipping undecodable commit in record subscription", "seq", evt.RepoCommit.Seq, "repo", evt.RepoCommit.Repo, "err", err)
+			continue
+		}
+		for _, rec := range recs {
+			select {
+			case rs.out <- rec:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Decodes the ops of a commit in the wanted collections
+func commitRecordEvents(evt *XRPCStreamEvent, wanted func(string) bool) ([]*RecordEvent, error) {
+	ops, err := evt.CommitOps()
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks *CommitBlocks
+	var out []*RecordEvent
+	for _, op := range ops {
+		if !wanted(op.Collection) {
+			continue
+		}
+		rec := &RecordEvent{
+			Seq:        evt.RepoCommit.Seq,
+			URI:        fmt.Sprintf("at://%s/%s", evt.RepoCommit.Repo, op.Path()),
+			Repo:       evt.RepoCommit.Repo,
+			Collection: op.Collection,
+			Rkey:       op.Rkey,
+			Action:     op.Action,
+			CID:        op.CID,
+		}
+		if op.CID != nil {
+			if blocks == nil {
+				// hashes every block, so RawCBOR is never unverified data
+				if blocks, err = evt.CommitBlocks(); err != nil {
+					return nil, err
+				}
+			}
+			// missing blocks are left nil
+			rec.RawCBOR, _ = blocks.Get(*op.CID)
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
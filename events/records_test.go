@@ -0,0 +1,134 @@
+package events_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+)
+
+func TestSubscribeRecords(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	rs, err := em.SubscribeRecords(ctx, "indexer", []string{"app.bsky.feed.post"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	postBytes := []byte{0xa1, 0x61, 0x61, 0x01}
+	postCid, carBytes := testCAR(t, postBytes)
+	link := lexutil.LexLink(postCid)
+
+	// a commit with no matching ops, and a non-commit event, are skipped
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Repo: "did:plc:testuser",
+			Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+				{Action: "delete", Path: "app.bsky.feed.like/3k2akerrsrn2c"},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoHandle: &atproto.SyncSubscribeRepos_Handle{Did: "did:plc:testuser", Handle: "test.example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Repo:   "did:plc:testuser",
+			Blocks: carBytes,
+			Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+				{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+				{Action: "delete", Path: "app.bsky.feed.like/3k2akerrsrn2d"},
+				{Action: "delete", Path: "app.bsky.feed.post/3k2akerrsrn2e"},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []*events.RecordEvent
+	for len(recs) < 2 {
+		select {
+		case rec := <-rs.Records():
+			recs = append(recs, rec)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for records, got %d", len(recs))
+		}
+	}
+
+	create := recs[0]
+	if create.URI != "at://did:plc:testuser/app.bsky.feed.post/3k2akerrsrn2b" || create.Action != "create" || create.Seq != 3 {
+		t.Fatalf("unexpected create: %+v", create)
+	}
+	if create.CID == nil || *create.CID != postCid || !bytes.Equal(create.RawCBOR, postBytes) {
+		t.Fatalf("unexpected create record: %+v", create)
+	}
+	del := recs[1]
+	if del.Collection != "app.bsky.feed.post" || del.Rkey != "3k2akerrsrn2e" || del.Action != "delete" || del.CID != nil || del.RawCBOR != nil {
+		t.Fatalf("unexpected delete: %+v", del)
+	}
+
+	rs.Close()
+	for range rs.Records() {
+	}
+	if rs.Reason() != events.CloseReasonNormal {
+		t.Fatalf("unexpected close reason: %q", rs.Reason())
+	}
+}
+
+func TestSubscribeRecordsTamperedBlock(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+
+	rs, err := em.SubscribeRecords(ctx, "indexer", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	postBytes := []byte{0xa1, 0x61, 0x61, 0x01}
+	postCid, carBytes := testCAR(t, postBytes)
+	link := lexutil.LexLink(postCid)
+
+	// {"a": 2} under the CID of {"a": 1}
+	tampered := bytes.Clone(carBytes)
+	tampered[bytes.LastIndex(tampered, postBytes)+3] = 0x02
+
+	for _, blocks := range [][]byte{tampered, carBytes} {
+		if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+				Repo:   "did:plc:testuser",
+				Blocks: blocks,
+				Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+					{Action: "create", Path: "app.bsky.feed.post/3k2akerrsrn2b", Cid: &link},
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the second commit is delivered
+	select {
+	case rec := <-rs.Records():
+		if rec.Seq != 2 || !bytes.Equal(rec.RawCBOR, postBytes) {
+			t.Fatalf("unexpected record: %+v", rec)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for record")
+	}
+	select {
+	case rec := <-rs.Records():
+		t.Fatalf("unexpected extra record: %+v", rec)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,30 @@
+package events
+
+import (
+	"context"
+	"errors"
+)
+
+var errReplayStopped = errors.New("replay stopped by consumer")
+
+// Replay returns an iterator over persisted events after the given sequence number. Unlike Subscribe, no subscriber is attached and there is no handoff to the live stream: iteration ends once the persister has played back everything it has. This is intended for batch jobs and replay tools.
+//
+// The iterator calls yield with each event and a nil error. If playback fails (including due to ctx being cancelled), yield is called once with a nil event and the error, and iteration ends. Returning false from yield stops playback early.
+//
+// The returned function has the same signature as iter.Seq2[*XRPCStreamEvent, error], so it can be used with range-over-func on newer Go versions; this module still targets a Go version without the iter package, so the named type is not used here.
+func (em *EventManager) Replay(ctx context.Context, since int64) func(yield func(*XRPCStreamEvent, error) bool) {
+	return func(yield func(*XRPCStreamEvent, error) bool) {
+		err := em.persister.Playback(ctx, since, func(evt *XRPCStreamEvent) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !yield(evt, nil) {
+				return errReplayStopped
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errReplayStopped) {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package events_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bluesky-social/indigo/events"
+)
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	em := events.NewEventManager(events.NewMemPersister())
+	addHandleEvents(t, em, 5)
+
+	var seqs []int64
+	em.Replay(ctx, 2)(func(evt *events.XRPCStreamEvent, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, evt.RepoHandle.Seq)
+		return true
+	})
+	if len(seqs) != 3 || seqs[0] != 3 || seqs[2] != 5 {
+		t.Fatalf("unexpected replayed sequence numbers: %v", seqs)
+	}
+
+	// stopping early does not yield an error
+	var count int
+	em.Replay(ctx, 0)(func(evt *events.XRPCStreamEvent, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Fatalf("expected replay to stop after 2 events, got %d", count)
+	}
+
+	// a cancelled context is surfaced as an error
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	var gotErr error
+	em.Replay(cctx, 0)(func(evt *events.XRPCStreamEvent, err error) bool {
+		if err != nil {
+			gotErr = err
+		}
+		return true
+	})
+	if gotErr != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", gotErr)
+	}
+}
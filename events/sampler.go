@@ -0,0 +1,58 @@
+package events
+
+import (
+	"math/rand"
+)
+
+// Number of sampled events which can be waiting for the sampler func before further samples are dropped
+const samplerBufferSize = 1024
+
+type eventSampler struct {
+	rate float64
+	ch   chan *XRPCStreamEvent
+	stop chan struct{}
+}
+
+// SetSampler registers fn to be called with a random sample (a fraction rate, between 0 and 1) of the events passed to AddEvent and AddEventBlocking, for feeding observability pipelines without running a full subscriber. Replaces any existing sampler; a rate of zero or a nil fn removes it.
+//
+// fn is called from a single background goroutine, fed by a buffered channel, so a slow fn never blocks the broadcast path. Samples are dropped (and counted in indigo_events_samples_dropped_total) if fn falls too far behind. Events are shared with the persister and subscribers, so fn must not modify them.
+func (em *EventManager) SetSampler(rate float64, fn func(*XRPCStreamEvent)) {
+	var s *eventSampler
+	if rate > 0 && fn != nil {
+		s = &eventSampler{
+			rate: min(rate, 1),
+			ch:   make(chan *XRPCStreamEvent, samplerBufferSize),
+			stop: make(chan struct{}),
+		}
+		go em.runSampler(s, fn)
+	}
+
+	if old := em.sampler.Swap(s); old != nil {
+		close(old.stop)
+	}
+}
+
+func (em *EventManager) runSampler(s *eventSampler, fn func(*XRPCStreamEvent)) {
+	for {
+		select {
+		case evt := <-s.ch:
+			fn(evt)
+		case <-s.stop:
+			return
+		case <-em.stop:
+			return
+		}
+	}
+}
+
+func (em *EventManager) maybeSample(evt *XRPCStreamEvent) {
+	s := em.sampler.Load()
+	if s == nil || rand.Float64() >= s.rate {
+		return
+	}
+	select {
+	case s.ch <- evt:
+	default:
+		eventSamplesDropped.Inc()
+	}
+}
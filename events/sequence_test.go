@@ -0,0 +1,97 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+)
+
+func TestSequenceForEvent(t *testing.T) {
+	seq, ok := sequenceForEvent(&XRPCStreamEvent{RepoCommit: &comatproto.SyncSubscribeRepos_Commit{Seq: 12}})
+	if !ok || seq != 12 {
+		t.Fatalf("expected sequenced commit, got (%d, %v)", seq, ok)
+	}
+	seq, ok = sequenceForEvent(&XRPCStreamEvent{LabelLabels: &comatproto.LabelSubscribeLabels_Labels{Seq: 7}})
+	if !ok || seq != 7 {
+		t.Fatalf("expected sequenced labels, got (%d, %v)", seq, ok)
+	}
+	for _, evt := range []*XRPCStreamEvent{
+		nil,
+		{},
+		{RepoInfo: &comatproto.SyncSubscribeRepos_Info{Name: "OutdatedCursor"}},
+		{Error: &ErrorFrame{Error: "ConsumerTooSlow"}},
+	} {
+		if _, ok := sequenceForEvent(evt); ok {
+			t.Fatalf("expected unsequenced event: %+v", evt)
+		}
+	}
+}
+
+// An unsequenced live event arriving during the playback-to-live handoff must not be treated as the catch-up point
+func TestSubscribeUnsequencedHandoff(t *testing.T) {
+	ctx := context.Background()
+	em := NewEventManager(NewMemPersister())
+
+	addCommit := func() {
+		if err := em.AddEvent(ctx, &XRPCStreamEvent{
+			RepoCommit: &comatproto.SyncSubscribeRepos_Commit{Repo: "did:plc:testuser"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		addCommit()
+	}
+
+	since := int64(0)
+	out, cleanup, err := em.Subscribe(ctx, "test", nil, &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// wait for the subscriber to finish initial playback and attach to the live stream
+	for i := 0; ; i++ {
+		em.subsLk.Lock()
+		n := len(em.subs)
+		em.subsLk.Unlock()
+		if n > 0 {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("subscriber never attached to live stream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	em.broadcastEvent(&XRPCStreamEvent{RepoInfo: &comatproto.SyncSubscribeRepos_Info{Name: "Interleaved"}})
+	addCommit()
+	addCommit()
+
+	var seqs []int64
+	sawInfo := false
+	for len(seqs) < 5 {
+		select {
+		case evt := <-out:
+			if seq, ok := sequenceForEvent(evt); ok {
+				seqs = append(seqs, seq)
+			} else if evt.RepoInfo != nil && evt.RepoInfo.Name == "Interleaved" {
+				sawInfo = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for events, got: %v", seqs)
+		}
+	}
+
+	for i, seq := range seqs {
+		if seq != int64(i+1) {
+			t.Fatalf("events out of order or missing: %v", seqs)
+		}
+	}
+	if !sawInfo {
+		t.Fatal("unsequenced info frame was dropped")
+	}
+}
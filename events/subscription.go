@@ -0,0 +1,139 @@
+package events
+
+import "golang.org/x/time/rate"
+
+// Indicates why a subscriber was torn down
+type CloseReason string
+
+const (
+	// subscriber is still active
+	CloseReasonNone CloseReason = ""
+	// the subscriber was closed by the calling code (eg, consumer disconnected)
+	CloseReasonNormal CloseReason = "Normal"
+	// the subscriber fell too far behind and was evicted
+	CloseReasonConsumerTooSlow CloseReason = "ConsumerTooSlow"
+	// the event manager is shutting down
+	CloseReasonShutdown CloseReason = "Shutdown"
+	// replaying persisted events failed
+	CloseReasonPlaybackFailed CloseReason = "PlaybackFailed"
+	// the subscriber was disconnected with EventManager.Disconnect
+	CloseReasonDisconnected CloseReason = "Disconnected"
+)
+
+// Whether a subscriber is still replaying persisted events or receiving the live stream
+type SubscriberState string
+
+const (
+	// the subscriber is playing back persisted events, and may or may not have started buffering live events
+	SubscriberCatchingUp SubscriberState = "catching_up"
+	// playback (if any) has finished, and the subscriber is receiving only live events
+	SubscriberLive SubscriberState = "live"
+)
+
+// Since value meaning "from the current tip": no playback, but the subscription records the latest sequence number at the moment it attached, so the consumer can persist a cursor before any events arrive
+const SinceTip int64 = -1
+
+type SubscribeOptions struct {
+	// If not nil, only events for which this returns true are delivered
+	Filter func(*XRPCStreamEvent) bool
+	// If not nil, persisted events after this sequence number are played back before switching to the live stream. SinceTip subscribes live, like nil, but with the starting sequence reported by Subscription.StartSeq
+	Since *int64
+	// If not nil, called (once) when the subscriber is torn down, with the reason
+	OnClose func(CloseReason)
+	// If set, and Since is nil, the subscription resumes from this consumer's last AckSequence cursor (or starts live if there is none). Requires the EventManager to have a CursorStore
+	ConsumerName string
+	// If non-zero, at most this many live events per second are delivered (after Filter), with bursts of up to MaxEventBurst (at least one). Excess events are dropped, and counted, rather than buffered, and the subscriber is not treated as slow. This is intentionally lossy sampling, for consumers like dashboards which only want a representative trickle. Playback of persisted events is not limited
+	MaxEventRate  rate.Limit
+	MaxEventBurst int
+	// Capacity of the channel returned by Subscription.Events for subscriptions which play back persisted events (ie, Since is set). Playback fills this channel as fast as the consumer drains it, independently of the live buffer (EventManagerOptions.BufferSize), so it can be larger for bulk replay or smaller for memory-constrained consumers. Defaults to the live buffer size if zero
+	PlaybackBufferSize int
+}
+
+// Handle to an active subscription, returned by [EventManager.SubscribeWithOptions]
+type Subscription struct {
+	events   <-chan *XRPCStreamEvent
+	sub      *Subscriber
+	startSeq int64
+}
+
+// Events returns the channel of events for this subscription. The channel is closed when the subscriber is torn down.
+func (s *Subscription) Events() <-chan *XRPCStreamEvent {
+	return s.events
+}
+
+// StartSeq returns the sequence number the subscription starts after: every event with a higher sequence number will be delivered (unless filtered or the subscriber is evicted), and none at or below it. For playback subscriptions this is the requested cursor. For live subscriptions it is the latest sequence number seen by the manager when the subscriber attached, which is zero if no events have been seen since startup (and the persister does not implement LastSequencePersister).
+func (s *Subscription) StartSeq() int64 {
+	return s.startSeq
+}
+
+// Close tears down the subscription. It is safe to call multiple times, and after the subscriber has already been evicted.
+func (s *Subscription) Close() {
+	s.sub.cleanup()
+}
+
+// Reason returns why the subscription was torn down, or CloseReasonNone if it is still active.
+func (s *Subscription) Reason() CloseReason {
+	s.sub.lk.Lock()
+	defer s.sub.lk.Unlock()
+	return s.sub.closeReason
+}
+
+// State returns whether the subscription is still catching up on persisted events or receiving the live stream. Subscriptions without a cursor are live from the start. The state of a torn down subscription is its state when it was closed.
+func (s *Subscription) State() SubscriberState {
+	return s.sub.State()
+}
+
+// UpdateFilter replaces the subscription's event filter without reconnecting. A nil filter passes all events. Takes effect for the next broadcast event; events already buffered are not re-filtered.
+func (s *Subscription) UpdateFilter(filter func(*XRPCStreamEvent) bool) {
+	if filter == nil {
+		filter = func(*XRPCStreamEvent) bool { return true }
+	}
+	s.sub.lk.Lock()
+	defer s.sub.lk.Unlock()
+	s.sub.filter.Store(&filter)
+}
+
+// close tears down the subscriber, recording the reason. Only the first call has any effect.
+func (sub *Subscriber) close(em *EventManager, reason CloseReason) {
+	sub.closeOnce.Do(func() {
+		// wake anything blocked on this subscriber (eg, an eviction error frame send, which holds lk) before taking the lock
+		close(sub.done)
+		sub.lk.Lock()
+		em.rmSubscriber(sub)
+		close(sub.outgoing)
+		sub.cleanedUp = true
+		if st := sub.State(); st != "" {
+			subscribersByState.WithLabelValues(string(st)).Dec()
+		}
+		sub.closeReason = reason
+		sub.lk.Unlock()
+
+		if sub.onClose != nil {
+			sub.onClose(reason)
+		}
+	})
+}
+
+// State returns the subscriber's current SubscriberState
+func (sub *Subscriber) State() SubscriberState {
+	st, _ := sub.state.Load().(SubscriberState)
+	return st
+}
+
+// setState records a state transition, keeping the subscribersByState gauge in step. Does nothing once the subscriber has been closed.
+func (sub *Subscriber) setState(st SubscriberState) {
+	sub.lk.Lock()
+	defer sub.lk.Unlock()
+	if sub.cleanedUp {
+		return
+	}
+	prev := sub.State()
+	if prev == st {
+		return
+	}
+	if prev != "" {
+		subscribersByState.WithLabelValues(string(prev)).Dec()
+	}
+	subscribersByState.WithLabelValues(string(st)).Inc()
+	sub.state.Store(st)
+}
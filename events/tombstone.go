@@ -0,0 +1,94 @@
+package events
+
+import (
+	"sync"
+)
+
+// TombstoneBarrier runs a callback for #tombstone events only once every earlier event for the same repo has been processed. Events arrive from a subscription in order, but consumers which process them concurrently (eg, with a worker pool, or the schedulers package) can otherwise see a tombstone while work for the repo is still in flight, and invalidate per-repo state (caches, etc) only for that work to repopulate it.
+//
+// Call Begin for every event, in the order they are received, and Done once each has been processed. Repos are tracked by DID, and only for the duration of their in-flight events, so memory use is bounded by the amount of in-flight work.
+type TombstoneBarrier struct {
+	lk sync.Mutex
+	// number of events begun, but not yet done, per repo
+	inflight map[string]int
+	// tombstones waiting for their repo to drain
+	waiting map[string][]*XRPCStreamEvent
+
+	onTombstone func(*XRPCStreamEvent)
+}
+
+// NewTombstoneBarrier returns a barrier which calls onTombstone for each tombstone event, once its repo has no events in flight. The callback is called synchronously, from whichever goroutine's Begin or Done call drained the repo, and never with the barrier's lock held
+func NewTombstoneBarrier(onTombstone func(*XRPCStreamEvent)) *TombstoneBarrier {
+	return &TombstoneBarrier{
+		inflight:    make(map[string]int),
+		waiting:     make(map[string][]*XRPCStreamEvent),
+		onTombstone: onTombstone,
+	}
+}
+
+// Begin records an event as in flight. Tombstones are held until every event for the repo which was begun earlier is done (events begun later for the same repo also hold the tombstone back, though a tombstoned repo should not have any). Tombstones do not need a matching Done call, and events with no repo are ignored
+func (tb *TombstoneBarrier) Begin(evt *XRPCStreamEvent) {
+	if evt.RepoTombstone != nil {
+		did := evt.RepoTombstone.Did
+		tb.lk.Lock()
+		if tb.inflight[did] > 0 {
+			tb.waiting[did] = append(tb.waiting[did], evt)
+			tb.lk.Unlock()
+			return
+		}
+		tb.lk.Unlock()
+		tb.onTombstone(evt)
+		return
+	}
+
+	did := eventRepo(evt)
+	if did == "" {
+		return
+	}
+	tb.lk.Lock()
+	tb.inflight[did]++
+	tb.lk.Unlock()
+}
+
+// Done marks an event begun with Begin as processed, running any tombstones for the repo which were waiting on it
+func (tb *TombstoneBarrier) Done(evt *XRPCStreamEvent) {
+	if evt.RepoTombstone != nil {
+		return
+	}
+	did := eventRepo(evt)
+	if did == "" {
+		return
+	}
+
+	tb.lk.Lock()
+	n := tb.inflight[did] - 1
+	if n > 0 {
+		tb.inflight[did] = n
+		tb.lk.Unlock()
+		return
+	}
+	delete(tb.inflight, did)
+	ready := tb.waiting[did]
+	delete(tb.waiting, did)
+	tb.lk.Unlock()
+
+	for _, ts := range ready {
+		tb.onTombstone(ts)
+	}
+}
+
+// Returns the DID of the repo an event is about, or an empty string for events not about a single repo (eg, #info)
+func eventRepo(evt *XRPCStreamEvent) string {
+	switch {
+	case evt.RepoCommit != nil:
+		return evt.RepoCommit.Repo
+	case evt.RepoHandle != nil:
+		return evt.RepoHandle.Did
+	case evt.RepoMigrate != nil:
+		return evt.RepoMigrate.Did
+	case evt.RepoTombstone != nil:
+		return evt.RepoTombstone.Did
+	default:
+		return ""
+	}
+}
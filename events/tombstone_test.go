@@ -0,0 +1,51 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+)
+
+func TestTombstoneBarrier(t *testing.T) {
+	var fired []string
+	tb := events.NewTombstoneBarrier(func(evt *events.XRPCStreamEvent) {
+		fired = append(fired, evt.RepoTombstone.Did)
+	})
+
+	commit := func(did string) *events.XRPCStreamEvent {
+		return &events.XRPCStreamEvent{RepoCommit: &atproto.SyncSubscribeRepos_Commit{Repo: did}}
+	}
+	tombstone := func(did string) *events.XRPCStreamEvent {
+		return &events.XRPCStreamEvent{RepoTombstone: &atproto.SyncSubscribeRepos_Tombstone{Did: did}}
+	}
+
+	// nothing in flight for the repo, so the tombstone runs straight away
+	tb.Begin(tombstone("did:plc:idle"))
+	if len(fired) != 1 || fired[0] != "did:plc:idle" {
+		t.Fatalf("expected idle tombstone to fire immediately, got %v", fired)
+	}
+
+	first, second, other := commit("did:plc:busy"), commit("did:plc:busy"), commit("did:plc:other")
+	tb.Begin(first)
+	tb.Begin(other)
+	tb.Begin(second)
+	tb.Begin(tombstone("did:plc:busy"))
+
+	// work finishing out of order, and on other repos, doesn't release the tombstone
+	tb.Done(second)
+	tb.Done(other)
+	if len(fired) != 1 {
+		t.Fatalf("tombstone fired with events still in flight: %v", fired)
+	}
+
+	tb.Done(first)
+	if len(fired) != 2 || fired[1] != "did:plc:busy" {
+		t.Fatalf("expected tombstone to fire once the repo drained, got %v", fired)
+	}
+
+	// events with no repo are ignored
+	info := &events.XRPCStreamEvent{RepoInfo: &atproto.SyncSubscribeRepos_Info{Name: "OutdatedCursor"}}
+	tb.Begin(info)
+	tb.Done(info)
+}
@@ -0,0 +1,169 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/repo"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	cid "github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+)
+
+// Returned by VerifyCommitSignature when the committing account's signing key could not be determined (DID resolution failed, or the DID document has no valid atproto key)
+var ErrSigningKeyResolution = errors.New("failed to resolve commit signing key")
+
+// Returned by VerifyCommitSignature when the commit is not validly signed by the account's current signing key
+var ErrInvalidCommitSignature = errors.New("invalid commit signature")
+
+// Defaults for NewCommitVerifier
+const (
+	DefaultCommitKeyCacheSize = 100_000
+	DefaultCommitKeyTTL       = 10 * time.Minute
+)
+
+// CommitVerifier checks firehose commit signatures against signing keys resolved with a single directory, caching the keys. Keys resolved by one verifier are never used by another, so verifiers for different directories (eg, a staging PLC) don't mix keys. Safe for concurrent use.
+type CommitVerifier struct {
+	dir *identity.BaseDirectory
+	// signing keys by DID; nil if caching is disabled
+	keys *expirable.LRU[syntax.DID, crypto.PublicKey]
+}
+
+// Creates a CommitVerifier which resolves keys with dir, caching up to cacheSize keys for keyTTL each. Zero values use DefaultCommitKeyCacheSize and DefaultCommitKeyTTL. A shorter TTL picks up key rotations sooner (a failed check always re-resolves), at the cost of more resolution.
+func NewCommitVerifier(dir *identity.BaseDirectory, cacheSize int, keyTTL time.Duration) *CommitVerifier {
+	if cacheSize <= 0 {
+		cacheSize = DefaultCommitKeyCacheSize
+	}
+	if keyTTL <= 0 {
+		keyTTL = DefaultCommitKeyTTL
+	}
+	return &CommitVerifier{
+		dir:  dir,
+		keys: expirable.NewLRU[syntax.DID, crypto.PublicKey](cacheSize, nil, keyTTL),
+	}
+}
+
+// Drops any cached signing key for did, so it is re-resolved on next use (eg, on an #identity event for the account)
+func (v *CommitVerifier) Purge(did syntax.DID) {
+	if v.keys != nil {
+		v.keys.Remove(did)
+	}
+}
+
+// Drops all cached signing keys
+func (v *CommitVerifier) PurgeAll() {
+	if v.keys != nil {
+		v.keys.Purge()
+	}
+}
+
+// VerifyCommitSignature checks that a firehose commit event's signed commit object is present in its blocks, is for the event's repo, and is signed by the repo account's current atproto signing key (resolved with dir).
+//
+// The key is resolved on every call; use a [CommitVerifier] to cache keys when verifying a stream of events.
+//
+// Resolution failures wrap ErrSigningKeyResolution, and bad signatures wrap ErrInvalidCommitSignature. Other errors indicate a malformed event.
+func VerifyCommitSignature(ctx context.Context, dir *identity.BaseDirectory, evt *XRPCStreamEvent) error {
+	return (&CommitVerifier{dir: dir}).Verify(ctx, evt)
+}
+
+// Verify is like VerifyCommitSignature, but uses the verifier's key cache. If a signature fails to verify against a cached key, the key is purged and re-resolved once before giving up, so key rotations are picked up promptly.
+func (v *CommitVerifier) Verify(ctx context.Context, evt *XRPCStreamEvent) error {
+	if evt.RepoCommit == nil {
+		return fmt.Errorf("not a repo commit event")
+	}
+	did, err := syntax.ParseDID(evt.RepoCommit.Repo)
+	if err != nil {
+		return fmt.Errorf("invalid commit repo DID: %w", err)
+	}
+
+	blk, err := commitBlock(evt)
+	if err != nil {
+		return err
+	}
+	var sc repo.SignedCommit
+	if err := sc.UnmarshalCBOR(bytes.NewReader(blk)); err != nil {
+		return fmt.Errorf("decoding signed commit: %w", err)
+	}
+	if sc.Did != did.String() {
+		return fmt.Errorf("%w: commit is for %s, not event repo %s", ErrInvalidCommitSignature, sc.Did, did)
+	}
+	msg, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		return fmt.Errorf("encoding unsigned commit: %w", err)
+	}
+
+	var key crypto.PublicKey
+	cached := false
+	if v.keys != nil {
+		key, cached = v.keys.Get(did)
+	}
+	if cached {
+		if err := key.HashAndVerify(msg, sc.Sig); err == nil {
+			return nil
+		}
+		// the key may have been rotated since it was cached
+		v.keys.Remove(did)
+	}
+
+	if key, err = v.resolveKey(ctx, did); err != nil {
+		return err
+	}
+	if err := key.HashAndVerify(msg, sc.Sig); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCommitSignature, err)
+	}
+	if v.keys != nil {
+		v.keys.Add(did, key)
+	}
+	return nil
+}
+
+func (v *CommitVerifier) resolveKey(ctx context.Context, did syntax.DID) (crypto.PublicKey, error) {
+	doc, err := v.dir.ResolveDID(ctx, did)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSigningKeyResolution, err)
+	}
+	ident := identity.ParseIdentity(doc)
+	key, err := ident.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSigningKeyResolution, err)
+	}
+	return key, nil
+}
+
+// Finds the commit object block in the event's CAR slice
+func commitBlock(evt *XRPCStreamEvent) ([]byte, error) {
+	opts := DefaultCommitDecodeOptions()
+	if len(evt.RepoCommit.Blocks) > opts.MaxCARSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrCommitTooLarge, len(evt.RepoCommit.Blocks), opts.MaxCARSize)
+	}
+	commitCID := cid.Cid(evt.RepoCommit.Commit)
+	if !commitCID.Defined() {
+		return nil, fmt.Errorf("commit event has no commit CID")
+	}
+
+	br, err := car.NewBlockReader(bytes.NewReader(evt.RepoCommit.Blocks), car.MaxAllowedSectionSize(uint64(opts.MaxCARSize)))
+	if err != nil {
+		return nil, fmt.Errorf("reading commit CAR: %w", err)
+	}
+	for n := 0; n < opts.MaxBlocks; n++ {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading commit CAR: %w", err)
+		}
+		if blk.Cid().Equals(commitCID) {
+			return blk.RawData(), nil
+		}
+	}
+	return nil, fmt.Errorf("commit block %s not found in event blocks", commitCID)
+}
@@ -0,0 +1,178 @@
+package events_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// builds a commit event for did, signed with priv
+func signedCommitEvent(t *testing.T, did string, priv crypto.PrivateKey) *events.XRPCStreamEvent {
+	dataCid, err := cid.Decode("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := repo.SignedCommit{Did: did, Version: repo.ATP_REPO_VERSION, Data: dataCid, Rev: "3k2akerrsrn2b"}
+	msg, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Sig, err = priv.HashAndSign(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := sc.MarshalCBOR(buf); err != nil {
+		t.Fatal(err)
+	}
+	commitCid, carBytes := testCAR(t, buf.Bytes())
+	return &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Repo:   did,
+			Commit: lexutil.LexLink(commitCid),
+			Blocks: carBytes,
+		},
+	}
+}
+
+func TestVerifyCommitSignature(t *testing.T) {
+	ctx := context.Background()
+	did := "did:plc:verifytest1234567890abc"
+
+	priv, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := priv.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(identity.DIDDocument{
+			DID: syntax.DID(did),
+			VerificationMethod: []identity.DocVerificationMethod{{
+				ID:                 did + "#atproto",
+				Type:               "Multikey",
+				Controller:         did,
+				PublicKeyMultibase: pub.Multibase(),
+			}},
+		})
+	}))
+	defer srv.Close()
+	dir := &identity.BaseDirectory{PLCURL: srv.URL}
+
+	if err := events.VerifyCommitSignature(ctx, dir, signedCommitEvent(t, did, priv)); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := events.VerifyCommitSignature(ctx, dir, signedCommitEvent(t, did, other)); !errors.Is(err, events.ErrInvalidCommitSignature) {
+		t.Fatalf("expected ErrInvalidCommitSignature, got: %v", err)
+	}
+
+	found = false
+	if err := events.VerifyCommitSignature(ctx, dir, signedCommitEvent(t, "did:plc:verifytestmissing0000000", priv)); !errors.Is(err, events.ErrSigningKeyResolution) {
+		t.Fatalf("expected ErrSigningKeyResolution, got: %v", err)
+	}
+}
+
+func TestCommitVerifier(t *testing.T) {
+	ctx := context.Background()
+	did := "did:plc:verifytest1234567890abc"
+
+	newKey := func() crypto.PrivateKey {
+		priv, err := crypto.GeneratePrivateKeyK256()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return priv
+	}
+	// serves a DID document with whatever key is current, counting requests
+	keyServer := func(current *crypto.PrivateKey, hits *atomic.Int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			pub, err := (*current).PublicKey()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			json.NewEncoder(w).Encode(identity.DIDDocument{
+				DID: syntax.DID(did),
+				VerificationMethod: []identity.DocVerificationMethod{{
+					ID:                 did + "#atproto",
+					Type:               "Multikey",
+					Controller:         did,
+					PublicKeyMultibase: pub.Multibase(),
+				}},
+			})
+		}))
+	}
+
+	current := newKey()
+	var hits atomic.Int64
+	srv := keyServer(&current, &hits)
+	defer srv.Close()
+	v := events.NewCommitVerifier(&identity.BaseDirectory{PLCURL: srv.URL}, 0, time.Hour)
+
+	first := current
+	for i := 0; i < 2; i++ {
+		if err := v.Verify(ctx, signedCommitEvent(t, did, first)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected key to be cached, got %d resolutions", n)
+	}
+
+	// a rotated key is picked up despite the cache
+	current = newKey()
+	if err := v.Verify(ctx, signedCommitEvent(t, did, current)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed check purges the cached key
+	if err := v.Verify(ctx, signedCommitEvent(t, did, newKey())); !errors.Is(err, events.ErrInvalidCommitSignature) {
+		t.Fatalf("expected ErrInvalidCommitSignature, got: %v", err)
+	}
+	before := hits.Load()
+	if err := v.Verify(ctx, signedCommitEvent(t, did, current)); err != nil {
+		t.Fatal(err)
+	}
+	if hits.Load() != before+1 {
+		t.Fatal("expected key to be re-resolved after a failed check")
+	}
+
+	// keys cached by one verifier are not used by another, with a different directory
+	other := newKey()
+	var otherHits atomic.Int64
+	otherSrv := keyServer(&other, &otherHits)
+	defer otherSrv.Close()
+	v2 := events.NewCommitVerifier(&identity.BaseDirectory{PLCURL: otherSrv.URL}, 0, 0)
+	if err := v2.Verify(ctx, signedCommitEvent(t, did, current)); !errors.Is(err, events.ErrInvalidCommitSignature) {
+		t.Fatalf("expected ErrInvalidCommitSignature, got: %v", err)
+	}
+}
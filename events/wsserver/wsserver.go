@@ -0,0 +1,162 @@
+// Package wsserver wires an [events.EventManager] subscription to a WebSocket connection, implementing the server side of com.atproto.sync.subscribeRepos.
+//
+// This lives in a separate package so that users of the events package who don't serve WebSockets don't need to pull in the HTTP serving code.
+package wsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+
+	"github.com/gorilla/websocket"
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("events-wsserver")
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  10 << 10,
+	WriteBufferSize: 10 << 10,
+	// subscribeRepos is a public, unauthenticated endpoint
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// ServeSubscribeRepos subscribes to the event manager (starting from the optional "cursor" query parameter), upgrades the request to a WebSocket, and streams CBOR frames to the client until either side disconnects.
+//
+// Subscribers are identified by the client's host (see ClientIdent), so per-ident limits and EventManager.Disconnect apply across all of a client's connections. Subscriptions rejected by the event manager's limits get an HTTP 429 response, before any upgrade.
+func ServeSubscribeRepos(w http.ResponseWriter, r *http.Request, em *events.EventManager) {
+	var since *int64
+	if sinceVal := r.URL.Query().Get("cursor"); sinceVal != "" {
+		sval, err := strconv.ParseInt(sinceVal, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid cursor parameter", http.StatusBadRequest)
+			return
+		}
+		since = &sval
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// subscribe before upgrading, so a rejected subscription gets a proper HTTP error instead of a dropped socket
+	evts, cleanup, err := em.Subscribe(ctx, ClientIdent(r), nil, since)
+	if err != nil {
+		if errors.Is(err, events.ErrTooManySubscriptions) || errors.Is(err, events.ErrTooManySubscribers) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		log.Warnw("failed to subscribe", "err", err, "remote_addr", r.RemoteAddr)
+		http.Error(w, "failed to subscribe", http.StatusInternalServerError)
+		return
+	}
+	defer cleanup()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader has already written an HTTP error response
+		log.Warnw("failed to upgrade websocket", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := serveConn(ctx, cancel, conn, evts); err != nil {
+		log.Warnw("subscribeRepos connection closed with error", "err", err, "remote_addr", r.RemoteAddr)
+	}
+}
+
+// ClientIdent is the subscriber ident used for a request: the client's host, without the (ephemeral) port
+func ClientIdent(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Streams events to conn until the subscription ends, the client disconnects, or ctx is done. cancel is called on client disconnect or ping failure
+func serveConn(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn, evts <-chan *events.XRPCStreamEvent) error {
+	lastWriteLk := sync.Mutex{}
+	lastWrite := time.Now()
+
+	// ping idle clients every 30 seconds; if the ping can't be written, tear down the consumer
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				lastWriteLk.Lock()
+				lw := lastWrite
+				lastWriteLk.Unlock()
+
+				if time.Since(lw) < 30*time.Second {
+					continue
+				}
+
+				if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(5*time.Second)); err != nil {
+					log.Warnw("failed to ping client", "err", err)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	conn.SetPingHandler(func(message string) error {
+		err := conn.WriteControl(websocket.PongMessage, []byte(message), time.Now().Add(time.Second*60))
+		if err == websocket.ErrCloseSent {
+			return nil
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		return err
+	})
+
+	// read and discard any messages from the client; this also detects client disconnect
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case evt, ok := <-evts:
+			if !ok {
+				return nil
+			}
+
+			wc, err := conn.NextWriter(websocket.BinaryMessage)
+			if err != nil {
+				return fmt.Errorf("failed to get next writer: %w", err)
+			}
+
+			if err := evt.Serialize(wc); err != nil {
+				return fmt.Errorf("failed to write event: %w", err)
+			}
+
+			if err := wc.Close(); err != nil {
+				return fmt.Errorf("failed to flush-close event write: %w", err)
+			}
+
+			lastWriteLk.Lock()
+			lastWrite = time.Now()
+			lastWriteLk.Unlock()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
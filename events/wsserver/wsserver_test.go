@@ -0,0 +1,119 @@
+package wsserver_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/wsserver"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+)
+
+func TestServeSubscribeRepos(t *testing.T) {
+	ctx := context.Background()
+	c, err := cid.Decode("bafkreiccldh766hwcnuxnf2wh6jgzepf2nlu2lvcllt63eww5p6chi4ity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	em := events.NewEventManager(events.NewMemPersister())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsserver.ServeSubscribeRepos(w, r, em)
+	}))
+	defer srv.Close()
+
+	// persisted before connecting, so this is delivered via playback
+	if err := em.AddEvent(ctx, &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+			Repo:   "did:plc:testuser",
+			Commit: lexutil.LexLink(c),
+			Blocks: []byte{},
+			Ops:    []*atproto.SyncSubscribeRepos_RepoOp{},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "?cursor=0"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	mt, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != websocket.BinaryMessage {
+		t.Fatalf("expected binary message, got type %d", mt)
+	}
+	r := bytes.NewReader(msg)
+	var header events.EventHeader
+	if err := header.UnmarshalCBOR(r); err != nil {
+		t.Fatal(err)
+	}
+	if header.Op != events.EvtKindMessage || header.MsgType != "#commit" {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+	var commit atproto.SyncSubscribeRepos_Commit
+	if err := commit.UnmarshalCBOR(r); err != nil {
+		t.Fatal(err)
+	}
+	if commit.Repo != "did:plc:testuser" || commit.Seq != 1 {
+		t.Fatalf("unexpected commit: repo=%s seq=%d", commit.Repo, commit.Seq)
+	}
+}
+
+func TestServeSubscribeReposBadCursor(t *testing.T) {
+	em := events.NewEventManager(events.NewMemPersister())
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/xrpc/com.atproto.sync.subscribeRepos?cursor=abc", nil)
+	wsserver.ServeSubscribeRepos(rec, req, em)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestServeSubscribeReposLimits(t *testing.T) {
+	opts := events.DefaultEventManagerOptions()
+	opts.MaxSubscribers = 1
+	em := events.NewEventManagerWithOptions(events.NewMemPersister(), opts)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsserver.ServeSubscribeRepos(w, r, em)
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// subscribers are identified by host, not by host and port
+	subs := em.Subscribers()
+	if len(subs) != 1 || subs[0].Ident != "127.0.0.1" {
+		t.Fatalf("expected one subscriber with ident 127.0.0.1, got %+v", subs)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected second subscription to be rejected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected HTTP 429, got: %v", err)
+	}
+}
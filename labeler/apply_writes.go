@@ -0,0 +1,217 @@
+package labeler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	util "github.com/bluesky-social/indigo/util"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// Upper bound on the number of writes in a single com.atproto.repo.applyWrites request (as enforced by the PDS)
+const maxApplyWrites = 200
+
+const labelRecordNSID = "com.atproto.label.label"
+
+// A label, as stored in a labeler's repo. LabelDefs_Label has no $type field, so it can't be wrapped in a LexiconTypeDecoder directly. This is only used for JSON (XRPC) encoding.
+type labelRecord struct {
+	LexiconTypeID string `json:"$type,const=com.atproto.label.label" cborgen:"$type,const=com.atproto.label.label"`
+	*comatproto.LabelDefs_Label
+}
+
+// Builds applyWrites request bodies which each create a batch of label records in the labeler's repo.
+type LabelWritesBuilder struct {
+	// DID of the labeler repo the records are written to; also used as the label "src"
+	Repo string
+
+	// If non-zero, Build assigns each create an explicit TID rkey derived from this seed and the label's position in the builder, instead of leaving the rkey to the server. Building the same logical batch (same seed, same labels added in the same order) again produces the same rkeys.
+	//
+	// When the server assigns rkeys, a retried applyWrites which had actually succeeded creates duplicate records. With deterministic rkeys, the retry instead fails (the records already exist), and the batch is all-or-nothing, so nothing is duplicated. Setting swapCommit on the input as well makes the outcome explicit: a retry of a request which already went through fails with InvalidSwap, which the caller can treat as success.
+	RkeySeed time.Time
+
+	labels []*comatproto.LabelDefs_Label
+}
+
+func NewLabelWritesBuilder(repo string) *LabelWritesBuilder {
+	return &LabelWritesBuilder{Repo: repo}
+}
+
+// Adds labels for a subject. subjectCID may be nil for labels which apply to a whole account (or any version of a record).
+func (b *LabelWritesBuilder) Add(subjectURI string, subjectCID *string, vals ...string) *LabelWritesBuilder {
+	cts := time.Now().Format(util.ISO8601)
+	for _, val := range vals {
+		b.labels = append(b.labels, &comatproto.LabelDefs_Label{
+			Src: b.Repo,
+			Uri: subjectURI,
+			Cid: subjectCID,
+			Val: val,
+			Cts: cts,
+		})
+	}
+	return b
+}
+
+// Returns one applyWrites input per batch of (up to 200) labels. Returns nil if no labels have been added.
+func (b *LabelWritesBuilder) Build() []*comatproto.RepoApplyWrites_Input {
+	var inputs []*comatproto.RepoApplyWrites_Input
+	for start := 0; start < len(b.labels); start += maxApplyWrites {
+		end := min(start+maxApplyWrites, len(b.labels))
+		input := &comatproto.RepoApplyWrites_Input{
+			Repo:   b.Repo,
+			Writes: make([]*comatproto.RepoApplyWrites_Input_Writes_Elem, 0, end-start),
+		}
+		for i, l := range b.labels[start:end] {
+			create := &comatproto.RepoApplyWrites_Create{
+				Collection: labelRecordNSID,
+				Value:      &lexutil.LexiconTypeDecoder{Val: &labelRecord{LabelDefs_Label: l}},
+			}
+			if !b.RkeySeed.IsZero() {
+				// one microsecond apart per label, so keys are unique and in insertion order
+				rkey := syntax.NewTID(b.RkeySeed.UnixMicro()+int64(start+i), 0).String()
+				create.Rkey = &rkey
+			}
+			input.Writes = append(input.Writes, &comatproto.RepoApplyWrites_Input_Writes_Elem{
+				RepoApplyWrites_Create: create,
+			})
+		}
+		inputs = append(inputs, input)
+	}
+	return inputs
+}
+
+// Returned by ValidateApplyWrites for writes which would be rejected by the server
+var ErrInvalidWrite = errors.New("invalid applyWrites input")
+
+// ValidateApplyWrites checks an applyWrites request locally before it is sent: the repo must be a valid DID or handle, each collection a valid NSID, and each rkey (where given) a valid record key. The error names the offending field, eg "writes[3].rkey".
+func ValidateApplyWrites(input *comatproto.RepoApplyWrites_Input) error {
+	if _, err := syntax.ParseAtIdentifier(input.Repo); err != nil {
+		return fmt.Errorf("%w: repo: %w", ErrInvalidWrite, err)
+	}
+	for i, w := range input.Writes {
+		var collection string
+		var rkey *string
+		switch {
+		case w == nil:
+			return fmt.Errorf("%w: writes[%d]: empty write", ErrInvalidWrite, i)
+		case w.RepoApplyWrites_Create != nil:
+			collection, rkey = w.RepoApplyWrites_Create.Collection, w.RepoApplyWrites_Create.Rkey
+		case w.RepoApplyWrites_Update != nil:
+			collection, rkey = w.RepoApplyWrites_Update.Collection, &w.RepoApplyWrites_Update.Rkey
+		case w.RepoApplyWrites_Delete != nil:
+			collection, rkey = w.RepoApplyWrites_Delete.Collection, &w.RepoApplyWrites_Delete.Rkey
+		default:
+			return fmt.Errorf("%w: writes[%d]: empty write", ErrInvalidWrite, i)
+		}
+		if _, err := syntax.ParseNSID(collection); err != nil {
+			return fmt.Errorf("%w: writes[%d].collection: %w", ErrInvalidWrite, i, err)
+		}
+		if rkey != nil {
+			if _, err := syntax.ParseRecordKey(*rkey); err != nil {
+				return fmt.Errorf("%w: writes[%d].rkey: %w", ErrInvalidWrite, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Options for SplitApplyWrites
+type SplitApplyWritesOptions struct {
+	// If true, writes are grouped by collection, so that each batch only has writes for a single collection. With Validate set on the input, a lexicon validation failure then fails just that collection's batch, and ApplyWritesBatched names the collection in the error. Writes keep their relative order within a collection, but not across collections; collections are batched in order of their first write. If false, writes are batched in their original order, mixing collections
+	ByCollection bool
+}
+
+// SplitApplyWrites splits an applyWrites input into as many inputs as needed to respect the per-request write limit (200), each with the original repo and validate settings. Inputs with swapCommit set can't be split, since only the first batch could be applied against that commit, so an error is returned if they would need to be. A nil opts batches writes in order.
+func SplitApplyWrites(input *comatproto.RepoApplyWrites_Input, opts *SplitApplyWritesOptions) ([]*comatproto.RepoApplyWrites_Input, error) {
+	if opts == nil {
+		opts = &SplitApplyWritesOptions{}
+	}
+
+	var groups [][]*comatproto.RepoApplyWrites_Input_Writes_Elem
+	if opts.ByCollection {
+		byCollection := make(map[string]int)
+		for _, w := range input.Writes {
+			c := applyWriteCollection(w)
+			i, ok := byCollection[c]
+			if !ok {
+				i = len(groups)
+				byCollection[c] = i
+				groups = append(groups, nil)
+			}
+			groups[i] = append(groups[i], w)
+		}
+	} else if len(input.Writes) > 0 {
+		groups = append(groups, input.Writes)
+	}
+
+	var inputs []*comatproto.RepoApplyWrites_Input
+	for _, writes := range groups {
+		for start := 0; start < len(writes); start += maxApplyWrites {
+			end := min(start+maxApplyWrites, len(writes))
+			inputs = append(inputs, &comatproto.RepoApplyWrites_Input{
+				Repo:       input.Repo,
+				Validate:   input.Validate,
+				SwapCommit: input.SwapCommit,
+				Writes:     writes[start:end],
+			})
+		}
+	}
+	if len(inputs) > 1 && input.SwapCommit != nil {
+		return nil, fmt.Errorf("%w: can't split %d writes into batches with swapCommit set", ErrInvalidWrite, len(input.Writes))
+	}
+	return inputs, nil
+}
+
+// ApplyWritesBatched sends an applyWrites input of any size on the given (authenticated) client, split up by SplitApplyWrites. Each batch is checked with ValidateApplyWrites before it is sent. Batches are applied in order, and not atomically as a whole: if one fails, the error says which (and, when grouping by collection, which collection it was for), and earlier batches have already been applied.
+func ApplyWritesBatched(ctx context.Context, c *xrpc.Client, input *comatproto.RepoApplyWrites_Input, opts *SplitApplyWritesOptions) error {
+	inputs, err := SplitApplyWrites(input, opts)
+	if err != nil {
+		return err
+	}
+	for i, batch := range inputs {
+		desc := fmt.Sprintf("batch %d of %d", i+1, len(inputs))
+		if opts != nil && opts.ByCollection {
+			desc = fmt.Sprintf("collection %s (%s)", applyWriteCollection(batch.Writes[0]), desc)
+		}
+		if err := ValidateApplyWrites(batch); err != nil {
+			return fmt.Errorf("%s: %w", desc, err)
+		}
+		if err := comatproto.RepoApplyWrites(ctx, c, batch); err != nil {
+			return fmt.Errorf("failed to apply writes for %s: %w", desc, err)
+		}
+	}
+	return nil
+}
+
+// Returns the collection of a write, or an empty string for an empty write
+func applyWriteCollection(w *comatproto.RepoApplyWrites_Input_Writes_Elem) string {
+	switch {
+	case w == nil:
+		return ""
+	case w.RepoApplyWrites_Create != nil:
+		return w.RepoApplyWrites_Create.Collection
+	case w.RepoApplyWrites_Update != nil:
+		return w.RepoApplyWrites_Update.Collection
+	case w.RepoApplyWrites_Delete != nil:
+		return w.RepoApplyWrites_Delete.Collection
+	default:
+		return ""
+	}
+}
+
+// Records label values for a subject as label records in the labeler's repo, via applyWrites on the given (authenticated) client. All values are written in a single request, unless there are more than the applyWrites limit.
+func ApplyLabels(ctx context.Context, c *xrpc.Client, repo, subjectURI string, subjectCID *string, vals []string) error {
+	for _, input := range NewLabelWritesBuilder(repo).Add(subjectURI, subjectCID, vals...).Build() {
+		if err := ValidateApplyWrites(input); err != nil {
+			return err
+		}
+		if err := comatproto.RepoApplyWrites(ctx, c, input); err != nil {
+			return fmt.Errorf("failed to apply label writes: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package labeler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyLabels(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var bodies []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/xrpc/com.atproto.repo.applyWrites", r.URL.Path)
+		var body map[string]any
+		assert.NoError(json.NewDecoder(r.Body).Decode(&body))
+		bodies = append(bodies, body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	cidStr := "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"
+	err := ApplyLabels(ctx, &xrpc.Client{Host: srv.URL}, "did:plc:labeler", "at://did:plc:user/app.bsky.feed.post/3k2akerrsrn2b", &cidStr, []string{"porn", "sexy"})
+	assert.NoError(err)
+
+	// both labels in a single request
+	if assert.Equal(1, len(bodies)) {
+		assert.Equal("did:plc:labeler", bodies[0]["repo"])
+		writes := bodies[0]["writes"].([]any)
+		assert.Equal(2, len(writes))
+		w := writes[0].(map[string]any)
+		assert.Equal("com.atproto.repo.applyWrites#create", w["$type"])
+		assert.Equal("com.atproto.label.label", w["collection"])
+		val := w["value"].(map[string]any)
+		assert.Equal("com.atproto.label.label", val["$type"])
+		assert.Equal("did:plc:labeler", val["src"])
+		assert.Equal(cidStr, val["cid"])
+		assert.Equal("porn", val["val"])
+	}
+}
+
+func TestLabelWritesBuilderBatching(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewLabelWritesBuilder("did:plc:labeler")
+	assert.Nil(b.Build())
+
+	vals := make([]string, 250)
+	for i := range vals {
+		vals[i] = "spam"
+	}
+	inputs := b.Add("at://did:plc:user", nil, vals...).Build()
+	assert.Equal(2, len(inputs))
+	assert.Equal(200, len(inputs[0].Writes))
+	assert.Equal(50, len(inputs[1].Writes))
+}
+
+func TestLabelWritesBuilderRkeys(t *testing.T) {
+	assert := assert.New(t)
+
+	// server-assigned by default
+	inputs := NewLabelWritesBuilder("did:plc:labeler").Add("at://did:plc:user", nil, "spam").Build()
+	assert.Nil(inputs[0].Writes[0].RepoApplyWrites_Create.Rkey)
+
+	seed := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	build := func() []*comatproto.RepoApplyWrites_Input {
+		b := NewLabelWritesBuilder("did:plc:labeler")
+		b.RkeySeed = seed
+		vals := make([]string, 201)
+		for i := range vals {
+			vals[i] = "spam"
+		}
+		return b.Add("at://did:plc:user", nil, vals...).Build()
+	}
+	first, retry := build(), build()
+
+	seen := make(map[string]bool)
+	for i, input := range first {
+		for j, w := range input.Writes {
+			rkey := w.RepoApplyWrites_Create.Rkey
+			if assert.NotNil(rkey) {
+				_, err := syntax.ParseTID(*rkey)
+				assert.NoError(err)
+				assert.False(seen[*rkey])
+				seen[*rkey] = true
+				assert.Equal(*rkey, *retry[i].Writes[j].RepoApplyWrites_Create.Rkey)
+			}
+		}
+	}
+	assert.Equal(201, len(seen))
+}
+
+func TestValidateApplyWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	inputs := NewLabelWritesBuilder("did:plc:labeler").Add("at://did:plc:user", nil, "spam").Build()
+	assert.NoError(ValidateApplyWrites(inputs[0]))
+
+	badRkey := "bad/rkey"
+	input := &comatproto.RepoApplyWrites_Input{
+		Repo: "did:plc:labeler",
+		Writes: []*comatproto.RepoApplyWrites_Input_Writes_Elem{
+			{RepoApplyWrites_Delete: &comatproto.RepoApplyWrites_Delete{Collection: "app.bsky.feed.post", Rkey: "3k2akerrsrn2b"}},
+			{RepoApplyWrites_Create: &comatproto.RepoApplyWrites_Create{Collection: "app.bsky.feed.post", Rkey: &badRkey}},
+		},
+	}
+	err := ValidateApplyWrites(input)
+	assert.ErrorIs(err, ErrInvalidWrite)
+	assert.ErrorContains(err, "writes[1].rkey")
+
+	input.Writes[1].RepoApplyWrites_Create.Rkey = nil
+	input.Writes[0].RepoApplyWrites_Delete.Collection = "not an nsid"
+	assert.ErrorContains(ValidateApplyWrites(input), "writes[0].collection")
+
+	input.Writes[0].RepoApplyWrites_Delete.Collection = "app.bsky.feed.post"
+	input.Repo = "not a repo"
+	assert.ErrorContains(ValidateApplyWrites(input), "repo")
+}
+
+func TestSplitApplyWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	create := func(collection string) *comatproto.RepoApplyWrites_Input_Writes_Elem {
+		return &comatproto.RepoApplyWrites_Input_Writes_Elem{
+			RepoApplyWrites_Create: &comatproto.RepoApplyWrites_Create{Collection: collection},
+		}
+	}
+	validate := true
+	input := &comatproto.RepoApplyWrites_Input{Repo: "did:plc:user", Validate: &validate}
+	for i := 0; i < 250; i++ {
+		input.Writes = append(input.Writes, create("app.bsky.feed.post"), create("app.bsky.feed.like"))
+	}
+
+	// mixed, in order
+	inputs, err := SplitApplyWrites(input, nil)
+	assert.NoError(err)
+	if assert.Equal(3, len(inputs)) {
+		assert.Equal(200, len(inputs[0].Writes))
+		assert.Equal(100, len(inputs[2].Writes))
+		assert.Equal("app.bsky.feed.like", applyWriteCollection(inputs[0].Writes[1]))
+		assert.Equal(&validate, inputs[2].Validate)
+	}
+
+	inputs, err = SplitApplyWrites(input, &SplitApplyWritesOptions{ByCollection: true})
+	assert.NoError(err)
+	if assert.Equal(4, len(inputs)) {
+		for i, collection := range []string{"app.bsky.feed.post", "app.bsky.feed.post", "app.bsky.feed.like", "app.bsky.feed.like"} {
+			for _, w := range inputs[i].Writes {
+				assert.Equal(collection, applyWriteCollection(w))
+			}
+		}
+		assert.Equal(50, len(inputs[1].Writes))
+		assert.Equal("did:plc:user", inputs[3].Repo)
+	}
+
+	// a single batch can keep its swapCommit, but several can't
+	swap := "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"
+	small := &comatproto.RepoApplyWrites_Input{Repo: "did:plc:user", SwapCommit: &swap, Writes: input.Writes[:2]}
+	inputs, err = SplitApplyWrites(small, nil)
+	assert.NoError(err)
+	assert.Equal(1, len(inputs))
+	_, err = SplitApplyWrites(small, &SplitApplyWritesOptions{ByCollection: true})
+	assert.ErrorIs(err, ErrInvalidWrite)
+
+	empty, err := SplitApplyWrites(&comatproto.RepoApplyWrites_Input{Repo: "did:plc:user"}, nil)
+	assert.NoError(err)
+	assert.Empty(empty)
+}
+
+func TestApplyWritesBatchedByCollection(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var body comatproto.RepoApplyWrites_Input
+		assert.NoError(json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/json")
+		for _, wr := range body.Writes {
+			if applyWriteCollection(wr) == "app.bsky.feed.like" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"InvalidRequest","message":"Invalid app.bsky.feed.like record"}`))
+				return
+			}
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	input := &comatproto.RepoApplyWrites_Input{Repo: "did:plc:user"}
+	for _, collection := range []string{"app.bsky.feed.post", "app.bsky.feed.like", "app.bsky.feed.post"} {
+		input.Writes = append(input.Writes, &comatproto.RepoApplyWrites_Input_Writes_Elem{
+			RepoApplyWrites_Create: &comatproto.RepoApplyWrites_Create{Collection: collection},
+		})
+	}
+
+	err := ApplyWritesBatched(ctx, &xrpc.Client{Host: srv.URL}, input, &SplitApplyWritesOptions{ByCollection: true})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "collection app.bsky.feed.like (batch 2 of 2)")
+	}
+	// the posts went through first
+	assert.Equal(2, requests)
+}
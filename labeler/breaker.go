@@ -0,0 +1,124 @@
+package labeler
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned by MicroNSFWImgLabeler while its circuit breaker is open, after repeated classifier failures
+var ErrClassifierUnavailable = errors.New("classifier unavailable (circuit open)")
+
+type breakerState int
+
+// values are exported as the labelmaker_micro_nsfw_img_circuit_state gauge
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// Fails requests fast once a backend has failed threshold times in a row within window. After cooldown a single trial request is let through (half-open): if it succeeds the circuit closes, otherwise it re-opens for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	lk           sync.Mutex
+	state        breakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+
+	// replaced in tests
+	now func() time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Returns ErrClassifierUnavailable if the request should not be attempted. Otherwise the caller must report the outcome with record. A nil breaker allows everything.
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return ErrClassifierUnavailable
+		}
+		// let this request through as the trial
+		cb.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// trial already in flight
+		return ErrClassifierUnavailable
+	default:
+		return nil
+	}
+}
+
+// Records the outcome of an allowed request. healthy should be true if the backend responded properly, even if the request itself was rejected (eg, a 4xx status).
+func (cb *circuitBreaker) record(healthy bool) {
+	if cb == nil {
+		return
+	}
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	now := cb.now()
+	if healthy {
+		cb.failures = 0
+		if cb.state != breakerClosed {
+			log.Infow("micro-NSFW-img classifier recovered, closing circuit")
+			cb.setState(breakerClosed)
+		}
+		return
+	}
+
+	if cb.state == breakerHalfOpen {
+		cb.openedAt = now
+		cb.setState(breakerOpen)
+		return
+	}
+
+	if cb.failures == 0 || now.Sub(cb.firstFailure) > cb.window {
+		cb.failures = 0
+		cb.firstFailure = now
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		log.Warnw("micro-NSFW-img classifier failing, opening circuit", "failures", cb.failures, "cooldown", cb.cooldown)
+		cb.openedAt = now
+		cb.setState(breakerOpen)
+	}
+}
+
+// Reports that an allowed request was given up on (eg, cancelled by the caller) without learning anything about the backend. If it was the half-open trial, the next request becomes the trial instead.
+func (cb *circuitBreaker) abandon() {
+	if cb == nil {
+		return
+	}
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	if cb.state == breakerHalfOpen {
+		// openedAt is unchanged, so the cooldown has already elapsed
+		cb.setState(breakerOpen)
+	}
+}
+
+// Called with lk held
+func (cb *circuitBreaker) setState(s breakerState) {
+	cb.state = s
+	microNSFWImgCircuitState.Set(float64(s))
+}
@@ -0,0 +1,67 @@
+package labeler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var microNSFWImgRequests = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "labelmaker_micro_nsfw_img_requests_total",
+	Help: "Total number of blobs sent to the micro-NSFW-img classifier",
+})
+
+var microNSFWImgFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "labelmaker_micro_nsfw_img_failures_total",
+	Help: "Total number of failed micro-NSFW-img classifier requests, by cause",
+}, []string{"cause"})
+
+var microNSFWImgDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "labelmaker_micro_nsfw_img_duration_seconds",
+	Help:    "Duration of micro-NSFW-img classifier requests",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+})
+
+var microNSFWImgLabels = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "labelmaker_micro_nsfw_img_labels_total",
+	Help: "Total number of labels emitted by the micro-NSFW-img labeler, by label value",
+}, []string{"label"})
+
+var microNSFWImgClean = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "labelmaker_micro_nsfw_img_clean_total",
+	Help: "Total number of blobs classified by the micro-NSFW-img labeler with no label emitted. Together with labelmaker_micro_nsfw_img_labels_total, gives the label distribution (cache hits are counted separately)",
+})
+
+var microNSFWImgMissingFields = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "labelmaker_micro_nsfw_img_missing_fields_total",
+	Help: "Total number of micro-NSFW-img responses missing a score field (or with a non-numeric value), by field. Missing scores are treated as zero",
+}, []string{"field"})
+
+var microNSFWImgCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "labelmaker_micro_nsfw_img_cache_hits_total",
+	Help: "Total number of micro-NSFW-img results served from the blob CID cache, by result (clean or labels)",
+}, []string{"result"})
+
+var labelerPoolQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "labelmaker_pool_queue_depth",
+	Help: "Number of label jobs waiting for a worker, across all labeler pools",
+})
+
+var labelerPoolWorkersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "labelmaker_pool_workers_busy",
+	Help: "Number of labeler pool workers currently running a classifier request, across all labeler pools",
+})
+
+var labelerPoolSkipped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "labelmaker_pool_checkpoint_skipped",
+	Help: "Number of label jobs skipped because the blob was already in the pool's checkpoint store",
+})
+
+var microNSFWImgCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "labelmaker_micro_nsfw_img_coalesced_total",
+	Help: "Total number of micro-NSFW-img LabelBlob calls which shared an in-flight classifier request for identical content",
+})
+
+var microNSFWImgCircuitState = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "labelmaker_micro_nsfw_img_circuit_state",
+	Help: "State of the micro-NSFW-img classifier circuit breaker: 0 closed (healthy), 1 half-open (testing recovery), 2 open (failing fast)",
+})
@@ -3,21 +3,98 @@ package labeler
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	util "github.com/bluesky-social/indigo/util"
 
 	"github.com/carlmjohnson/versioninfo"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/ipfs/go-cid"
 )
 
 type MicroNSFWImgLabeler struct {
 	Client   http.Client
 	Endpoint string
+
+	// If non-zero, images which are larger than MaxUploadBytes, or which have an edge longer than MaxImageEdge pixels, will be downscaled client-side (to MaxImageEdge) before upload. The classifier model works on small inputs, so this mostly saves bandwidth and latency.
+	MaxImageEdge   int
+	MaxUploadBytes int
+
+	// Upper bound on the size of images downloaded by LabelBlobURL. Defaults to DefaultMaxFetchBytes if zero
+	MaxFetchBytes int
+
+	// Set of blob MIME types which will be sent to the classifier. Other blobs are rejected with ErrUnsupportedMediaType. If empty, all blobs are sent.
+	AllowedMimeTypes []string
+
+	// Name of the multipart form field the image is uploaded as. Defaults to "file" if empty
+	FormFieldName string
+	// Additional form fields included in every upload, for classifier services which take extra parameters (eg, model selection)
+	ExtraFields map[string]string
+
+	// If set, sent as "Authorization: Bearer <token>", for classifiers behind an authenticating gateway
+	AuthToken string
+	// Additional HTTP headers set on every request (eg, a custom API key header). These are applied last, so can override any of the default headers
+	Headers map[string]string
+
+	// If not nil, labels are derived from scores with this policy, instead of SummarizeLabels
+	Policy *LabelPolicy
+
+	// If not nil, applied to the labels from SummarizeLabels (or Policy) before they are returned (and cached) by LabelBlob, so operators can remap or suppress label values (eg, collapse "hentai" into "porn"). May modify the slice in place. ScoreBlob results are not affected
+	LabelTransform func(labels []string) []string
+
+	// If not nil, used to parse the classifier response body instead of the default micro-NSFW-img JSON shape, for backends with a different response schema (see FieldMapDecoder)
+	DecodeResponse func(respBytes []byte) (*MicroNSFWImgResp, error)
+
+	// Results by blob CID. Images which got labels and clean images (no labels) are cached separately, so they can have different TTLs. Both are nil if caching is disabled.
+	labelCache *expirable.LRU[string, []string]
+	cleanCache *expirable.LRU[string, struct{}]
+
+	// Concurrent LabelBlob calls for the same content share a single classifier request. Nil disables coalescing.
+	inflight *inflightCalls
+
+	// Fails requests fast while the classifier is down. Nil if disabled.
+	breaker *circuitBreaker
+}
+
+// Returned when a blob's MIME type is not one the classifier is configured to handle (eg, video or audio)
+var ErrUnsupportedMediaType = errors.New("unsupported media type for image labeler")
+
+// Returned by LabelBlobURL when the image could not be downloaded
+var ErrBlobFetchFailed = errors.New("failed to fetch blob")
+
+// Returned by LabelBlobURL when the image is larger than MaxFetchBytes
+var ErrBlobTooLarge = errors.New("blob too large")
+
+var DefaultMaxFetchBytes = 16 << 20
+
+// Image types supported by the upstream micro-NSFW-img service
+var DefaultMicroNSFWImgMimeTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// Result of a single classifier request, with metadata for performance tuning (eg, correlating image size with classifier latency). Returned by LabelBlobDetailed
+type MicroNSFWImgResult struct {
+	// As returned by LabelBlob, and ScoreBlob
+	Labels []string
+	Scores *MicroNSFWImgResp
+
+	// Time taken by the classifier HTTP request, including reading the response body
+	Latency time.Duration
+	// Size of the image sent (after any client-side downscaling), and of the whole multipart request body
+	ImageBytes  int
+	UploadBytes int64
+	// HTTP status of the classifier response; zero if no response was received
+	StatusCode int
 }
 
 type MicroNSFWImgResp struct {
@@ -28,11 +105,34 @@ type MicroNSFWImgResp struct {
 	Sexy     float64 `json:"sexy"`
 }
 
+// Downscaling, MIME type filtering, result caching, and the circuit breaker are all disabled on the returned labeler; set MaxImageEdge (and MaxUploadBytes) and AllowedMimeTypes, or call SetCache and SetCircuitBreaker, to enable them.
 func NewMicroNSFWImgLabeler(url string) MicroNSFWImgLabeler {
 	return MicroNSFWImgLabeler{
-		Client:   *util.RobustHTTPClient(),
-		Endpoint: url,
+		Client:        *util.RobustHTTPClient(),
+		Endpoint:      url,
+		FormFieldName: "file",
+		inflight:      &inflightCalls{calls: make(map[string]*inflightCall)},
+	}
+}
+
+// Configures caching of LabelBlob results by blob CID. ttl applies to blobs which got labels, and cleanTTL to blobs which got no labels (the common case). A size of zero disables caching.
+func (mnil *MicroNSFWImgLabeler) SetCache(size int, ttl, cleanTTL time.Duration) {
+	if size <= 0 {
+		mnil.labelCache = nil
+		mnil.cleanCache = nil
+		return
+	}
+	mnil.labelCache = expirable.NewLRU[string, []string](size, nil, ttl)
+	mnil.cleanCache = expirable.NewLRU[string, struct{}](size, nil, cleanTTL)
+}
+
+// Configures the classifier circuit breaker. After failures consecutive failed requests (network errors, 5xx statuses, or unparseable responses) within window, requests fail immediately with ErrClassifierUnavailable for cooldown; then a single trial request is let through to check whether the classifier has recovered. A failures count of zero disables the breaker.
+func (mnil *MicroNSFWImgLabeler) SetCircuitBreaker(failures int, window, cooldown time.Duration) {
+	if failures <= 0 {
+		mnil.breaker = nil
+		return
 	}
+	mnil.breaker = newCircuitBreaker(failures, window, cooldown)
 }
 
 func (resp *MicroNSFWImgResp) SummarizeLabels() []string {
@@ -51,52 +151,582 @@ func (resp *MicroNSFWImgResp) SummarizeLabels() []string {
 	return labels
 }
 
+// Moderation severity tier for an image, derived from classifier scores
+type Severity int
+
+const (
+	SeverityClean Severity = iota
+	SeveritySuggestive
+	SeverityExplicit
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityClean:
+		return "clean"
+	case SeveritySuggestive:
+		return "suggestive"
+	case SeverityExplicit:
+		return "explicit"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Score cutoffs for [MicroNSFWImgResp.Severity]
+type SeverityThresholds struct {
+	// "porn" or "hentai" scores above this are Explicit
+	Explicit float64
+	// "porn", "hentai", or "sexy" scores above this (but not Explicit) are Suggestive
+	Suggestive float64
+}
+
+func DefaultSeverityThresholds() *SeverityThresholds {
+	return &SeverityThresholds{
+		Explicit:   0.90,
+		Suggestive: 0.70,
+	}
+}
+
+// Maps scores to a severity tier, returning the tier along with the labels which contributed to it. A nil thresholds uses the defaults.
+func (resp *MicroNSFWImgResp) Severity(th *SeverityThresholds) (Severity, []string) {
+	if th == nil {
+		th = DefaultSeverityThresholds()
+	}
+
+	var explicit []string
+	if resp.Porn > th.Explicit {
+		explicit = append(explicit, "porn")
+	}
+	if resp.Hentai > th.Explicit {
+		explicit = append(explicit, "hentai")
+	}
+	if len(explicit) > 0 {
+		return SeverityExplicit, explicit
+	}
+
+	var suggestive []string
+	if resp.Porn > th.Suggestive {
+		suggestive = append(suggestive, "porn")
+	}
+	if resp.Hentai > th.Suggestive {
+		suggestive = append(suggestive, "hentai")
+	}
+	if resp.Sexy > th.Suggestive {
+		suggestive = append(suggestive, "sexy")
+	}
+	if len(suggestive) > 0 {
+		return SeveritySuggestive, suggestive
+	}
+	return SeverityClean, nil
+}
+
 func (mnil *MicroNSFWImgLabeler) LabelBlob(ctx context.Context, blob lexutil.LexBlob, blobBytes []byte) ([]string, error) {
+	key := blobContentKey(blob, blobBytes)
+	if mnil.cleanCache != nil {
+		if _, ok := mnil.cleanCache.Get(key); ok {
+			microNSFWImgCacheHits.WithLabelValues("clean").Inc()
+			return []string{}, nil
+		}
+		if labels, ok := mnil.labelCache.Get(key); ok {
+			microNSFWImgCacheHits.WithLabelValues("labels").Inc()
+			return append([]string{}, labels...), nil
+		}
+	}
 
-	log.Infof("sending blob to micro-NSFW-img cid=%s mimetype=%s size=%d", blob.Ref, blob.MimeType, len(blobBytes))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// generic HTTP form file upload, then parse the response JSON
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", blob.Ref.String())
+	if mnil.inflight == nil {
+		return mnil.labelBlob(ctx, key, blob, blobBytes)
+	}
+
+	// identical content (eg, a viral image reposted by many accounts) which is already being classified shares the in-flight request
+	call := mnil.inflight.join(ctx, key, func(ctx context.Context) ([]string, error) {
+		return mnil.labelBlob(ctx, key, blob, blobBytes)
+	})
+	defer mnil.inflight.leave(key, call)
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, call.err
+		}
+		return append([]string{}, call.labels...), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// LabelBlobURL downloads an image (eg, the thumbnail of an external embed) with the labeler's HTTP client, and labels it as with LabelBlob. Downloads larger than MaxFetchBytes fail with ErrBlobTooLarge. The MIME type is sniffed from the content, falling back to the Content-Type header, and the usual AllowedMimeTypes gating applies. Results are cached by content hash, as there is no blob CID.
+func (mnil *MicroNSFWImgLabeler) LabelBlobURL(ctx context.Context, url string) ([]string, error) {
+	blobBytes, mimeType, err := mnil.fetchBlob(ctx, url)
 	if err != nil {
 		return nil, err
 	}
+	blob := lexutil.LexBlob{
+		MimeType: mimeType,
+		Size:     int64(len(blobBytes)),
+	}
+	return mnil.LabelBlob(ctx, blob, blobBytes)
+}
 
-	_, err = part.Write(blobBytes)
+// Downloads the blob at url, returning its bytes and MIME type
+func (mnil *MicroNSFWImgLabeler) fetchBlob(ctx context.Context, url string) ([]byte, string, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, "", fmt.Errorf("%w: not an http(s) URL: %q", ErrBlobFetchFailed, url)
+	}
+	maxBytes := mnil.MaxFetchBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxFetchBytes
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", fmt.Errorf("%w: %w", ErrBlobFetchFailed, err)
 	}
-	err = writer.Close()
+	req.Header.Set("User-Agent", "labelmaker/"+versioninfo.Short())
+	resp, err := mnil.Client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrBlobFetchFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%w: HTTP status %d", ErrBlobFetchFailed, resp.StatusCode)
+	}
+	if resp.ContentLength > int64(maxBytes) {
+		return nil, "", fmt.Errorf("%w: %d bytes", ErrBlobTooLarge, resp.ContentLength)
+	}
+
+	// read one byte past the limit, to tell a body of exactly the limit from a longer one
+	blobBytes, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrBlobFetchFailed, err)
+	}
+	if len(blobBytes) > maxBytes {
+		return nil, "", fmt.Errorf("%w: more than %d bytes", ErrBlobTooLarge, maxBytes)
+	}
+
+	// servers frequently send a generic (or wrong) Content-Type for images, so the content itself is trusted first
+	mimeType := http.DetectContentType(blobBytes)
+	if mimeType == "application/octet-stream" && resp.Header.Get("Content-Type") != "" {
+		mimeType = resp.Header.Get("Content-Type")
+	}
+	return blobBytes, mimeType, nil
+}
+
+// Coalesces concurrent classifier requests for the same content. Unlike singleflight, a shared request is cancelled once every caller waiting on it has given up, so cancellation (eg, during shutdown) actually stops uploads.
+type inflightCalls struct {
+	lk    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	// closed once labels and err are set
+	done   chan struct{}
+	labels []string
+	err    error
+
+	// guarded by inflightCalls.lk
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Returns the in-flight call for key, starting one (with fn) if there is none. Callers must call leave when done waiting.
+func (ic *inflightCalls) join(ctx context.Context, key string, fn func(ctx context.Context) ([]string, error)) *inflightCall {
+	ic.lk.Lock()
+	defer ic.lk.Unlock()
+
+	if call, ok := ic.calls[key]; ok {
+		call.waiters++
+		microNSFWImgCoalesced.Inc()
+		return call
+	}
+
+	// detached from the first caller's cancellation, since other callers may join; cancelled via leave instead
+	callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	call := &inflightCall{
+		done:    make(chan struct{}),
+		waiters: 1,
+		cancel:  cancel,
+	}
+	ic.calls[key] = call
+	go func() {
+		call.labels, call.err = fn(callCtx)
+		ic.lk.Lock()
+		if ic.calls[key] == call {
+			delete(ic.calls, key)
+		}
+		ic.lk.Unlock()
+		cancel()
+		close(call.done)
+	}()
+	return call
+}
+
+// Drops a waiter from the call, cancelling it if nobody is left waiting
+func (ic *inflightCalls) leave(key string, call *inflightCall) {
+	ic.lk.Lock()
+	defer ic.lk.Unlock()
+
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+		// later callers start a fresh request, rather than joining a cancelled one
+		if ic.calls[key] == call {
+			delete(ic.calls, key)
+		}
+	}
+}
+
+// LabelBlobDetailed is like LabelBlob, but also returns the raw scores and metadata about the classifier request. It always sends a request (bypassing the result cache and request coalescing), so the metadata is for this call; the result is still added to the cache. If the request was made but failed (eg, an error status), the partial result is returned along with the error.
+func (mnil *MicroNSFWImgLabeler) LabelBlobDetailed(ctx context.Context, blob lexutil.LexBlob, blobBytes []byte) (*MicroNSFWImgResult, error) {
+	res := &MicroNSFWImgResult{}
+	nsfwScore, err := mnil.scoreBlob(ctx, blob, blobBytes, res)
 	if err != nil {
+		if res.UploadBytes == 0 {
+			// rejected before any request was sent (eg, unsupported media type, or the circuit breaker is open)
+			return nil, err
+		}
+		return res, err
+	}
+	res.Scores = nsfwScore
+	res.Labels = mnil.labelsForScores(blobContentKey(blob, blobBytes), nsfwScore)
+	return res, nil
+}
+
+// Classifies the blob, and caches the result under key
+func (mnil *MicroNSFWImgLabeler) labelBlob(ctx context.Context, key string, blob lexutil.LexBlob, blobBytes []byte) ([]string, error) {
+	nsfwScore, err := mnil.ScoreBlob(ctx, blob, blobBytes)
+	if err != nil {
+		// errors are not cached
+		return nil, err
+	}
+	return mnil.labelsForScores(key, nsfwScore), nil
+}
+
+// Derives labels from classifier scores (with the Policy and LabelTransform, if any), and caches them under key
+func (mnil *MicroNSFWImgLabeler) labelsForScores(key string, nsfwScore *MicroNSFWImgResp) []string {
+	var labels []string
+	if mnil.Policy != nil {
+		labels = mnil.Policy.Evaluate(nsfwScore)
+	} else {
+		labels = nsfwScore.SummarizeLabels()
+	}
+	if mnil.LabelTransform != nil {
+		labels = mnil.LabelTransform(labels)
+		if labels == nil {
+			labels = []string{}
+		}
+	}
+	for _, l := range labels {
+		microNSFWImgLabels.WithLabelValues(l).Inc()
+	}
+	if len(labels) == 0 {
+		microNSFWImgClean.Inc()
+	}
+
+	if mnil.cleanCache != nil {
+		if len(labels) == 0 {
+			mnil.cleanCache.Add(key, struct{}{})
+		} else {
+			mnil.labelCache.Add(key, append([]string{}, labels...))
+		}
+	}
+	return labels
+}
+
+// Key identifying the blob's content, for caching and coalescing. The blob CID is a content hash, so it is used when present; otherwise the bytes are hashed directly
+func blobContentKey(blob lexutil.LexBlob, blobBytes []byte) string {
+	if c := cid.Cid(blob.Ref); c.Defined() {
+		return c.String()
+	}
+	sum := sha256.Sum256(blobBytes)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Sends the blob to the classifier and returns the raw parsed scores, without applying any labeling policy. Calling code can use this to implement custom thresholds; [MicroNSFWImgLabeler.LabelBlob] is the simple path.
+func (mnil *MicroNSFWImgLabeler) ScoreBlob(ctx context.Context, blob lexutil.LexBlob, blobBytes []byte) (*MicroNSFWImgResp, error) {
+	return mnil.scoreBlob(ctx, blob, blobBytes, nil)
+}
+
+// Implements ScoreBlob, filling in the request metadata of out (if not nil) once a request is actually sent
+func (mnil *MicroNSFWImgLabeler) scoreBlob(ctx context.Context, blob lexutil.LexBlob, blobBytes []byte, out *MicroNSFWImgResult) (*MicroNSFWImgResp, error) {
+	if out == nil {
+		out = &MicroNSFWImgResult{}
+	}
+	if !mnil.mimeTypeAllowed(blob.MimeType) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, blob.MimeType)
+	}
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", mnil.Endpoint, body)
+
+	microNSFWImgRequests.Inc()
+	start := time.Now()
+	defer func() {
+		microNSFWImgDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	// keyed by the original bytes, not the downscaled upload, to match the cache
+	key := blobContentKey(blob, blobBytes)
+	blobBytes = mnil.maybeDownscale(blob, blobBytes)
+	// downscaling can be slow for large images
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Infof("sending blob to micro-NSFW-img cid=%s mimetype=%s size=%d", blob.Ref, blob.MimeType, len(blobBytes))
+
+	req, err := mnil.buildRequest(ctx, uploadFilename(blob, key, blobBytes), blobBytes)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Content-Type", writer.FormDataContentType())
-	req.Header.Set("User-Agent", "labelmaker/"+versioninfo.Short())
+
+	if err := mnil.breaker.allow(); err != nil {
+		microNSFWImgFailures.WithLabelValues("circuit_open").Inc()
+		return nil, err
+	}
+	healthy, abandoned := false, false
+	defer func() {
+		if abandoned {
+			mnil.breaker.abandon()
+		} else {
+			mnil.breaker.record(healthy)
+		}
+	}()
+
+	out.ImageBytes = len(blobBytes)
+	out.UploadBytes = req.ContentLength
+	reqStart := time.Now()
+	defer func() {
+		out.Latency = time.Since(reqStart)
+	}()
 
 	res, err := mnil.Client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up, which says nothing about the classifier
+		abandoned = true
+		return nil, fmt.Errorf("micro-NSFW-img request cancelled: %w", ctx.Err())
+	}
 	if err != nil {
+		microNSFWImgFailures.WithLabelValues("network").Inc()
 		return nil, fmt.Errorf("micro-NSFW-img request failed: %v", err)
 	}
 	defer res.Body.Close()
+	out.StatusCode = res.StatusCode
 	if res.StatusCode != 200 {
+		// the classifier is up, but didn't like this particular request
+		healthy = res.StatusCode < 500
+		microNSFWImgFailures.WithLabelValues("status").Inc()
 		return nil, fmt.Errorf("micro-NSFW-img request failed  statusCode=%d", res.StatusCode)
 	}
 
 	respBytes, err := io.ReadAll(res.Body)
 	if err != nil {
+		microNSFWImgFailures.WithLabelValues("network").Inc()
 		return nil, fmt.Errorf("failed to read micro-NSFW-img resp body: %v", err)
 	}
 
-	var nsfwScore MicroNSFWImgResp
-	if err := json.Unmarshal(respBytes, &nsfwScore); err != nil {
-		return nil, fmt.Errorf("failed to parse micro-NSFW-img resp JSON: %v", err)
+	decode := mnil.DecodeResponse
+	if decode == nil {
+		decode = decodeMicroNSFWImgResp
+	}
+	nsfwScore, err := decode(respBytes)
+	if err != nil {
+		microNSFWImgFailures.WithLabelValues("parse").Inc()
+		return nil, fmt.Errorf("failed to parse micro-NSFW-img resp: %w", err)
 	}
+	healthy = true
 	scoreJson, _ := json.Marshal(nsfwScore)
 	log.Infof("micro-NSFW-img result cid=%s scores=%v", blob.Ref, string(scoreJson))
-	return nsfwScore.SummarizeLabels(), nil
+	return nsfwScore, nil
+}
+
+// File extensions for the image types the classifier is likely to see, keyed by MIME type
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+	"image/heic": ".heic",
+	"image/heif": ".heif",
+	"image/bmp":  ".bmp",
+	"image/tiff": ".tiff",
+}
+
+// Filename for the form file upload. Blobs from records are named by CID. Blobs fetched by URL (see LabelBlobURL) have no CID, so are named by their content key ("sha256-<hex>"), with an extension for the MIME type sniffed from the upload (which may have been re-encoded by downscaling)
+func uploadFilename(blob lexutil.LexBlob, key string, upload []byte) string {
+	if c := cid.Cid(blob.Ref); c.Defined() {
+		return c.String()
+	}
+	mimeType := http.DetectContentType(upload)
+	if mimeType == "application/octet-stream" {
+		mimeType = blob.MimeType
+	}
+	mimeType = strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	return strings.Replace(key, ":", "-", 1) + imageExtensions[mimeType]
+}
+
+// Builds a classifier request for the blob: a generic HTTP form file upload. Each call gets a fresh body, so this is used for every attempt at sending a blob, rather than re-sending a request whose body has already been consumed
+func (mnil *MicroNSFWImgLabeler) buildRequest(ctx context.Context, filename string, blobBytes []byte) (*http.Request, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	// sorted, so request bodies are deterministic
+	extraKeys := make([]string, 0, len(mnil.ExtraFields))
+	for k := range mnil.ExtraFields {
+		extraKeys = append(extraKeys, k)
+	}
+	sort.Strings(extraKeys)
+	for _, k := range extraKeys {
+		if err := writer.WriteField(k, mnil.ExtraFields[k]); err != nil {
+			return nil, err
+		}
+	}
+	fieldName := mnil.FormFieldName
+	if fieldName == "" {
+		fieldName = "file"
+	}
+	part, err := writer.CreateFormFile(fieldName, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = part.Write(blobBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", mnil.Endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	req.Header.Set("User-Agent", "labelmaker/"+versioninfo.Short())
+	if mnil.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+mnil.AuthToken)
+	}
+	for k, v := range mnil.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// Decodes the default micro-NSFW-img response leniently, to ride out minor schema drift in the classifier: unknown fields are ignored, and score fields which are missing (or null, or not numbers) are treated as zero, with a warning. Fails if the body is not a JSON object, or has none of the score fields at all (eg, an error body sent with a 200 status), since treating that as a clean result would be wrong.
+func decodeMicroNSFWImgResp(respBytes []byte) (*MicroNSFWImgResp, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(respBytes, &raw); err != nil {
+		return nil, err
+	}
+
+	var resp MicroNSFWImgResp
+	fields := []struct {
+		name string
+		dst  *float64
+	}{
+		{"drawings", &resp.Drawings},
+		{"hentai", &resp.Hentai},
+		{"neutral", &resp.Neutral},
+		{"porn", &resp.Porn},
+		{"sexy", &resp.Sexy},
+	}
+	var missing []string
+	for _, f := range fields {
+		val, ok := raw[f.name]
+		var score *float64
+		if ok {
+			if err := json.Unmarshal(val, &score); err != nil {
+				score = nil
+			}
+		}
+		if score == nil {
+			missing = append(missing, f.name)
+			microNSFWImgMissingFields.WithLabelValues(f.name).Inc()
+			continue
+		}
+		*f.dst = *score
+	}
+	if len(missing) == len(fields) {
+		return nil, fmt.Errorf("no score fields in response")
+	}
+	if len(missing) > 0 {
+		log.Warnw("micro-NSFW-img response missing score fields, treating as zero", "missing", missing)
+	}
+	return &resp, nil
+}
+
+// Returns a DecodeResponse function for classifiers which return a flat JSON object of numeric scores under different keys. fields maps each response key to the MicroNSFWImgResp JSON field it corresponds to ("drawings", "hentai", "neutral", "porn", or "sexy"); response keys which are not in the map are ignored, and unmapped scores are zero. Scores are divided by scale, so eg a classifier returning percentages can use a scale of 100 (a scale of zero is treated as one).
+func FieldMapDecoder(fields map[string]string, scale float64) func([]byte) (*MicroNSFWImgResp, error) {
+	if scale == 0 {
+		scale = 1
+	}
+	return func(respBytes []byte) (*MicroNSFWImgResp, error) {
+		var raw map[string]any
+		if err := json.Unmarshal(respBytes, &raw); err != nil {
+			return nil, err
+		}
+		var resp MicroNSFWImgResp
+		for respKey, field := range fields {
+			val, ok := raw[respKey]
+			if !ok {
+				continue
+			}
+			score, ok := val.(float64)
+			if !ok {
+				return nil, fmt.Errorf("non-numeric score for %q", respKey)
+			}
+			score /= scale
+			switch field {
+			case "drawings":
+				resp.Drawings = score
+			case "hentai":
+				resp.Hentai = score
+			case "neutral":
+				resp.Neutral = score
+			case "porn":
+				resp.Porn = score
+			case "sexy":
+				resp.Sexy = score
+			default:
+				return nil, fmt.Errorf("unknown score field %q (mapped from %q)", field, respKey)
+			}
+		}
+		return &resp, nil
+	}
+}
+
+// Downscales the image if it is over the configured size limits. Any failure (eg, unsupported format) is logged, and the original bytes are returned.
+func (mnil *MicroNSFWImgLabeler) maybeDownscale(blob lexutil.LexBlob, blobBytes []byte) []byte {
+	if mnil.MaxImageEdge <= 0 {
+		return blobBytes
+	}
+	// oversized files get re-encoded even if dimensions are within bounds
+	force := mnil.MaxUploadBytes > 0 && len(blobBytes) > mnil.MaxUploadBytes
+	resized, ok, err := downscaleImage(blobBytes, mnil.MaxImageEdge, force)
+	if err != nil {
+		log.Debugf("skipping micro-NSFW-img downscale cid=%s mimetype=%s: %v", blob.Ref, blob.MimeType, err)
+		return blobBytes
+	}
+	if ok {
+		log.Debugf("downscaled blob for micro-NSFW-img cid=%s size=%d resized=%d", blob.Ref, len(blobBytes), len(resized))
+	}
+	return resized
+}
+
+func (mnil *MicroNSFWImgLabeler) mimeTypeAllowed(mimeType string) bool {
+	if len(mnil.AllowedMimeTypes) == 0 {
+		return true
+	}
+	// strip any parameters, eg "image/jpeg; charset=binary"
+	mimeType = strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	for _, mt := range mnil.AllowedMimeTypes {
+		if mt == mimeType {
+			return true
+		}
+	}
+	return false
 }
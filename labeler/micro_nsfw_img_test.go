@@ -0,0 +1,603 @@
+package labeler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBlob(t *testing.T, mimeType string) lexutil.LexBlob {
+	c, err := cid.Decode("bafkreiccldh766hwcnuxnf2wh6jgzepf2nlu2lvcllt63eww5p6chi4ity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lexutil.LexBlob{
+		Ref:      lexutil.LexLink(c),
+		MimeType: mimeType,
+	}
+}
+
+func TestMicroNSFWImgMimeGating(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.Write([]byte(`{"drawings": 0.1, "hentai": 0.0, "neutral": 0.9, "porn": 0.0, "sexy": 0.0}`))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+
+	// all types are sent by default
+	_, err := mnil.LabelBlob(ctx, testBlob(t, "video/mp4"), []byte("dummy"))
+	assert.NoError(err)
+	assert.True(called)
+
+	called = false
+	mnil.AllowedMimeTypes = DefaultMicroNSFWImgMimeTypes
+	_, err = mnil.LabelBlob(ctx, testBlob(t, "video/mp4"), []byte("dummy"))
+	assert.ErrorIs(err, ErrUnsupportedMediaType)
+	assert.False(called)
+
+	labels, err := mnil.LabelBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.Empty(labels)
+	assert.True(called)
+}
+
+func TestMicroNSFWImgCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	calls := 0
+	resp := `{"drawings": 0.1, "hentai": 0.0, "neutral": 0.9, "porn": 0.0, "sexy": 0.0}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	mnil.SetCache(100_000, 24*time.Hour, 6*time.Hour)
+	blob := testBlob(t, "image/jpeg")
+
+	// clean result is cached
+	for i := 0; i < 3; i++ {
+		labels, err := mnil.LabelBlob(ctx, blob, []byte("dummy"))
+		assert.NoError(err)
+		assert.Empty(labels)
+	}
+	assert.Equal(1, calls)
+
+	// labeled results are cached separately
+	resp = `{"drawings": 0.0, "hentai": 0.0, "neutral": 0.0, "porn": 0.99, "sexy": 0.0}`
+	mnil.cleanCache.Purge()
+	for i := 0; i < 3; i++ {
+		labels, err := mnil.LabelBlob(ctx, blob, []byte("dummy"))
+		assert.NoError(err)
+		assert.Equal([]string{"porn"}, labels)
+	}
+	assert.Equal(2, calls)
+
+	// caching can be disabled
+	mnil.SetCache(0, 0, 0)
+	_, err := mnil.LabelBlob(ctx, blob, []byte("dummy"))
+	assert.NoError(err)
+	assert.Equal(3, calls)
+}
+
+func TestMicroNSFWImgFormFields(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(r.ParseMultipartForm(1 << 20))
+		assert.Equal("nsfw-v2", r.FormValue("model"))
+		_, fh, err := r.FormFile("image")
+		if assert.NoError(err) {
+			assert.Equal(testBlob(t, "image/jpeg").Ref.String(), fh.Filename)
+		}
+		w.Write([]byte(`{"drawings": 0.1, "hentai": 0.0, "neutral": 0.9, "porn": 0.0, "sexy": 0.0}`))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	mnil.FormFieldName = "image"
+	mnil.ExtraFields = map[string]string{"model": "nsfw-v2"}
+
+	_, err := mnil.ScoreBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+}
+
+func TestMicroNSFWImgAuth(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Api-Key") != "key123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"drawings": 0.1, "hentai": 0.0, "neutral": 0.9, "porn": 0.0, "sexy": 0.0}`))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	_, err := mnil.ScoreBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.Error(err)
+
+	mnil.AuthToken = "secret"
+	mnil.Headers = map[string]string{"X-Api-Key": "key123"}
+	_, err = mnil.ScoreBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+}
+
+func TestMicroNSFWImgSeverity(t *testing.T) {
+	assert := assert.New(t)
+
+	sev, labels := (&MicroNSFWImgResp{Neutral: 0.95, Sexy: 0.05}).Severity(nil)
+	assert.Equal(SeverityClean, sev)
+	assert.Empty(labels)
+
+	sev, labels = (&MicroNSFWImgResp{Sexy: 0.8, Porn: 0.1}).Severity(nil)
+	assert.Equal(SeveritySuggestive, sev)
+	assert.Equal([]string{"sexy"}, labels)
+
+	sev, labels = (&MicroNSFWImgResp{Sexy: 0.8, Porn: 0.95}).Severity(nil)
+	assert.Equal(SeverityExplicit, sev)
+	assert.Equal([]string{"porn"}, labels)
+	assert.Equal("explicit", sev.String())
+
+	// custom thresholds
+	sev, _ = (&MicroNSFWImgResp{Hentai: 0.6}).Severity(&SeverityThresholds{Explicit: 0.5, Suggestive: 0.3})
+	assert.Equal(SeverityExplicit, sev)
+}
+
+func TestMicroNSFWImgCoalesce(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var calls atomic.Int64
+	gate := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-gate
+		w.Write([]byte(`{"drawings": 0.0, "hentai": 0.0, "neutral": 0.0, "porn": 0.99, "sexy": 0.0}`))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+
+	// no CID, so the content is hashed
+	blob := lexutil.LexBlob{MimeType: "image/jpeg"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			labels, err := mnil.LabelBlob(ctx, blob, []byte("dummy"))
+			assert.NoError(err)
+			assert.Equal([]string{"porn"}, labels)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	assert.Equal(int64(1), calls.Load())
+
+	assert.NotEqual(blobContentKey(blob, []byte("dummy")), blobContentKey(blob, []byte("other")))
+	assert.Equal(testBlob(t, "image/jpeg").Ref.String(), blobContentKey(testBlob(t, "image/jpeg"), []byte("dummy")))
+}
+
+func TestMicroNSFWImgDecodeResponse(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"explicit": 97.5, "suggestive": 1.0, "safe": 1.5, "model": "v2"}`))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	mnil.DecodeResponse = FieldMapDecoder(map[string]string{
+		"explicit":   "porn",
+		"suggestive": "sexy",
+		"safe":       "neutral",
+	}, 100)
+
+	resp, err := mnil.ScoreBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.InDelta(0.975, resp.Porn, 0.0001)
+	assert.InDelta(0.01, resp.Sexy, 0.0001)
+	assert.InDelta(0.015, resp.Neutral, 0.0001)
+	assert.Equal(0.0, resp.Hentai)
+
+	labels, err := mnil.LabelBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.Equal([]string{"porn"}, labels)
+
+	_, err = FieldMapDecoder(map[string]string{"model": "porn"}, 1)([]byte(`{"model": "v2"}`))
+	assert.Error(err)
+}
+
+func TestMicroNSFWImgLabelTransform(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	resp := `{"drawings": 0.0, "hentai": 0.99, "neutral": 0.0, "porn": 0.0, "sexy": 0.0}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	mnil.LabelTransform = func(labels []string) []string {
+		var out []string
+		for _, l := range labels {
+			switch l {
+			case "hentai":
+				out = append(out, "porn")
+			case "sexy":
+			default:
+				out = append(out, l)
+			}
+		}
+		return out
+	}
+
+	labels, err := mnil.LabelBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.Equal([]string{"porn"}, labels)
+
+	// suppressed entirely
+	resp = `{"drawings": 0.0, "hentai": 0.0, "neutral": 0.0, "porn": 0.0, "sexy": 0.99}`
+	labels, err = mnil.LabelBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.Empty(labels)
+}
+
+func TestMicroNSFWImgCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var down atomic.Bool
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"drawings": 0.0, "hentai": 0.0, "neutral": 1.0, "porn": 0.0, "sexy": 0.0}`))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	mnil.SetCircuitBreaker(3, time.Minute, 30*time.Second)
+	// no retries, so calls counts requests
+	mnil.Client = http.Client{}
+	now := time.Now()
+	mnil.breaker.now = func() time.Time { return now }
+	blob := testBlob(t, "image/jpeg")
+
+	down.Store(true)
+	for i := 0; i < 3; i++ {
+		_, err := mnil.ScoreBlob(ctx, blob, []byte("dummy"))
+		assert.Error(err)
+		assert.NotErrorIs(err, ErrClassifierUnavailable)
+	}
+	assert.Equal(int64(3), calls.Load())
+
+	// circuit is open: fail fast without a request
+	_, err := mnil.LabelBlob(ctx, blob, []byte("dummy"))
+	assert.ErrorIs(err, ErrClassifierUnavailable)
+	assert.Equal(int64(3), calls.Load())
+
+	// after cooldown, a failed trial re-opens the circuit
+	now = now.Add(31 * time.Second)
+	_, err = mnil.ScoreBlob(ctx, blob, []byte("dummy"))
+	assert.NotErrorIs(err, ErrClassifierUnavailable)
+	_, err = mnil.ScoreBlob(ctx, blob, []byte("dummy"))
+	assert.ErrorIs(err, ErrClassifierUnavailable)
+	assert.Equal(int64(4), calls.Load())
+
+	// and a successful trial closes it
+	down.Store(false)
+	now = now.Add(31 * time.Second)
+	for i := 0; i < 2; i++ {
+		_, err = mnil.ScoreBlob(ctx, blob, []byte("dummy"))
+		assert.NoError(err)
+	}
+	assert.Equal(int64(6), calls.Load())
+
+	// failures spread out over more than the window don't open the circuit
+	down.Store(true)
+	for i := 0; i < 5; i++ {
+		now = now.Add(40 * time.Second)
+		_, err = mnil.ScoreBlob(ctx, blob, []byte("dummy"))
+		assert.NotErrorIs(err, ErrClassifierUnavailable)
+	}
+
+	// nor do client errors, since the classifier is up
+	mnil.SetCircuitBreaker(1, time.Minute, 30*time.Second)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	})
+	for i := 0; i < 2; i++ {
+		_, err = mnil.ScoreBlob(ctx, blob, []byte("dummy"))
+		assert.Error(err)
+		assert.NotErrorIs(err, ErrClassifierUnavailable)
+	}
+}
+
+func TestMicroNSFWImgCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int64
+	aborted := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// the server only notices the client going away once the body has been read
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	blob := testBlob(t, "image/jpeg")
+
+	// already cancelled: no request at all
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err := mnil.LabelBlob(ctx, blob, []byte("dummy"))
+	assert.ErrorIs(err, context.Canceled)
+	_, err = mnil.ScoreBlob(ctx, blob, []byte("dummy"))
+	assert.ErrorIs(err, context.Canceled)
+	assert.Less(time.Since(start), time.Second)
+	assert.Equal(int64(0), calls.Load())
+
+	// a coalesced request is only aborted once every waiting caller has given up
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, err := mnil.LabelBlob(ctx1, blob, []byte("dummy"))
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		_, err := mnil.LabelBlob(ctx2, blob, []byte("dummy"))
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel1()
+	assert.ErrorIs(<-errs, context.Canceled)
+	select {
+	case <-aborted:
+		t.Fatal("request aborted while a caller was still waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel2()
+	assert.ErrorIs(<-errs, context.Canceled)
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("request not aborted after all callers gave up")
+	}
+	assert.Equal(int64(1), calls.Load())
+}
+
+func TestMicroNSFWImgLabelMetrics(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	resp := `{"drawings": 0.0, "hentai": 0.0, "neutral": 0.0, "porn": 0.99, "sexy": 0.0}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+
+	porn := testutil.ToFloat64(microNSFWImgLabels.WithLabelValues("porn"))
+	clean := testutil.ToFloat64(microNSFWImgClean)
+
+	labels, err := mnil.LabelBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.Equal([]string{"porn"}, labels)
+	assert.Equal(porn+1, testutil.ToFloat64(microNSFWImgLabels.WithLabelValues("porn")))
+	assert.Equal(clean, testutil.ToFloat64(microNSFWImgClean))
+
+	resp = `{"drawings": 0.1, "hentai": 0.0, "neutral": 0.9, "porn": 0.0, "sexy": 0.0}`
+	labels, err = mnil.LabelBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.Empty(labels)
+	assert.Equal(porn+1, testutil.ToFloat64(microNSFWImgLabels.WithLabelValues("porn")))
+	assert.Equal(clean+1, testutil.ToFloat64(microNSFWImgClean))
+}
+
+func TestMicroNSFWImgLabelBlobURL(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(pngBuf.Bytes())
+	var classified atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/classify", func(w http.ResponseWriter, r *http.Request) {
+		classified.Add(1)
+		// named by content hash, as there is no CID
+		_, fh, err := r.FormFile("file")
+		if assert.NoError(err) {
+			assert.Equal("sha256-"+hex.EncodeToString(sum[:])+".png", fh.Filename)
+		}
+		w.Write([]byte(`{"drawings": 0.0, "hentai": 0.0, "neutral": 0.0, "porn": 0.99, "sexy": 0.0}`))
+	})
+	mux.HandleFunc("/img", func(w http.ResponseWriter, r *http.Request) {
+		// a generic content type is ignored in favor of the content
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(pngBuf.Bytes())
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{0}, 2048))
+	})
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>not an image</html>"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL + "/classify")
+	mnil.Client = http.Client{}
+	mnil.MaxFetchBytes = 1024
+	mnil.AllowedMimeTypes = DefaultMicroNSFWImgMimeTypes
+	mnil.SetCache(100, time.Hour, time.Hour)
+
+	labels, err := mnil.LabelBlobURL(ctx, srv.URL+"/img")
+	assert.NoError(err)
+	assert.Equal([]string{"porn"}, labels)
+	assert.Equal(int64(1), classified.Load())
+
+	// cached by content
+	_, err = mnil.LabelBlobURL(ctx, srv.URL+"/img")
+	assert.NoError(err)
+	assert.Equal(int64(1), classified.Load())
+
+	_, err = mnil.LabelBlobURL(ctx, srv.URL+"/big")
+	assert.ErrorIs(err, ErrBlobTooLarge)
+	_, err = mnil.LabelBlobURL(ctx, srv.URL+"/text")
+	assert.ErrorIs(err, ErrUnsupportedMediaType)
+	_, err = mnil.LabelBlobURL(ctx, srv.URL+"/missing")
+	assert.ErrorIs(err, ErrBlobFetchFailed)
+	_, err = mnil.LabelBlobURL(ctx, "file:///etc/passwd")
+	assert.ErrorIs(err, ErrBlobFetchFailed)
+	assert.Equal(int64(1), classified.Load())
+}
+
+func TestDecodeMicroNSFWImgResp(t *testing.T) {
+	assert := assert.New(t)
+
+	resp, err := decodeMicroNSFWImgResp([]byte(`{"drawings": 0.1, "hentai": 0.0, "neutral": 0.5, "porn": 0.4, "sexy": 0.0}`))
+	assert.NoError(err)
+	assert.Equal(0.4, resp.Porn)
+
+	// missing, null, and mistyped fields are zero; unknown fields are ignored
+	missingPorn := testutil.ToFloat64(microNSFWImgMissingFields.WithLabelValues("porn"))
+	resp, err = decodeMicroNSFWImgResp([]byte(`{"hentai": null, "neutral": 0.2, "porn": "high", "sexy": 0.95, "model": "v3"}`))
+	assert.NoError(err)
+	assert.Equal(MicroNSFWImgResp{Neutral: 0.2, Sexy: 0.95}, *resp)
+	assert.Equal(missingPorn+1, testutil.ToFloat64(microNSFWImgMissingFields.WithLabelValues("porn")))
+
+	for _, body := range []string{`not json`, `[0.1, 0.2]`, `{"error": "model not loaded"}`, `{}`} {
+		_, err = decodeMicroNSFWImgResp([]byte(body))
+		assert.Error(err, body)
+	}
+}
+
+func TestMicroNSFWImgBuildRequest(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	mnil := NewMicroNSFWImgLabeler("http://classifier.example.com/score")
+	mnil.AuthToken = "secret"
+	mnil.ExtraFields = map[string]string{"model": "nsfw-v2"}
+
+	// each request has its own body, so consuming one doesn't affect the next
+	for i := 0; i < 2; i++ {
+		req, err := mnil.buildRequest(ctx, testBlob(t, "image/jpeg").Ref.String(), []byte("dummy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal("POST", req.Method)
+		assert.Equal("Bearer secret", req.Header.Get("Authorization"))
+		assert.NoError(req.ParseMultipartForm(1 << 20))
+		assert.Equal("nsfw-v2", req.FormValue("model"))
+		f, _, err := req.FormFile("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(f)
+		assert.NoError(err)
+		assert.Equal([]byte("dummy"), data)
+	}
+}
+
+func TestMicroNSFWImgLabelBlobDetailed(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		if s := int(status.Load()); s != http.StatusOK {
+			w.WriteHeader(s)
+			return
+		}
+		w.Write([]byte(`{"drawings": 0.0, "hentai": 0.0, "neutral": 0.05, "porn": 0.95, "sexy": 0.0}`))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	mnil.Client = http.Client{}
+	mnil.AllowedMimeTypes = DefaultMicroNSFWImgMimeTypes
+	mnil.SetCache(100, time.Hour, time.Hour)
+
+	res, err := mnil.LabelBlobDetailed(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([]string{"porn"}, res.Labels)
+	assert.Equal(0.95, res.Scores.Porn)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal(5, res.ImageBytes)
+	assert.Greater(res.UploadBytes, int64(5))
+	assert.GreaterOrEqual(res.Latency, 5*time.Millisecond)
+
+	// the result is cached for the simple path
+	status.Store(http.StatusInternalServerError)
+	labels, err := mnil.LabelBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.Equal([]string{"porn"}, labels)
+
+	// but detailed calls always make a request, and report failures
+	res, err = mnil.LabelBlobDetailed(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.Error(err)
+	if assert.NotNil(res) {
+		assert.Equal(http.StatusInternalServerError, res.StatusCode)
+		assert.Nil(res.Scores)
+	}
+
+	res, err = mnil.LabelBlobDetailed(ctx, testBlob(t, "video/mp4"), []byte("dummy"))
+	assert.ErrorIs(err, ErrUnsupportedMediaType)
+	assert.Nil(res)
+}
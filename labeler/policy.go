@@ -0,0 +1,135 @@
+package labeler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A rule in a LabelPolicy. Scores are referred to by their MicroNSFWImgResp JSON field name ("drawings", "hentai", "neutral", "porn", or "sexy").
+//
+// The rule matches if every score in All is above its threshold, and (if Weights is set) the weighted sum of scores is above WeightedThreshold. Rules in a policy are OR'd together, so alternative conditions for the same label are expressed as separate rules.
+type LabelRule struct {
+	// Label value emitted when the rule matches
+	Label string `json:"label"`
+	// Minimum scores (exclusive), which must all be exceeded
+	All map[string]float64 `json:"all,omitempty"`
+	// Weights for a combined score, which must exceed WeightedThreshold
+	Weights           map[string]float64 `json:"weights,omitempty"`
+	WeightedThreshold float64            `json:"weightedThreshold,omitempty"`
+}
+
+// Rule-based alternative to the fixed per-score cutoffs in [MicroNSFWImgResp.SummarizeLabels], for policies which combine scores (eg, moderately high "porn" and "sexy" scores together). Can be loaded from JSON with LoadLabelPolicyFile.
+type LabelPolicy struct {
+	Rules []LabelRule `json:"rules"`
+}
+
+// The SummarizeLabels cutoffs, plus rules which catch images where the signal is split across categories
+func DefaultLabelPolicy() *LabelPolicy {
+	return &LabelPolicy{
+		Rules: []LabelRule{
+			{Label: "porn", All: map[string]float64{"porn": 0.90}},
+			{Label: "hentai", All: map[string]float64{"hentai": 0.90}},
+			{Label: "sexy", All: map[string]float64{"sexy": 0.90}},
+			// explicit, but the classifier can't tell if it is drawn or photographic
+			{Label: "porn", Weights: map[string]float64{"porn": 1, "hentai": 1}, WeightedThreshold: 1.2},
+			// suggestive on two counts
+			{Label: "sexy", All: map[string]float64{"porn": 0.6, "sexy": 0.7}},
+		},
+	}
+}
+
+// Checks that every rule has a label, at least one condition, and only refers to known scores
+func (p *LabelPolicy) Validate() error {
+	var resp MicroNSFWImgResp
+	for i, r := range p.Rules {
+		if r.Label == "" {
+			return fmt.Errorf("rule %d: missing label", i)
+		}
+		if len(r.All) == 0 && len(r.Weights) == 0 {
+			return fmt.Errorf("rule %d (%s): no conditions", i, r.Label)
+		}
+		for _, fields := range []map[string]float64{r.All, r.Weights} {
+			for f := range fields {
+				if _, ok := resp.score(f); !ok {
+					return fmt.Errorf("rule %d (%s): unknown score field %q", i, r.Label, f)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the labels of all matching rules, de-duplicated, in rule order
+func (p *LabelPolicy) Evaluate(resp *MicroNSFWImgResp) []string {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, r := range p.Rules {
+		if seen[r.Label] || !r.matches(resp) {
+			continue
+		}
+		seen[r.Label] = true
+		labels = append(labels, r.Label)
+	}
+	return labels
+}
+
+func (r *LabelRule) matches(resp *MicroNSFWImgResp) bool {
+	for f, min := range r.All {
+		if s, _ := resp.score(f); s <= min {
+			return false
+		}
+	}
+	if len(r.Weights) > 0 {
+		var sum float64
+		for f, w := range r.Weights {
+			s, _ := resp.score(f)
+			sum += w * s
+		}
+		if sum <= r.WeightedThreshold {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the score for a MicroNSFWImgResp JSON field name
+func (resp *MicroNSFWImgResp) score(field string) (float64, bool) {
+	switch field {
+	case "drawings":
+		return resp.Drawings, true
+	case "hentai":
+		return resp.Hentai, true
+	case "neutral":
+		return resp.Neutral, true
+	case "porn":
+		return resp.Porn, true
+	case "sexy":
+		return resp.Sexy, true
+	default:
+		return 0, false
+	}
+}
+
+func LoadLabelPolicyFile(fpath string) (*LabelPolicy, error) {
+	jsonFile, err := os.Open(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JSON file: %v", err)
+	}
+	defer jsonFile.Close()
+
+	raw, err := io.ReadAll(jsonFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JSON file: %v", err)
+	}
+
+	var p LabelPolicy
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse label policy file: %v", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid label policy: %w", err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,58 @@
+package labeler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p := DefaultLabelPolicy()
+	assert.NoError(p.Validate())
+
+	// same as SummarizeLabels for single strong signals
+	for _, resp := range []MicroNSFWImgResp{
+		{Porn: 0.99},
+		{Hentai: 0.95, Sexy: 0.95},
+		{Neutral: 0.99},
+	} {
+		assert.Equal(resp.SummarizeLabels(), p.Evaluate(&resp))
+	}
+
+	// combined signals
+	assert.Equal([]string{"sexy"}, p.Evaluate(&MicroNSFWImgResp{Porn: 0.65, Sexy: 0.75}))
+	assert.Equal([]string{"porn"}, p.Evaluate(&MicroNSFWImgResp{Porn: 0.6, Hentai: 0.7}))
+	// labels are not repeated
+	assert.Equal([]string{"porn"}, p.Evaluate(&MicroNSFWImgResp{Porn: 0.95, Hentai: 0.5}))
+
+	assert.Error((&LabelPolicy{Rules: []LabelRule{{Label: "x"}}}).Validate())
+	assert.Error((&LabelPolicy{Rules: []LabelRule{{All: map[string]float64{"porn": 0.5}}}}).Validate())
+	assert.Error((&LabelPolicy{Rules: []LabelRule{{Label: "x", Weights: map[string]float64{"gore": 1}}}}).Validate())
+}
+
+func TestLoadLabelPolicyFile(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	p, err := LoadLabelPolicyFile("testdata/label_policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(2, len(p.Rules))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"drawings": 0.0, "hentai": 0.0, "neutral": 0.1, "porn": 0.85, "sexy": 0.5}`))
+	}))
+	defer srv.Close()
+
+	mnil := NewMicroNSFWImgLabeler(srv.URL)
+	mnil.Policy = p
+	labels, err := mnil.LabelBlob(ctx, testBlob(t, "image/jpeg"), []byte("dummy"))
+	assert.NoError(err)
+	assert.Equal([]string{"porn", "nudity"}, labels)
+}
@@ -0,0 +1,279 @@
+package labeler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Common interface of the blob classifiers in this package (eg, MicroNSFWImgLabeler, HiveAILabeler)
+type ImageLabeler interface {
+	LabelBlob(ctx context.Context, blob lexutil.LexBlob, blobBytes []byte) ([]string, error)
+}
+
+// Returned by LabelerPool.Submit after the pool has been shut down
+var ErrPoolClosed = errors.New("labeler pool is shut down")
+
+// Records which blobs (by CID string) have been labeled, so a LabelerPool can skip them after a restart. Implementations must be safe for concurrent use.
+type CheckpointStore interface {
+	Mark(ctx context.Context, blobCIDs []string) error
+	Contains(ctx context.Context, blobCID string) (bool, error)
+}
+
+type LabelJob struct {
+	// Account the blob belongs to. Not used by the pool itself; passed through to the result for the caller's convenience
+	DID       string
+	Blob      lexutil.LexBlob
+	BlobBytes []byte
+
+	// If not nil, called (from a worker goroutine) with the result of this job. Otherwise the result is sent to the pool's Results channel
+	Callback func(*LabelResult)
+}
+
+type LabelResult struct {
+	Job    *LabelJob
+	Labels []string
+	Err    error
+	// True if the blob was already recorded in the pool's CheckpointStore, and the labeler was not called (Labels is nil)
+	Skipped bool
+}
+
+type LabelerPoolOptions struct {
+	// Number of concurrent LabelBlob calls
+	Workers int
+	// Number of jobs which can be queued waiting for a worker. Submit blocks once the queue is full
+	QueueSize int
+	// If not nil, jobs for blobs already in the store are skipped, and successfully labeled blobs are added to it
+	Checkpoint CheckpointStore
+	// How often labeled blobs are flushed to Checkpoint. Blobs labeled since the last flush are re-labeled after a crash (but not after a Shutdown, which flushes)
+	CheckpointInterval time.Duration
+}
+
+func DefaultLabelerPoolOptions() *LabelerPoolOptions {
+	return &LabelerPoolOptions{
+		Workers:            4,
+		QueueSize:          100,
+		CheckpointInterval: 10 * time.Second,
+	}
+}
+
+// LabelerPool runs a fixed number of workers calling an ImageLabeler, fed by a bounded job queue.
+//
+// Results for jobs without a Callback are sent to the Results channel, which must be consumed (or workers will block). The Results channel is closed once Shutdown has drained the queue.
+type LabelerPool struct {
+	labeler ImageLabeler
+	jobs    chan *LabelJob
+	results chan *LabelResult
+
+	checkpoint CheckpointStore
+	// blob CIDs labeled since the last checkpoint flush
+	pendingLk sync.Mutex
+	pending   []string
+	// closed by Shutdown to stop the checkpoint flush loop
+	stopFlush     chan struct{}
+	flushLoopDone chan struct{}
+
+	// cancelled if Shutdown gives up on draining, to abort in-flight classifier requests
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// held (read) by Submit while enqueuing, so Shutdown does not close the jobs channel out from under it
+	lk     sync.RWMutex
+	closed bool
+
+	wg sync.WaitGroup
+}
+
+// Creates a pool and starts its workers. opts may be nil, for defaults.
+func NewLabelerPool(labeler ImageLabeler, opts *LabelerPoolOptions) *LabelerPool {
+	if opts == nil {
+		opts = DefaultLabelerPoolOptions()
+	}
+	workers := max(1, opts.Workers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &LabelerPool{
+		labeler: labeler,
+		jobs:    make(chan *LabelJob, max(0, opts.QueueSize)),
+		results: make(chan *LabelResult, max(0, opts.QueueSize)),
+		ctx:     ctx,
+		cancel:  cancel,
+
+		checkpoint: opts.Checkpoint,
+	}
+
+	if p.checkpoint != nil {
+		interval := opts.CheckpointInterval
+		if interval <= 0 {
+			interval = DefaultLabelerPoolOptions().CheckpointInterval
+		}
+		p.stopFlush = make(chan struct{})
+		p.flushLoopDone = make(chan struct{})
+		go p.flushLoop(interval)
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.results)
+	}()
+	return p
+}
+
+// Results returns the channel results are delivered on, for jobs submitted without a Callback.
+func (p *LabelerPool) Results() <-chan *LabelResult {
+	return p.results
+}
+
+// Submit adds a job to the queue, blocking while the queue is full (or until ctx is done). Returns ErrPoolClosed if the pool has been shut down.
+func (p *LabelerPool) Submit(ctx context.Context, job *LabelJob) error {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	labelerPoolQueueDepth.Inc()
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		labelerPoolQueueDepth.Dec()
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting new jobs, and waits for queued and in-flight jobs to finish. If ctx is done first, in-flight classifier requests are cancelled (their results are still delivered, with errors) and ctx.Err() is returned. Either way, blobs labeled so far are flushed to the checkpoint store, if there is one.
+func (p *LabelerPool) Shutdown(ctx context.Context) error {
+	p.lk.Lock()
+	first := !p.closed
+	if first {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.lk.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	p.cancel()
+
+	if p.checkpoint != nil {
+		if first {
+			close(p.stopFlush)
+		}
+		<-p.flushLoopDone
+		if ferr := p.flushCheckpoint(context.WithoutCancel(ctx)); ferr != nil {
+			log.Errorw("failed to flush labeler pool checkpoint", "err", ferr)
+		}
+	}
+	return err
+}
+
+func (p *LabelerPool) worker() {
+	defer p.wg.Done()
+
+	for job := range p.jobs {
+		labelerPoolQueueDepth.Dec()
+
+		blobCID := checkpointKey(job.Blob)
+		var res *LabelResult
+		if p.alreadyLabeled(blobCID) {
+			labelerPoolSkipped.Inc()
+			res = &LabelResult{Job: job, Skipped: true}
+		} else {
+			labelerPoolWorkersBusy.Inc()
+			labels, err := p.labeler.LabelBlob(p.ctx, job.Blob, job.BlobBytes)
+			labelerPoolWorkersBusy.Dec()
+			res = &LabelResult{Job: job, Labels: labels, Err: err}
+		}
+
+		if job.Callback != nil {
+			job.Callback(res)
+		} else {
+			p.results <- res
+		}
+
+		// only checkpoint once the result has been handed off
+		if p.checkpoint != nil && res.Err == nil && !res.Skipped && blobCID != "" {
+			p.pendingLk.Lock()
+			p.pending = append(p.pending, blobCID)
+			p.pendingLk.Unlock()
+		}
+	}
+}
+
+// Returns the string CID of the blob, or empty string if it has none (in which case it is not checkpointed)
+func checkpointKey(blob lexutil.LexBlob) string {
+	if !cid.Cid(blob.Ref).Defined() {
+		return ""
+	}
+	return blob.Ref.String()
+}
+
+func (p *LabelerPool) alreadyLabeled(blobCID string) bool {
+	if p.checkpoint == nil || blobCID == "" {
+		return false
+	}
+	ok, err := p.checkpoint.Contains(p.ctx, blobCID)
+	if err != nil {
+		// fail open: re-labeling a blob is better than dropping it
+		log.Warnw("failed to check labeler pool checkpoint", "cid", blobCID, "err", err)
+		return false
+	}
+	return ok
+}
+
+func (p *LabelerPool) flushLoop(interval time.Duration) {
+	defer close(p.flushLoopDone)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := p.flushCheckpoint(p.ctx); err != nil {
+				log.Errorw("failed to flush labeler pool checkpoint", "err", err)
+			}
+		case <-p.stopFlush:
+			return
+		}
+	}
+}
+
+// Writes pending blob CIDs to the checkpoint store. On failure they are kept for the next flush.
+func (p *LabelerPool) flushCheckpoint(ctx context.Context) error {
+	p.pendingLk.Lock()
+	batch := p.pending
+	p.pending = nil
+	p.pendingLk.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := p.checkpoint.Mark(ctx, batch); err != nil {
+		p.pendingLk.Lock()
+		p.pending = append(batch, p.pending...)
+		p.pendingLk.Unlock()
+		return err
+	}
+	return nil
+}
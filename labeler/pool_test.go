@@ -0,0 +1,135 @@
+package labeler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+type slowLabeler struct {
+	calls atomic.Int64
+}
+
+func (sl *slowLabeler) LabelBlob(ctx context.Context, blob lexutil.LexBlob, blobBytes []byte) ([]string, error) {
+	sl.calls.Add(1)
+	select {
+	case <-time.After(10 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []string{string(blobBytes)}, nil
+}
+
+func TestLabelerPool(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	sl := &slowLabeler{}
+	pool := NewLabelerPool(sl, &LabelerPoolOptions{Workers: 3, QueueSize: 2})
+
+	var results []string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for res := range pool.Results() {
+			assert.NoError(res.Err)
+			results = append(results, res.Labels...)
+		}
+	}()
+
+	var callbacks atomic.Int64
+	for i := 0; i < 10; i++ {
+		job := &LabelJob{Blob: testBlob(t, "image/png"), BlobBytes: []byte("label")}
+		if i%2 == 0 {
+			job.Callback = func(res *LabelResult) {
+				assert.NoError(res.Err)
+				callbacks.Add(1)
+			}
+		}
+		assert.NoError(pool.Submit(ctx, job))
+	}
+
+	// shutdown drains everything already queued
+	assert.NoError(pool.Shutdown(ctx))
+	wg.Wait()
+	assert.Equal(int64(10), sl.calls.Load())
+	assert.Equal(int64(5), callbacks.Load())
+	assert.Equal(5, len(results))
+
+	assert.ErrorIs(pool.Submit(ctx, &LabelJob{}), ErrPoolClosed)
+}
+
+type memCheckpointStore struct {
+	lk    sync.Mutex
+	done  map[string]bool
+	marks int
+}
+
+func (s *memCheckpointStore) Mark(ctx context.Context, blobCIDs []string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.marks++
+	for _, c := range blobCIDs {
+		s.done[c] = true
+	}
+	return nil
+}
+
+func (s *memCheckpointStore) Contains(ctx context.Context, blobCID string) (bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.done[blobCID], nil
+}
+
+func TestLabelerPoolCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var blobs []lexutil.LexBlob
+	for _, b := range []string{"one", "two", "three"} {
+		c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs = append(blobs, lexutil.LexBlob{Ref: lexutil.LexLink(c), MimeType: "image/png"})
+	}
+
+	store := &memCheckpointStore{done: map[string]bool{}}
+	run := func(blobs []lexutil.LexBlob) (labeled, skipped int) {
+		pool := NewLabelerPool(&slowLabeler{}, &LabelerPoolOptions{Workers: 2, QueueSize: 10, Checkpoint: store, CheckpointInterval: time.Hour})
+		for _, b := range blobs {
+			assert.NoError(pool.Submit(ctx, &LabelJob{Blob: b, BlobBytes: []byte("label")}))
+		}
+		assert.NoError(pool.Shutdown(ctx))
+		for res := range pool.Results() {
+			assert.NoError(res.Err)
+			if res.Skipped {
+				skipped++
+			} else {
+				labeled++
+			}
+		}
+		return labeled, skipped
+	}
+
+	// first run labels two blobs; Shutdown flushes them to the store in one batch
+	labeled, skipped := run(blobs[:2])
+	assert.Equal(2, labeled)
+	assert.Equal(0, skipped)
+	assert.Equal(1, store.marks)
+
+	// "restart" with the whole backlog
+	labeled, skipped = run(blobs)
+	assert.Equal(1, labeled)
+	assert.Equal(2, skipped)
+	assert.Len(store.done, 3)
+}
@@ -0,0 +1,91 @@
+package labeler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// Decodes an image and re-encodes it so that neither edge exceeds maxEdge pixels, preserving aspect ratio.
+//
+// Returns the original bytes (and false) if the image is already small enough, unless force is set, in which case the image is always re-encoded. Returns an error if the image format is not supported by the decoders registered in this package (JPEG, PNG, GIF).
+func downscaleImage(imgBytes []byte, maxEdge int, force bool) ([]byte, bool, error) {
+	if maxEdge <= 0 {
+		return imgBytes, false, nil
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(imgBytes))
+	if err != nil {
+		return nil, false, fmt.Errorf("unsupported image format: %w", err)
+	}
+	if cfg.Width <= maxEdge && cfg.Height <= maxEdge && !force {
+		return imgBytes, false, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(imgBytes))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	w, h := cfg.Width, cfg.Height
+	if w > maxEdge || h > maxEdge {
+		if w >= h {
+			h = max(1, h*maxEdge/w)
+			w = maxEdge
+		} else {
+			w = max(1, w*maxEdge/h)
+			h = maxEdge
+		}
+	}
+	dst := resizeBox(src, w, h)
+
+	out := &bytes.Buffer{}
+	switch format {
+	case "png", "gif":
+		// keep alpha channel
+		err = png.Encode(out, dst)
+	default:
+		err = jpeg.Encode(out, dst, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode resized image: %w", err)
+	}
+	return out.Bytes(), true, nil
+}
+
+// Simple area-averaging ("box filter") resize. Only suitable for downscaling, which is all we need here.
+func resizeBox(src image.Image, w, h int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	for y := 0; y < h; y++ {
+		y0 := sb.Min.Y + y*sh/h
+		y1 := max(y0+1, sb.Min.Y+(y+1)*sh/h)
+		for x := 0; x < w; x++ {
+			x0 := sb.Min.X + x*sw/w
+			x1 := max(x0+1, sb.Min.X+(x+1)*sw/w)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8((r / n) >> 8),
+				G: uint8((g / n) >> 8),
+				B: uint8((b / n) >> 8),
+				A: uint8((a / n) >> 8),
+			})
+		}
+	}
+	return dst
+}
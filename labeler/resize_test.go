@@ -0,0 +1,43 @@
+package labeler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownscaleImage(t *testing.T) {
+	assert := assert.New(t)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	assert.NoError(png.Encode(buf, src))
+
+	// already small enough
+	out, resized, err := downscaleImage(buf.Bytes(), 1000, false)
+	assert.NoError(err)
+	assert.False(resized)
+	assert.Equal(buf.Bytes(), out)
+
+	out, resized, err = downscaleImage(buf.Bytes(), 100, false)
+	assert.NoError(err)
+	assert.True(resized)
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+	assert.NoError(err)
+	assert.Equal("png", format)
+	assert.Equal(100, cfg.Width)
+	assert.Equal(50, cfg.Height)
+
+	// unsupported format
+	_, _, err = downscaleImage([]byte("not an image"), 100, false)
+	assert.Error(err)
+}
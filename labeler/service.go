@@ -125,9 +125,14 @@ func (s *Server) AddKeywordLabeler(kwl KeywordLabeler) {
 }
 
 func (s *Server) AddMicroNSFWImgLabeler(url string) {
-	log.Infof("configuring micro-NSFW-img labeler url=%s", url)
 	mnil := NewMicroNSFWImgLabeler(url)
-	s.muNSFWImgLabeler = &mnil
+	s.SetMicroNSFWImgLabeler(&mnil)
+}
+
+// Like AddMicroNSFWImgLabeler, but with a labeler the caller has already configured (eg, with a LabelPolicy, downscaling, result caching, or a circuit breaker enabled)
+func (s *Server) SetMicroNSFWImgLabeler(mnil *MicroNSFWImgLabeler) {
+	log.Infof("configuring micro-NSFW-img labeler url=%s", mnil.Endpoint)
+	s.muNSFWImgLabeler = mnil
 }
 
 func (s *Server) AddHiveAILabeler(apiToken string) {
@@ -0,0 +1,52 @@
+package xrpc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+func TestTypedError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/com.atproto.repo.applyWrites" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "InvalidSwap", "message": "Commit was at bafyreixyz"}`))
+	}))
+	defer srv.Close()
+
+	c := &xrpc.Client{Host: srv.URL}
+	swap := "bafyreiabc"
+	err := atproto.RepoApplyWrites(context.Background(), c, &atproto.RepoApplyWrites_Input{
+		Repo:       "did:plc:testuser",
+		SwapCommit: &swap,
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	var xe *xrpc.XRPCError
+	if !errors.As(err, &xe) {
+		t.Fatalf("expected an XRPCError, got: %v", err)
+	}
+	if xe.ErrStr != "InvalidSwap" || xe.Message != "Commit was at bafyreixyz" {
+		t.Fatalf("unexpected error fields: %+v", xe)
+	}
+	var he *xrpc.Error
+	if !errors.As(err, &he) || he.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got: %v", err)
+	}
+	if xrpc.ErrorName(err) != "InvalidSwap" {
+		t.Fatalf("unexpected error name: %q", xrpc.ErrorName(err))
+	}
+	if xrpc.ErrorName(errors.New("some other error")) != "" {
+		t.Fatal("expected no error name for a plain error")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -43,6 +44,7 @@ type AuthInfo struct {
 	Did        string `json:"did"`
 }
 
+// Structured error body returned by XRPC servers. Errors returned by Client.Do for non-200 responses wrap one of these (inside an *Error, which carries the HTTP status) whenever the server sent a JSON error body, so callers can use errors.As, or ErrorName, to branch on the error name (eg, "InvalidSwap", "RecordNotFound").
 type XRPCError struct {
 	ErrStr  string `json:"error"`
 	Message string `json:"message"`
@@ -52,6 +54,15 @@ func (xe *XRPCError) Error() string {
 	return fmt.Sprintf("%s: %s", xe.ErrStr, xe.Message)
 }
 
+// ErrorName returns the XRPC error name (the "error" field of the response body) from an error returned by Client.Do, or an empty string if err does not carry one.
+func ErrorName(err error) string {
+	var xe *XRPCError
+	if errors.As(err, &xe) {
+		return xe.ErrStr
+	}
+	return ""
+}
+
 type Error struct {
 	StatusCode int
 	Wrapped    error